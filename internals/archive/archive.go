@@ -0,0 +1,493 @@
+//go:build linux
+// +build linux
+
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whiteout markers used in image layers (same convention as docker/OCI)
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = ".wh..wh..opq"
+)
+
+// overlayfs keeps the opaque marker in trusted.* when mounted by real root
+// and in user.* when mounted from a user namespace (userxattr)
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+type TarOptions struct {
+	// OverlayWhiteouts converts between overlayfs whiteouts (0/0 character
+	// devices and opaque directories) and the .wh. entries used in layers
+	OverlayWhiteouts bool
+
+	// SkipDirs lists directories, relative to the root, whose contents are
+	// left out of the stream. The directories themselves are still written,
+	// which is how mount points inside a container filesystem are handled.
+	SkipDirs []string
+
+	// Name, when set, writes root itself under that name with its contents
+	// below it, so a single file or directory can be streamed the way
+	// `congo cp` needs it
+	Name string
+
+	// Chown maps the owner of every entry written or extracted, used to
+	// translate between host and user namespace ids
+	Chown func(uid, gid int) (int, int)
+}
+
+// xattrPrefix is the PAX record prefix GNU tar and docker use for xattrs
+const xattrPrefix = "SCHILY.xattr."
+
+
+// inode identifies a file for hardlink detection, a tree may span mounts
+type inode struct {
+	dev, ino uint64
+}
+
+// Tar writes the contents of root to w as an uncompressed tar stream. Entries
+// are named relative to root and written in lexical order so the same tree
+// always produces the same stream.
+func Tar(w io.Writer, root string, opts TarOptions) error {
+	tw := tar.NewWriter(w)
+	hardlinks := make(map[inode]string)
+	skip := make(map[string]bool)
+	for _, dir := range opts.SkipDirs {
+		skip[filepath.Clean(strings.TrimPrefix(dir, "/"))] = true
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root && opts.Name == "" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		skipContents := skip[rel]
+		if opts.Name != "" {
+			rel = filepath.Join(opts.Name, rel)
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, _ := fi.Sys().(*syscall.Stat_t)
+		if st == nil {
+			return fmt.Errorf("unsupported file info for %s", path)
+		}
+
+		// overlayfs records deletions as 0/0 character devices
+		if opts.OverlayWhiteouts && fi.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0 {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(filepath.Dir(rel), WhiteoutPrefix+filepath.Base(rel)),
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		// Sockets can't be archived, they only make sense to a running process
+		if fi.Mode()&fs.ModeSocket != 0 {
+			return nil
+		}
+
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return fmt.Errorf("failed to create tar header for %s: %v", path, err)
+		}
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid = int(st.Uid)
+		hdr.Gid = int(st.Gid)
+		if opts.Chown != nil {
+			hdr.Uid, hdr.Gid = opts.Chown(hdr.Uid, hdr.Gid)
+		}
+		hdr.Uname = ""
+		hdr.Gname = ""
+		if fi.Mode()&(fs.ModeDevice|fs.ModeCharDevice) != 0 {
+			hdr.Devmajor = int64(unix.Major(st.Rdev))
+			hdr.Devminor = int64(unix.Minor(st.Rdev))
+		}
+
+		// Later names of an inode we've already written become hardlinks
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			id := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := hardlinks[id]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				hardlinks[id] = rel
+			}
+		}
+
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return err
+		}
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[xattrPrefix+name] = value
+		}
+		if len(hdr.PAXRecords) > 0 {
+			hdr.Format = tar.FormatPAX
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write tar header for %s: %v", path, err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to write %s to tar: %v", path, err)
+			}
+		}
+
+		if opts.OverlayWhiteouts && fi.IsDir() && IsOpaque(path) {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(rel, WhiteoutOpaque),
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			}); err != nil {
+				return err
+			}
+		}
+
+		if fi.IsDir() && skipContents {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Untar extracts a tar stream into dest. Whiteout entries either become
+// overlayfs whiteouts (OverlayWhiteouts) or delete the paths they name, which
+// is how a layer is applied on top of a flat directory.
+func Untar(r io.Reader, dest string, opts TarOptions) error {
+	tr := tar.NewReader(r)
+	created := make(map[string]bool)
+
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar stream: %v", err)
+		}
+
+		path, err := SafeJoin(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if path == dest {
+			continue
+		}
+		parent := filepath.Dir(path)
+		base := filepath.Base(path)
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %v", parent, err)
+		}
+
+		if strings.HasPrefix(base, WhiteoutPrefix) {
+			if err := applyWhiteout(parent, base, created, opts); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Anything but a directory replaces what was there before
+		if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("failed to replace %s: %v", path, err)
+			}
+		}
+
+		if opts.Chown != nil {
+			hdr.Uid, hdr.Gid = opts.Chown(hdr.Uid, hdr.Gid)
+		}
+		if err := createEntry(tr, hdr, dest, path); err != nil {
+			return err
+		}
+		created[path] = true
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path, hdr.ModTime})
+		}
+	}
+
+	// Directory mtimes change as entries are added, so set them last
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i].path) > len(dirs[j].path) })
+	for _, dir := range dirs {
+		setTimes(dir.path, dir.mtime)
+	}
+
+	return nil
+}
+
+func createEntry(tr *tar.Reader, hdr *tar.Header, dest, path string) error {
+	mode := uint32(hdr.FileInfo().Mode().Perm())
+	if hdr.Mode&04000 != 0 {
+		mode |= unix.S_ISUID
+	}
+	if hdr.Mode&02000 != 0 {
+		mode |= unix.S_ISGID
+	}
+	if hdr.Mode&01000 != 0 {
+		mode |= unix.S_ISVTX
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create directory %s: %v", path, err)
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create file %s: %v", path, err)
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write file %s: %v", path, err)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %v", path, err)
+		}
+	case tar.TypeLink:
+		target, err := SafeJoin(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return fmt.Errorf("failed to create hardlink %s: %v", path, err)
+		}
+		// A hardlink shares the inode, ownership and mode come from the target
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devType := uint32(unix.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			devType = unix.S_IFBLK
+		} else if hdr.Typeflag == tar.TypeFifo {
+			devType = unix.S_IFIFO
+		}
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(path, devType|mode, dev); err != nil {
+			return fmt.Errorf("failed to create device node %s: %v", path, err)
+		}
+	default:
+		// Skip entry types that have no filesystem representation
+		return nil
+	}
+
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil && os.Geteuid() == 0 {
+		return fmt.Errorf("failed to chown %s: %v", path, err)
+	}
+
+	if err := writeXattrs(path, hdr.PAXRecords); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := unix.Chmod(path, mode); err != nil {
+			return fmt.Errorf("failed to chmod %s: %v", path, err)
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeDir {
+		setTimes(path, hdr.ModTime)
+	}
+
+	return nil
+}
+
+func applyWhiteout(dir, base string, created map[string]bool, opts TarOptions) error {
+	if base == WhiteoutOpaque {
+		if opts.OverlayWhiteouts {
+			return setOpaque(dir)
+		}
+		// Opaque directory: hide everything lower layers put in it
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read directory %s: %v", dir, err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if !created[path] {
+				if err := os.RemoveAll(path); err != nil {
+					return fmt.Errorf("failed to remove %s: %v", path, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	path := filepath.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", path, err)
+	}
+	if opts.OverlayWhiteouts {
+		if err := unix.Mknod(path, unix.S_IFCHR, 0); err != nil {
+			return fmt.Errorf("failed to create whiteout %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// IsWhiteout reports whether the file at path is an overlayfs whiteout
+func IsWhiteout(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+// IsOpaque reports whether the directory at path is an overlayfs opaque directory
+func IsOpaque(path string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range opaqueXattrs {
+		if n, err := unix.Lgetxattr(path, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+func setOpaque(dir string) error {
+	var lastErr error
+	set := false
+	for _, attr := range opaqueXattrs {
+		if err := unix.Lsetxattr(dir, attr, []byte("y"), 0); err != nil {
+			lastErr = err
+			continue
+		}
+		set = true
+	}
+	if !set {
+		return fmt.Errorf("failed to mark %s opaque: %v", dir, lastErr)
+	}
+	return nil
+}
+
+// readXattrs returns the extended attributes of path. overlayfs' own
+// attributes are left out, whiteouts and opaque directories are carried as
+// .wh. entries instead.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		// Filesystems without xattr support simply have none
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, nil
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.") {
+			continue
+		}
+		value := make([]byte, 256)
+		n, err := unix.Lgetxattr(path, name, value)
+		if err == unix.ERANGE {
+			if n, err = unix.Lgetxattr(path, name, nil); err == nil {
+				value = make([]byte, n)
+				n, err = unix.Lgetxattr(path, name, value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xattr %s of %s: %v", name, path, err)
+		}
+		xattrs[name] = string(value[:n])
+	}
+	return xattrs, nil
+}
+
+// writeXattrs applies the xattrs recorded in PAX records. Attributes the
+// filesystem or our privileges don't allow (trusted.* in a user namespace)
+// are skipped.
+func writeXattrs(path string, records map[string]string) error {
+	for key, value := range records {
+		name := strings.TrimPrefix(key, xattrPrefix)
+		if name == key {
+			continue
+		}
+		err := unix.Lsetxattr(path, name, []byte(value), 0)
+		if err != nil && err != unix.ENOTSUP && err != unix.EPERM {
+			return fmt.Errorf("failed to set xattr %s on %s: %v", name, path, err)
+		}
+	}
+	return nil
+}
+
+func setTimes(path string, mtime time.Time) {
+	ts := []unix.Timespec{unix.NsecToTimespec(mtime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// SafeJoin joins name onto root without letting it escape root, either
+// through ".." components or through symlinks created by earlier entries
+func SafeJoin(root, name string) (string, error) {
+	path := filepath.Join(root, filepath.Clean("/"+name))
+
+	for dir := filepath.Dir(path); len(dir) > len(root); dir = filepath.Dir(dir) {
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to write %s through symlink %s", name, dir)
+		}
+	}
+
+	return path, nil
+}
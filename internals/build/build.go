@@ -0,0 +1,523 @@
+//go:build linux
+// +build linux
+
+package build
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"congo/internals/archive"
+	"congo/internals/container"
+	"congo/internals/image"
+	"congo/internals/registry"
+	"congo/internals/types"
+)
+
+// Options configures a build
+type Options struct {
+	ContextDir string    // directory COPY and ADD sources are relative to
+	File       string    // path of the Congofile, defaults to <ContextDir>/Congofile
+	Tags       []string  // references the final image is tagged with
+	NoCache    bool      // run every step even if the cache has a result
+	Out        io.Writer // progress output, defaults to os.Stdout
+}
+
+// Builder runs the steps of a Congofile, each step produces a new image that
+// the next step builds on
+type Builder struct {
+	opts Options
+	out  io.Writer
+}
+
+func NewBuilder(opts Options) *Builder {
+	if opts.File == "" {
+		opts.File = filepath.Join(opts.ContextDir, "Congofile")
+	}
+	out := opts.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	return &Builder{opts: opts, out: out}
+}
+
+// Build runs the Congofile and returns the ID of the resulting image
+func (b *Builder) Build() (string, error) {
+	f, err := os.Open(b.opts.File)
+	if err != nil {
+		return "", fmt.Errorf("failed to open Congofile: %v", err)
+	}
+	instructions, err := Parse(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if fi, err := os.Stat(b.opts.ContextDir); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("build context %s is not a directory", b.opts.ContextDir)
+	}
+
+	// The layers of every step are kept until the last one is tagged
+	unlock, err := image.LockLayers()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	var img *image.Image
+	for i, instruction := range instructions {
+		fmt.Fprintf(b.out, "Step %d/%d : %s\n", i+1, len(instructions), instruction.Original)
+
+		if instruction.Command == "FROM" {
+			if img, err = b.from(instruction.Args); err != nil {
+				return "", fmt.Errorf("line %d: %v", instruction.Line, err)
+			}
+			if img.ID != "" {
+				fmt.Fprintf(b.out, " ---> %s\n", image.ShortID(img.ID))
+			}
+			continue
+		}
+
+		key, err := b.cacheKey(img, instruction)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %v", instruction.Line, err)
+		}
+		if cached := lookupCache(key); cached != nil && !b.opts.NoCache {
+			img = cached
+			fmt.Fprintf(b.out, " ---> Using cache\n ---> %s\n", image.ShortID(img.ID))
+			continue
+		}
+
+		if img, err = b.execute(img, instruction); err != nil {
+			return "", fmt.Errorf("line %d: %v", instruction.Line, err)
+		}
+		if err := storeCache(key, img.ID); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(b.out, " ---> %s\n", image.ShortID(img.ID))
+	}
+
+	for _, tag := range b.opts.Tags {
+		if err := image.Tag(tag, img.ID); err != nil {
+			return "", err
+		}
+	}
+
+	return img.ID, nil
+}
+
+// from resolves the base image, pulling it when it isn't in the store.
+// "scratch" starts from an empty image.
+func (b *Builder) from(ref string) (*image.Image, error) {
+	if ref == "scratch" {
+		return &image.Image{}, nil
+	}
+
+	img, err := image.Lookup(ref)
+	if err == nil {
+		return img, nil
+	}
+
+	client := registry.NewClient()
+	client.Out = b.out
+	if img, err = client.Pull(ref); err != nil {
+		return nil, fmt.Errorf("failed to pull base image %s: %v", ref, err)
+	}
+	return img, nil
+}
+
+// execute runs one step on top of parent and stores the resulting image
+func (b *Builder) execute(parent *image.Image, instruction Instruction) (*image.Image, error) {
+	img := &image.Image{
+		Parent:  parent.ID,
+		Layers:  append([]string{}, parent.Layers...),
+		Config:  copyConfig(parent.Config),
+		Created: time.Now(),
+		History: append([]image.History{}, parent.History...),
+	}
+	history := image.History{Created: img.Created, CreatedBy: instruction.Original}
+
+	switch instruction.Command {
+	case "RUN":
+		layer, err := b.run(parent, instruction.Args)
+		if err != nil {
+			return nil, err
+		}
+		img.Layers = append(img.Layers, layer)
+	case "COPY", "ADD":
+		layer, err := b.copy(parent, instruction.Args, instruction.Command == "ADD")
+		if err != nil {
+			return nil, err
+		}
+		img.Layers = append(img.Layers, layer)
+	default:
+		// Everything else only changes the config
+		if err := image.ApplyChange(&img.Config, instruction.Original); err != nil {
+			return nil, err
+		}
+		history.EmptyLayer = true
+	}
+
+	img.History = append(img.History, history)
+	if _, err := image.SaveImage(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// run executes a RUN step in a temporary container created from parent and
+// returns the layer holding what it changed
+func (b *Builder) run(parent *image.Image, args string) (string, error) {
+	if len(parent.Layers) == 0 {
+		return "", fmt.Errorf("RUN needs a base image with a filesystem")
+	}
+	cmd, err := image.ParseCommand(args)
+	if err != nil {
+		return "", err
+	}
+
+	env := make(map[string]string)
+	for _, kv := range parent.Config.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		env[key] = value
+	}
+	if _, ok := env["PATH"]; !ok {
+		env["PATH"] = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	}
+
+	id, err := container.GenerateID()
+	if err != nil {
+		return "", err
+	}
+	state := types.ContainerState{
+		ID:         id,
+		Status:     "created",
+		CreatedAt:  time.Now(),
+		Command:    cmd,
+		WorkingDir: parent.Config.WorkingDir,
+		User:       parent.Config.User,
+		EnvVars:    env,
+		ImageID:    parent.ID,
+		UseLayers:  true,
+	}
+	if err := container.RegisterContainer(&state); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := container.RemoveContainer(id); err != nil {
+			log.Printf("Warning: failed to remove build container %s: %v", container.ShortID(id), err)
+		}
+	}()
+
+	if err := container.StartContainer(id, nil); err != nil {
+		return "", fmt.Errorf("RUN %s: %v", args, err)
+	}
+
+	upperDir := filepath.Join(container.GetContainerDir(id), types.OverlayUpperDir)
+	layer, err := image.PutLayerFromDir(upperDir, archive.TarOptions{OverlayWhiteouts: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to create layer: %v", err)
+	}
+	return layer, nil
+}
+
+// copy stages the sources of a COPY or ADD step in a scratch directory laid
+// out like the container's root and stores that as a layer. ADD also unpacks
+// local tar archives and downloads URLs.
+func (b *Builder) copy(parent *image.Image, args string, add bool) (string, error) {
+	srcs, dest, err := parseCopyArgs(args)
+	if err != nil {
+		return "", err
+	}
+	destIsDir := strings.HasSuffix(dest, "/") || len(srcs) > 1
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", parent.Config.WorkingDir, dest)
+	}
+
+	stage, err := os.MkdirTemp(image.GetLayerDir(), ".tmp-build-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(stage)
+	if err := os.Chmod(stage, 0755); err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	target := filepath.Join(stage, filepath.Clean(dest))
+
+	for _, src := range srcs {
+		if add && isURL(src) {
+			name := target
+			if destIsDir {
+				name = filepath.Join(target, path.Base(src))
+			}
+			if err := download(src, name); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		matches, err := b.resolveSource(src)
+		if err != nil {
+			return "", err
+		}
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case fi.IsDir():
+				// Like docker, a directory's contents are copied, not the directory itself
+				err = copyTree(match, target)
+			case add && isArchive(match):
+				err = extract(match, target)
+			case destIsDir:
+				err = copyFile(match, filepath.Join(target, filepath.Base(match)), fi.Mode())
+			default:
+				err = copyFile(match, target, fi.Mode())
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	layer, err := image.PutLayerFromDir(stage, archive.TarOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create layer: %v", err)
+	}
+	return layer, nil
+}
+
+// resolveSource expands a COPY source, which may be a glob, inside the build context
+func (b *Builder) resolveSource(src string) ([]string, error) {
+	pattern, err := archive.SafeJoin(b.opts.ContextDir, src)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %s: %v", src, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("source %s not found in build context", src)
+	}
+	return matches, nil
+}
+
+// parseCopyArgs splits COPY/ADD arguments, in shell or JSON form, into the
+// sources and the destination
+func parseCopyArgs(args string) ([]string, string, error) {
+	var words []string
+	if strings.HasPrefix(args, "[") {
+		if err := json.Unmarshal([]byte(args), &words); err != nil {
+			return nil, "", fmt.Errorf("invalid JSON form %s: %v", args, err)
+		}
+	} else {
+		words = strings.Fields(args)
+	}
+
+	if len(words) < 2 {
+		return nil, "", fmt.Errorf("COPY and ADD need at least one source and a destination")
+	}
+	return words[:len(words)-1], words[len(words)-1], nil
+}
+
+// cacheKey identifies a step by the image it runs on and the instruction.
+// COPY and ADD also hash their sources so changed files miss the cache.
+func (b *Builder) cacheKey(parent *image.Image, instruction Instruction) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n", parent.ID, instruction.Original)
+
+	if instruction.Command == "COPY" || instruction.Command == "ADD" {
+		srcs, _, err := parseCopyArgs(instruction.Args)
+		if err != nil {
+			return "", err
+		}
+		for _, src := range srcs {
+			if isURL(src) {
+				continue
+			}
+			matches, err := b.resolveSource(src)
+			if err != nil {
+				return "", err
+			}
+			for _, match := range matches {
+				if err := hashPath(hash, match); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashPath(w io.Writer, src string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return archive.Tar(w, src, archive.TarOptions{})
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(w, "%s %o\n", filepath.Base(src), fi.Mode())
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func cacheDir() string {
+	os.MkdirAll(types.DefaultBuildCacheDir, 0755)
+	return types.DefaultBuildCacheDir
+}
+
+// lookupCache returns the image a step produced before, images removed
+// since then count as a miss
+func lookupCache(key string) *image.Image {
+	data, err := os.ReadFile(filepath.Join(cacheDir(), key))
+	if err != nil {
+		return nil
+	}
+	img, err := image.LoadImage(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+func storeCache(key, id string) error {
+	if err := os.WriteFile(filepath.Join(cacheDir(), key), []byte(id+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write build cache: %v", err)
+	}
+	return nil
+}
+
+func copyConfig(cfg image.ImageConfig) image.ImageConfig {
+	// Round trip through JSON so maps and slices aren't shared with the parent
+	data, _ := json.Marshal(cfg)
+	var copied image.ImageConfig
+	json.Unmarshal(data, &copied)
+	return copied
+}
+
+func copyTree(src, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dest, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		// Owned by root in the image, like the files copyFile writes
+		pw.CloseWithError(archive.Tar(pw, src, archive.TarOptions{
+			Chown: func(uid, gid int) (int, int) { return 0, 0 },
+		}))
+	}()
+	err := archive.Untar(pr, dest, archive.TarOptions{})
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	return nil
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(dest), err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dest, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	return out.Close()
+}
+
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+func isArchive(src string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(src, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func extract(src, dest string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(src, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %v", src, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dest, err)
+	}
+	if err := archive.Untar(r, dest, archive.TarOptions{}); err != nil {
+		return fmt.Errorf("failed to extract %s: %v", src, err)
+	}
+	return nil
+}
+
+func download(url, dest string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(dest), err)
+	}
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dest, err)
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Instruction is one step of a Congofile
+type Instruction struct {
+	Command  string // upper-cased instruction name, e.g. RUN
+	Args     string // everything after the instruction name
+	Original string // the step as written, used in history and output
+	Line     int
+}
+
+var supported = map[string]bool{
+	"FROM":       true,
+	"RUN":        true,
+	"COPY":       true,
+	"ADD":        true,
+	"ENV":        true,
+	"WORKDIR":    true,
+	"USER":       true,
+	"CMD":        true,
+	"ENTRYPOINT": true,
+	"EXPOSE":     true,
+	"LABEL":      true,
+	"VOLUME":     true,
+	"STOPSIGNAL": true,
+}
+
+// Parse reads a Congofile. Lines ending in a backslash continue on the next
+// line and lines starting with # are comments. The first instruction has to
+// be FROM.
+func Parse(r io.Reader) ([]Instruction, error) {
+	var instructions []Instruction
+	var current strings.Builder
+	start := 0
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || (line == "" && current.Len() == 0) {
+			continue
+		}
+		if current.Len() == 0 {
+			start = lineNo
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSpace(strings.TrimSuffix(line, "\\")))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+
+		instruction, err := parseLine(current.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, instruction)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Congofile: %v", err)
+	}
+	if current.Len() > 0 {
+		return nil, fmt.Errorf("line %d: unterminated line continuation", start)
+	}
+
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("Congofile has no instructions")
+	}
+	if instructions[0].Command != "FROM" {
+		return nil, fmt.Errorf("line %d: the first instruction must be FROM", instructions[0].Line)
+	}
+
+	return instructions, nil
+}
+
+func parseLine(line string, lineNo int) (Instruction, error) {
+	command, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	command = strings.ToUpper(command)
+	args = strings.TrimSpace(args)
+
+	if !supported[command] {
+		return Instruction{}, fmt.Errorf("line %d: unknown instruction %s", lineNo, command)
+	}
+	if args == "" {
+		return Instruction{}, fmt.Errorf("line %d: %s requires at least one argument", lineNo, command)
+	}
+
+	return Instruction{
+		Command:  command,
+		Args:     args,
+		Original: command + " " + args,
+		Line:     lineNo,
+	}, nil
+}
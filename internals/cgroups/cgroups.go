@@ -13,7 +13,10 @@ import(
 )
 
 func SetupCgroups(config *types.Config) error {
-    containerId := fmt.Sprintf("container-%d", os.Getpid())
+    containerId := filepath.Join(config.CgroupParent, ContainerCgroup(config.ContainerID))
+    if config.ContainerID == "" {
+        containerId = filepath.Join(config.CgroupParent, fmt.Sprintf("container-%d", os.Getpid()))
+    }
     cgroupPaths := map[string]string{
         "pids":   filepath.Join("/sys/fs/cgroup/pids", containerId),
         "memory": filepath.Join("/sys/fs/cgroup/memory", containerId),
@@ -56,3 +59,42 @@ func SetupCgroups(config *types.Config) error {
 
     return nil
 }
+
+// ContainerCgroup is the name of a container's cgroup under its parent
+func ContainerCgroup(containerID string) string {
+    return "congo-" + containerID
+}
+
+// subsystems are the cgroup v1 hierarchies a cgroup parent is created in
+var subsystems = []string{"pids", "memory", "cpu", "blkio"}
+
+// JoinCgroup moves a process into a cgroup, such as a pod container's
+// below the pod's parent, in every hierarchy. Its descendants start there
+// too, and a parent's counters account for all of its cgroups.
+func JoinCgroup(cgroup string, pid int) error {
+    for _, subsystem := range subsystems {
+        path := filepath.Join("/sys/fs/cgroup", subsystem, cgroup)
+        if err := os.MkdirAll(path, 0755); err != nil {
+            return fmt.Errorf("failed to create cgroup path %s: %v", path, err)
+        }
+        if err := os.WriteFile(filepath.Join(path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+            return fmt.Errorf("failed to add process to cgroup %s: %v", path, err)
+        }
+    }
+    return nil
+}
+
+// RemoveParent removes a cgroup parent and the cgroups of its containers
+// from every hierarchy, ones still holding processes are left alone
+func RemoveParent(parent string) {
+    for _, subsystem := range subsystems {
+        dir := filepath.Join("/sys/fs/cgroup", subsystem, parent)
+        entries, _ := os.ReadDir(dir)
+        for _, entry := range entries {
+            if entry.IsDir() {
+                os.Remove(filepath.Join(dir, entry.Name()))
+            }
+        }
+        os.Remove(dir)
+    }
+}
@@ -5,12 +5,18 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
-
-	//"strings"
+	"strings"
 
 	"congo/internals/container"
+	"congo/internals/dns"
+	"congo/internals/image"
+	"congo/internals/network"
 	"congo/internals/types"
 )
 
@@ -20,6 +26,7 @@ func ParseConfig(args []string, isChild bool) (*types.Config, error) {
 		Mounts:       make([]types.Mount, 0),
 		Capabilities: make([]string, 0),
 		Network: types.NetworkConfig{
+			Mode:     network.ModeBridge,
 			Bridge:   "congo0", // Default bridge name
 			PortMaps: make([]types.PortMapping, 0),
 		},
@@ -34,6 +41,7 @@ func ParseConfig(args []string, isChild bool) (*types.Config, error) {
 			MonitorMemory:    true,
 			MonitorProcesses: true,
 		},
+		UseLayers:   true,
 		Interactive: false,
 		Detached:    false,
 		StateDir:    container.GetStateDir(),
@@ -50,7 +58,8 @@ func ParseConfig(args []string, isChild bool) (*types.Config, error) {
 	config.EnvVars["TERM"] = args[5]
 	config.EnvVars["LANG"] = args[6]
 
-	cmdIndex := 7
+	// The command is optional when an image provides a default one
+	cmdIndex := len(args)
 	for i, arg := range args {
 		if arg == "--" {
 			cmdIndex = i
@@ -58,9 +67,12 @@ func ParseConfig(args []string, isChild bool) (*types.Config, error) {
 		}
 	}
 
-	if cmdIndex == len(args) {
-		return nil, fmt.Errorf("no command specified")
-	}
+	// Flags given on the command line take precedence over image defaults
+	env := make(map[string]string)
+	labels := make(map[string]string)
+	var entrypoint []string
+	entrypointSet := false
+	publishAll := false
 
 	// Parse additional arguments before --
 	currentIdx := 7
@@ -83,6 +95,12 @@ func ParseConfig(args []string, isChild bool) (*types.Config, error) {
 			}
 			config.Rootfs = args[currentIdx+1]
 			currentIdx += 2
+		case "--image":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing image name")
+			}
+			config.Image = args[currentIdx+1]
+			currentIdx += 2
 		case "--user":
 			if currentIdx+1 >= cmdIndex {
 				return nil, fmt.Errorf("missing user specification")
@@ -152,27 +170,341 @@ func ParseConfig(args []string, isChild bool) (*types.Config, error) {
 			}
 			config.ContainerID = args[currentIdx+1]
 			currentIdx += 2
+		case "--name":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing container name")
+			}
+			config.Name = args[currentIdx+1]
+			currentIdx += 2
+		case "--network", "--net":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing network mode")
+			}
+			config.Network.Mode = args[currentIdx+1]
+			currentIdx += 2
+		case "--ip", "--ip6":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing IP address")
+			}
+			ips, err := network.SetRequestedIP(config.Network.ContainerIPs, args[currentIdx], args[currentIdx+1])
+			if err != nil {
+				return nil, err
+			}
+			config.Network.ContainerIPs = ips
+			currentIdx += 2
+		case "--publish", "-p":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing port mapping")
+			}
+			port, err := network.ParsePortMapping(args[currentIdx+1])
+			if err != nil {
+				return nil, err
+			}
+			config.Network.PortMaps = append(config.Network.PortMaps, port)
+			currentIdx += 2
+		case "--publish-all", "-P":
+			publishAll = true
+			currentIdx++
+		case "--dns":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing DNS server")
+			}
+			if net.ParseIP(args[currentIdx+1]) == nil {
+				return nil, fmt.Errorf("invalid DNS server address: %s", args[currentIdx+1])
+			}
+			config.Network.DNS = append(config.Network.DNS, args[currentIdx+1])
+			currentIdx += 2
+		case "--dns-search":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing DNS search domain")
+			}
+			config.Network.DNSSearch = append(config.Network.DNSSearch, args[currentIdx+1])
+			currentIdx += 2
+		case "--add-host":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing extra host")
+			}
+			if _, err := dns.ParseHost(args[currentIdx+1]); err != nil {
+				return nil, err
+			}
+			config.Network.ExtraHosts = append(config.Network.ExtraHosts, args[currentIdx+1])
+			currentIdx += 2
 		case "--hostname":
 			if currentIdx+1 >= cmdIndex {
 				return nil, fmt.Errorf("missing hostname")
 			}
 			config.Hostname = args[currentIdx+1]
 			currentIdx += 2
+		case "--pod":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing pod")
+			}
+			config.Pod = args[currentIdx+1]
+			currentIdx += 2
+		case "--pid", "--ipc", "--uts", "--userns":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing %s mode", strings.TrimPrefix(args[currentIdx], "--"))
+			}
+			switch args[currentIdx] {
+			case "--pid":
+				config.Namespaces.PID = args[currentIdx+1]
+			case "--ipc":
+				config.Namespaces.IPC = args[currentIdx+1]
+			case "--userns":
+				config.Namespaces.User = args[currentIdx+1]
+			default:
+				config.Namespaces.UTS = args[currentIdx+1]
+			}
+			currentIdx += 2
+		case "--no-overlay":
+			config.UseLayers = false
+			currentIdx++
+		case "--env", "-e":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing environment variable")
+			}
+			key, value, ok := strings.Cut(args[currentIdx+1], "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("invalid environment variable, expected KEY=value: %s", args[currentIdx+1])
+			}
+			env[key] = value
+			currentIdx += 2
+		case "--label", "-l":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing label")
+			}
+			key, value, err := parseLabel(args[currentIdx+1])
+			if err != nil {
+				return nil, err
+			}
+			labels[key] = value
+			currentIdx += 2
+		case "--label-file":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing label file")
+			}
+			if err := readLabelFile(args[currentIdx+1], labels); err != nil {
+				return nil, err
+			}
+			currentIdx += 2
+		case "--entrypoint":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing entrypoint")
+			}
+			// An empty entrypoint clears the image's one
+			entrypoint = nil
+			if args[currentIdx+1] != "" {
+				entrypoint = []string{args[currentIdx+1]}
+			}
+			entrypointSet = true
+			currentIdx += 2
+		case "--workdir", "-w":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing working directory")
+			}
+			config.WorkingDir = args[currentIdx+1]
+			currentIdx += 2
+		case "--stop-signal":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing stop signal")
+			}
+			config.StopSignal = args[currentIdx+1]
+			currentIdx += 2
+		case "--read-only":
+			config.ReadOnly = true
+			currentIdx++
+		case "--tmpfs":
+			if currentIdx+1 >= cmdIndex {
+				return nil, fmt.Errorf("missing tmpfs specification")
+			}
+			tmpfs, err := ParseTmpfsSpec(args[currentIdx+1])
+			if err != nil {
+				return nil, err
+			}
+			config.Tmpfs = append(config.Tmpfs, tmpfs)
+			currentIdx += 2
 
 		default:
 			return nil, fmt.Errorf("unknown option: %s", args[currentIdx])
 		}
 	}
 
-	config.Command = args[cmdIndex+1:]
+	if cmdIndex < len(args) {
+		config.Command = args[cmdIndex+1:]
+	}
+
+	// Resolve the image to the layer directories used as overlay lowerdirs
+	var imgConfig image.ImageConfig
+	if config.Image != "" {
+		img, err := image.Lookup(config.Image)
+		if err != nil {
+			return nil, err
+		}
+		config.ImageID = img.ID
+		config.ImageLayers = image.LayerPaths(img)
+		imgConfig = img.Config
+	}
+	applyImageConfig(config, imgConfig, entrypoint, entrypointSet)
+
+	for key, value := range env {
+		config.EnvVars[key] = value
+	}
+	if publishAll {
+		if err := publishExposedPorts(config); err != nil {
+			return nil, err
+		}
+	}
+	if len(labels) > 0 && config.Labels == nil {
+		config.Labels = make(map[string]string, len(labels))
+	}
+	for key, value := range labels {
+		config.Labels[key] = value
+	}
+
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("no command specified")
+	}
+
 	return config, nil
 }
 
+// applyImageConfig fills in the image defaults for whatever the command line
+// left unset. Like docker, a command given on the command line replaces the
+// image's Cmd and is appended to its Entrypoint, and setting --entrypoint
+// drops the image's Cmd as well.
+func applyImageConfig(config *types.Config, imgConfig image.ImageConfig, entrypoint []string, entrypointSet bool) {
+	for _, kv := range imgConfig.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		config.EnvVars[key] = value
+	}
+
+	cmd := config.Command
+	if !entrypointSet {
+		entrypoint = imgConfig.Entrypoint
+		if len(cmd) == 0 {
+			cmd = imgConfig.Cmd
+		}
+	}
+	config.Entrypoint = entrypoint
+	config.Command = append(append([]string{}, entrypoint...), cmd...)
+
+	if config.WorkingDir == "" {
+		config.WorkingDir = imgConfig.WorkingDir
+	}
+	if config.User == "" {
+		config.User = imgConfig.User
+	}
+	if config.StopSignal == "" {
+		config.StopSignal = imgConfig.StopSignal
+	}
+
+	for port := range imgConfig.ExposedPorts {
+		config.ExposedPorts = append(config.ExposedPorts, port)
+	}
+	sort.Strings(config.ExposedPorts)
+	for volume := range imgConfig.Volumes {
+		config.Volumes = append(config.Volumes, volume)
+	}
+	sort.Strings(config.Volumes)
+
+	if len(imgConfig.Labels) > 0 {
+		config.Labels = make(map[string]string, len(imgConfig.Labels))
+		for key, value := range imgConfig.Labels {
+			config.Labels[key] = value
+		}
+	}
+}
+
+// publishExposedPorts adds a mapping to a random host port for every exposed
+// port the command line didn't publish already
+func publishExposedPorts(config *types.Config) error {
+	for _, exposed := range config.ExposedPorts {
+		port, err := network.ParsePortMapping(exposed)
+		if err != nil {
+			return fmt.Errorf("invalid exposed port %s: %v", exposed, err)
+		}
+		published := false
+		for _, existing := range config.Network.PortMaps {
+			published = published || (existing.ContainerPort == port.ContainerPort && existing.Protocol == port.Protocol)
+		}
+		if !published {
+			config.Network.PortMaps = append(config.Network.PortMaps, port)
+		}
+	}
+	return nil
+}
+
+// parseLabel splits a key=value label, a bare key gets an empty value
+func parseLabel(label string) (string, string, error) {
+	key, value, _ := strings.Cut(label, "=")
+	if strings.TrimSpace(key) == "" {
+		return "", "", fmt.Errorf("invalid label, expected key=value: %s", label)
+	}
+	return key, value, nil
+}
+
+// readLabelFile adds the labels in a file with one key=value per line,
+// blank lines and lines starting with # are skipped
+func readLabelFile(path string, labels map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read label file: %v", err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := parseLabel(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		labels[key] = value
+	}
+	return nil
+}
+
 func ValidateConfig(config *types.Config) error {
 	if config == nil {
 		return fmt.Errorf("config cannot be nil")
 	}
 
+	if config.Image != "" && !config.UseLayers {
+		return fmt.Errorf("images can only be run with an overlay rootfs")
+	}
+	if config.Image != "" && config.Rootfs != "" {
+		return fmt.Errorf("--image and --rootfs are mutually exclusive")
+	}
+
+	// A pod decides the container's namespaces
+	if err := container.JoinPod(config); err != nil {
+		return err
+	}
+	if err := container.ValidateNamespaces(config); err != nil {
+		return err
+	}
+	// The network of a container sharing another's is that container's
+	if !strings.HasPrefix(config.Network.Mode, container.NamespaceContainer) {
+		if err := validateNetwork(config); err != nil {
+			return err
+		}
+	}
+
+	if config.WorkingDir != "" && !filepath.IsAbs(config.WorkingDir) {
+		return fmt.Errorf("working directory must be an absolute path: %s", config.WorkingDir)
+	}
+	if config.StopSignal != "" {
+		if _, err := container.ParseSignal(config.StopSignal); err != nil {
+			return err
+		}
+	}
+
+	for _, tmpfs := range config.Tmpfs {
+		if !filepath.IsAbs(tmpfs.Destination) {
+			return fmt.Errorf("tmpfs destination must be an absolute path: %s", tmpfs.Destination)
+		}
+	}
+
 	if config.User != "" {
 		if _, err := exec.LookPath("su"); err != nil {
 			return fmt.Errorf("su command not found, required for user switching")
@@ -181,3 +513,46 @@ func ValidateConfig(config *types.Config) error {
 
 	return nil
 }
+
+// validateNetwork checks the options of a container on a network of its own
+// and replaces an ID (prefix) of the network by its name, which is how
+// containers on it are found
+func validateNetwork(config *types.Config) error {
+	netw, err := container.LookupNetwork(config.Network.Mode)
+	if err != nil {
+		return err
+	}
+	if config.Network.Mode != "" {
+		config.Network.Mode = netw.Name
+	}
+	for _, ip := range config.Network.ContainerIPs {
+		if netw.Driver != network.DriverBridge {
+			return fmt.Errorf("--ip and --ip6 can only be used with a bridge network")
+		}
+		if net.ParseIP(ip).To4() == nil && netw.IPv6Subnet == "" {
+			return fmt.Errorf("--ip6 needs a network with IPv6, %s has none", netw.Name)
+		}
+		if net.ParseIP(ip).To4() != nil && netw.Subnet == "" {
+			return fmt.Errorf("--ip needs a network with IPv4, %s has none", netw.Name)
+		}
+	}
+	if len(config.Network.PortMaps) > 0 && netw.Driver != network.DriverBridge {
+		return fmt.Errorf("ports can only be published on a bridge network")
+	}
+	return nil
+}
+
+// ParseTmpfsSpec parses a --tmpfs value of the form <path>[:<options>]
+func ParseTmpfsSpec(spec string) (types.TmpfsMount, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if parts[0] == "" {
+		return types.TmpfsMount{}, fmt.Errorf("invalid tmpfs specification: %s", spec)
+	}
+
+	tmpfs := types.TmpfsMount{Destination: filepath.Clean(parts[0])}
+	if len(parts) == 2 {
+		tmpfs.Options = parts[1]
+	}
+
+	return tmpfs, nil
+}
@@ -4,14 +4,17 @@
 package container
 
 import (
+	"congo/internals/archive"
+	"congo/internals/image"
+	"congo/internals/network"
 	"congo/internals/types"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -27,17 +30,46 @@ func RemoveContainer(containerID string) error {
 		return fmt.Errorf("failed to load container state: %v", err)
 	}
 
+	if state.Infra {
+		return fmt.Errorf("container %s is the infra container of a pod, remove the pod instead", state.Name)
+	}
+	return removeContainer(state)
+}
+
+// removeContainer removes a stopped container nothing depends on anymore
+func removeContainer(state types.ContainerState) error {
+	containerID := state.ID
+
 	// Check if container is running
 	if state.Status == "running" {
 		return fmt.Errorf("cannot remove running container %s, stop it first", containerID)
 	}
 
+	// Containers sharing its namespaces couldn't start anymore
+	dependents, err := NamespaceDependents(state.ID)
+	if err != nil {
+		return err
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("cannot remove container %s, its namespaces are shared by %s", state.Name, strings.Join(dependents, ", "))
+	}
+
 	// Remove container state file
 	stateFile := filepath.Join(GetStateDir(), containerID+".json")
 	if err := os.Remove(stateFile); err != nil {
 		return fmt.Errorf("failed to remove container state file: %v", err)
 	}
 
+	// A container that died on its own may still hold its address
+	if err := ReleaseNetwork(&state); err != nil {
+		log.Printf("Warning: failed to release container address: %v", err)
+	}
+
+	// Remove the container's overlay upper/work directories
+	if err := os.RemoveAll(GetContainerDir(containerID)); err != nil {
+		log.Printf("Warning: failed to remove container directory: %v", err)
+	}
+
 	// Clean up log directory if exists
 	if state.LogDir != "" {
 		if err := os.RemoveAll(state.LogDir); err != nil {
@@ -59,10 +91,11 @@ func UpdateContainerResources(containerID, memory, cpu string, pids int) error {
 	if state.Status == "" {
 		return fmt.Errorf("container %s does not exist", containerID)
 	}
+	cgroup := containerCgroup(state)
 
 	// Update memory limit if specified
 	if memory != "" {
-		memoryPath := filepath.Join("/sys/fs/cgroup/memory", "congo-"+containerID, "memory.limit_in_bytes")
+		memoryPath := filepath.Join("/sys/fs/cgroup/memory", cgroup, "memory.limit_in_bytes")
 		if err := os.WriteFile(memoryPath, []byte(memory), 0644); err != nil {
 			return fmt.Errorf("failed to update memory limit: %v", err)
 		}
@@ -71,7 +104,7 @@ func UpdateContainerResources(containerID, memory, cpu string, pids int) error {
 
 	// Update CPU shares if specified
 	if cpu != "" {
-		cpuPath := filepath.Join("/sys/fs/cgroup/cpu", "congo-"+containerID, "cpu.shares")
+		cpuPath := filepath.Join("/sys/fs/cgroup/cpu", cgroup, "cpu.shares")
 		if err := os.WriteFile(cpuPath, []byte(cpu), 0644); err != nil {
 			return fmt.Errorf("failed to update CPU shares: %v", err)
 		}
@@ -80,7 +113,7 @@ func UpdateContainerResources(containerID, memory, cpu string, pids int) error {
 
 	// Update process limit if specified
 	if pids > 0 {
-		pidsPath := filepath.Join("/sys/fs/cgroup/pids", "congo-"+containerID, "pids.max")
+		pidsPath := filepath.Join("/sys/fs/cgroup/pids", cgroup, "pids.max")
 		if err := os.WriteFile(pidsPath, []byte(strconv.Itoa(pids)), 0644); err != nil {
 			return fmt.Errorf("failed to update process limit: %v", err)
 		}
@@ -95,7 +128,9 @@ func UpdateContainerResources(containerID, memory, cpu string, pids int) error {
 	return nil
 }
 
-func CommitContainer(containerID, imageName string) error {
+// CommitContainer stores a container's filesystem as a new image. Each change
+// is a Congofile instruction applied to the image config, see image.ApplyChange.
+func CommitContainer(containerID, imageName string, changes []string) error {
 	// Load container state
 	state, err := LoadContainerState(containerID)
 	if err != nil {
@@ -107,47 +142,121 @@ func CommitContainer(containerID, imageName string) error {
 		log.Printf("Warning: Committing a running container may result in inconsistent image")
 	}
 
-	// Create image directory
-	imageDir := filepath.Join("/var/lib/congo/images", imageName)
-	if err := os.MkdirAll(imageDir, 0755); err != nil {
-		return fmt.Errorf("failed to create image directory: %v", err)
+	unlock, err := image.LockLayers()
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	// Create a tarball of the container filesystem
-	tarPath := filepath.Join(imageDir, "rootfs.tar")
-	tarCmd := exec.Command("tar", "-C", state.RootDir, "-cf", tarPath, ".")
-	if err := tarCmd.Run(); err != nil {
-		return fmt.Errorf("failed to create image tarball: %v", err)
+	img := &image.Image{
+		Created:   time.Now(),
+		Container: containerID,
 	}
 
-	// Create image metadata file
-	metadata := struct {
-		ImageName   string            `json:"name"`
-		CreatedAt   time.Time         `json:"created_at"`
-		ContainerID string            `json:"container_id"`
-		EnvVars     map[string]string `json:"env_vars"`
-		Command     []string          `json:"command"`
-	}{
-		ImageName:   imageName,
-		CreatedAt:   time.Now(),
-		ContainerID: containerID,
-		EnvVars:     state.EnvVars,
-		Command:     state.Command,
+	// Start from the layers and config of the image the container runs
+	if state.ImageID != "" {
+		parent, err := image.LoadImage(state.ImageID)
+		if err != nil {
+			return fmt.Errorf("failed to load parent image: %v", err)
+		}
+		img.Parent = parent.ID
+		img.Layers = append(img.Layers, parent.Layers...)
+		img.Config = parent.Config
+		img.History = append(img.History, parent.History...)
+	} else if state.RootDir != "" {
+		// A plain rootfs directory becomes the base layer, identical
+		// directories end up as the same layer
+		base, err := image.PutLayerFromDir(state.RootDir, archive.TarOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to create base layer: %v", err)
+		}
+		img.Layers = append(img.Layers, base)
+		img.History = append(img.History, image.History{
+			Created:   img.Created,
+			CreatedBy: "congo commit: rootfs " + state.RootDir,
+		})
+	}
+
+	// Only the container's writable overlay layer goes into the new layer
+	upperDir := filepath.Join(GetContainerDir(containerID), types.OverlayUpperDir)
+	if _, err := os.Stat(upperDir); state.UseLayers && err == nil {
+		diff, err := image.PutLayerFromDir(upperDir, archive.TarOptions{OverlayWhiteouts: true})
+		if err != nil {
+			return fmt.Errorf("failed to create diff layer: %v", err)
+		}
+		img.Layers = append(img.Layers, diff)
+		img.History = append(img.History, image.History{
+			Created:   img.Created,
+			CreatedBy: "congo commit " + containerID,
+		})
+	}
+
+	if len(img.Layers) == 0 {
+		return fmt.Errorf("container %s has no filesystem to commit", containerID)
 	}
 
-	metadataJSON, err := json.MarshalIndent(metadata, "", "  ")
+	if len(state.EnvVars) > 0 {
+		img.Config.Env = FormatEnvList(state.EnvVars)
+	}
+	// The entrypoint was prepended to the command when the container was created
+	if len(state.Command) > len(state.Entrypoint) {
+		img.Config.Cmd = state.Command[len(state.Entrypoint):]
+	}
+	if len(state.Entrypoint) > 0 {
+		img.Config.Entrypoint = state.Entrypoint
+	}
+	if state.WorkingDir != "" {
+		img.Config.WorkingDir = state.WorkingDir
+	}
+	if state.User != "" {
+		img.Config.User = state.User
+	}
+	if state.StopSignal != "" {
+		img.Config.StopSignal = state.StopSignal
+	}
+	// The container's labels started out as the image's, so they replace them
+	if len(state.Labels) > 0 {
+		img.Config.Labels = make(map[string]string, len(state.Labels))
+		for key, value := range state.Labels {
+			img.Config.Labels[key] = value
+		}
+	}
+
+	for _, change := range changes {
+		if err := image.ApplyChange(&img.Config, change); err != nil {
+			return fmt.Errorf("invalid change %q: %v", change, err)
+		}
+	}
+	if len(changes) > 0 {
+		img.History = append(img.History, image.History{
+			Created:    img.Created,
+			CreatedBy:  "congo commit --change " + strings.Join(changes, " --change "),
+			EmptyLayer: true,
+		})
+	}
+
+	id, err := image.SaveImage(img)
 	if err != nil {
-		return fmt.Errorf("failed to marshal image metadata: %v", err)
+		return fmt.Errorf("failed to save image: %v", err)
 	}
 
-	metadataPath := filepath.Join(imageDir, "metadata.json")
-	if err := os.WriteFile(metadataPath, metadataJSON, 0644); err != nil {
-		return fmt.Errorf("failed to write image metadata: %v", err)
+	if err := image.Tag(imageName, id); err != nil {
+		return fmt.Errorf("failed to tag image: %v", err)
 	}
 
 	return nil
 }
 
+// FormatEnvList turns an environment map into sorted KEY=value entries
+func FormatEnvList(envVars map[string]string) []string {
+	env := make([]string, 0, len(envVars))
+	for k, v := range envVars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
 func PauseContainer(containerID string) error {
 	// Load container state
 	state, err := LoadContainerState(containerID)
@@ -343,6 +452,11 @@ func StartContainer(containerID string, args []string) error {
 		return fmt.Errorf("container %s is already running", containerID)
 	}
 
+	// Pods are started again through their infra container
+	if state.Infra {
+		return startInfra(&state)
+	}
+
 	// Reconstruct container configuration
 	containerArgs := BuildArgsFromState(state)
 
@@ -357,53 +471,63 @@ func StartContainer(containerID string, args []string) error {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	// Set up namespaces using unix constants (from golang.org/x/sys/unix)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: unix.CLONE_NEWUTS |
-			unix.CLONE_NEWPID |
-			unix.CLONE_NEWNS |
-			unix.CLONE_NEWNET |
-			unix.CLONE_NEWIPC |
-			unix.CLONE_NEWUSER,
-		UidMappings: []syscall.SysProcIDMap{
-			{
-				ContainerID: 0,
-				HostID:      int(os.Getuid()),
-				Size:        1,
-			},
-		},
-		GidMappings: []syscall.SysProcIDMap{
-			{
-				ContainerID: 0,
-				HostID:      int(os.Getgid()),
-				Size:        1,
-			},
-		},
-		Unshareflags: unix.CLONE_NEWNS,
-	}
-
-	if err := cmd.Start(); err != nil {
+	// The child waits on this pipe until its network is wired up
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create sync pipe: %v", err)
+	}
+	cmd.ExtraFiles = []*os.File{syncR}
+
+	// Set up namespaces, joining those shared with other containers
+	if err := StartProcess(cmd, &state); err != nil {
+		syncR.Close()
+		syncW.Close()
 		return fmt.Errorf("failed to start container: %v", err)
 	}
+	syncR.Close()
 
-	// Update container state
+	netConfig := types.NetworkConfig{
+		Mode:         state.Network.Mode,
+		Bridge:       state.Network.Bridge,
+		ContainerIPs: state.Network.RequestedIPs,
+		PortMaps:     state.Network.PortMaps,
+	}
+	if netConfig.Bridge == "" {
+		netConfig.Bridge = types.DefaultBridgeName
+	}
+	if err := ConnectNetwork(&state, cmd.Process.Pid, &netConfig, syncW); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("failed to set up container network: %v", err)
+	}
+
+	// Update container state, container root maps to the ids we started it with
 	state.Pid = cmd.Process.Pid
 	state.Status = "running"
-	state.CreatedAt = time.Now()
+	state.HostUID = os.Getuid()
+	state.HostGID = os.Getgid()
+	state.StartedAt = time.Now()
 	if err := SaveContainerState(containerID, state); err != nil {
 		return fmt.Errorf("failed to save container state: %v", err)
 	}
 
 	if !state.Detached {
-		if err := cmd.Wait(); err != nil {
-			return fmt.Errorf("container process exited with error: %v", err)
+		waitErr := cmd.Wait()
+		if err := CleanupPortForwarding(containerID); err != nil {
+			log.Printf("Warning: failed to clean up port forwarding rules: %v", err)
 		}
-		// Update state after container exits
+		if err := ReleaseNetwork(&state); err != nil {
+			log.Printf("Warning: failed to release container address: %v", err)
+		}
+		// Update state after container exits, a failing command stops it too
 		state.Status = "stopped"
 		state.Pid = 0
 		if err := SaveContainerState(containerID, state); err != nil {
 			return fmt.Errorf("failed to update container state: %v", err)
 		}
+		if waitErr != nil {
+			return fmt.Errorf("container process exited with error: %v", waitErr)
+		}
 	}
 
 	return nil
@@ -421,14 +545,54 @@ func StopContainer(containerID string, force bool) error {
 		return fmt.Errorf("container %s is not running", containerID)
 	}
 
+	// A container whose process exited on its own is still cleaned up below,
+	// its proxies would keep the host ports bound otherwise
+	if IsRunning(state) {
+		if err := terminate(state, force); err != nil {
+			return err
+		}
+	}
+
+	// Clean up network resources
+	if err := CleanupContainerNetwork(state.Pid); err != nil {
+		log.Printf("Warning: failed to clean up container network: %v", err)
+	}
+
+	// Clean up any port forwarding rules
+	if err := CleanupPortForwarding(containerID); err != nil {
+		log.Printf("Warning: failed to clean up port forwarding rules: %v", err)
+	}
+
+	if err := ReleaseNetwork(&state); err != nil {
+		log.Printf("Warning: failed to release container address: %v", err)
+	}
+
+	// Update container state
+	state.Status = "stopped"
+	state.Pid = 0
+	if err := SaveContainerState(containerID, state); err != nil {
+		return fmt.Errorf("failed to update container state: %v", err)
+	}
+
+	return nil
+}
+
+// terminate sends a running container its stop signal, or SIGKILL with
+// force, and waits for it to exit
+func terminate(state types.ContainerState, force bool) error {
 	// Send signal to container process
 	process, err := os.FindProcess(state.Pid)
 	if err != nil {
 		return fmt.Errorf("failed to find container process: %v", err)
 	}
 
-	// Send SIGTERM or SIGKILL
+	// Send the image's stop signal (SIGTERM by default) or SIGKILL
 	signal := unix.SIGTERM
+	if state.StopSignal != "" {
+		if signal, err = ParseSignal(state.StopSignal); err != nil {
+			return err
+		}
+	}
 	if force {
 		signal = unix.SIGKILL
 	}
@@ -448,7 +612,7 @@ func StopContainer(containerID string, force bool) error {
 		select {
 		case <-timeout:
 			if !force {
-				return fmt.Errorf("container %s did not stop within timeout", containerID)
+				return fmt.Errorf("container %s did not stop within timeout", state.ID)
 			}
 			// Force kill
 			if err := process.Kill(); err != nil {
@@ -457,29 +621,12 @@ func StopContainer(containerID string, force bool) error {
 			exited = true
 		case <-ticker.C:
 			// Check if process is still running
-			if _, err := process.Signal(syscall.Signal(0)); err != nil {
+			if err := process.Signal(syscall.Signal(0)); err != nil {
 				exited = true
 			}
 		}
 	}
 
-	// Clean up network resources
-	if err := CleanupContainerNetwork(state.Pid); err != nil {
-		log.Printf("Warning: failed to clean up container network: %v", err)
-	}
-
-	// Clean up any port forwarding rules
-	if err := CleanupPortForwarding(containerID); err != nil {
-		log.Printf("Warning: failed to clean up port forwarding rules: %v", err)
-	}
-
-	// Update container state
-	state.Status = "stopped"
-	state.Pid = 0
-	if err := SaveContainerState(containerID, state); err != nil {
-		return fmt.Errorf("failed to update container state: %v", err)
-	}
-
 	return nil
 }
 
@@ -487,12 +634,8 @@ func CleanupContainerNetwork(pid int) error {
 	// Clean up veth pair - the host side only, container side vanishes with namespace
 	hostVeth := fmt.Sprintf("hveth%d", pid)
 
-	// Check if the interface exists before trying to remove it
-	if _, err := net.InterfaceByName(hostVeth); err == nil {
-		// Remove host veth interface
-		if err := exec.Command("ip", "link", "del", hostVeth).Run(); err != nil {
-			return fmt.Errorf("failed to remove host veth interface: %v", err)
-		}
+	if err := network.DeleteLink(hostVeth); err != nil {
+		return fmt.Errorf("failed to remove host veth interface: %v", err)
 	}
 
 	return nil
@@ -506,37 +649,13 @@ func CleanupPortForwarding(containerID string) error {
 	}
 
 	// Check for network configuration in the state
-	if state.Network.ContainerIP == "" || len(state.Network.PortMaps) == 0 {
+	if len(state.Network.ContainerIPs) == 0 || len(state.Network.Ports) == 0 {
 		// No port mappings to clean up
 		return nil
 	}
 
-	// Remove iptables rules for each port mapping
-	for _, port := range state.Network.PortMaps {
-		rule := fmt.Sprintf(
-			"-t nat -D PREROUTING -p %s --dport %d -j DNAT --to-destination %s:%d",
-			port.Protocol,
-			port.HostPort,
-			state.Network.ContainerIP,
-			port.ContainerPort,
-		)
-
-		if err := exec.Command("iptables", strings.Split(rule, " ")...).Run(); err != nil {
-			log.Printf("Warning: failed to remove port forwarding rule: %v", err)
-		}
-
-		// Also clean up any related MASQUERADE rules
-		masqRule := fmt.Sprintf(
-			"-t nat -D POSTROUTING -p %s -s %s --dport %d -j MASQUERADE",
-			port.Protocol,
-			state.Network.ContainerIP,
-			port.ContainerPort,
-		)
-
-		if err := exec.Command("iptables", strings.Split(masqRule, " ")...).Run(); err != nil {
-			log.Printf("Warning: failed to remove masquerade rule: %v", err)
-		}
-	}
+	// Flush the container's DNAT rules or stop its proxies
+	network.UnpublishPorts(state.ID, state.Network.Firewall, state.Network.Ports)
 
 	log.Printf("Cleaned up port forwarding rules for container %s", containerID)
 	return nil
@@ -610,6 +729,29 @@ func GetStateDir() string {
 	return dir
 }
 
+// ImagesInUse returns the IDs of the images containers were created from,
+// those must stay in the image store
+func ImagesInUse() (map[string]bool, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make(map[string]bool)
+	for _, c := range containers {
+		if c.ImageID != "" {
+			inUse[c.ImageID] = true
+		}
+	}
+	return inUse, nil
+}
+
+// GetContainerDir returns the per-container directory in the state root that
+// holds the overlay upper, work and merged directories
+func GetContainerDir(containerID string) string {
+	return filepath.Join(GetStateDir(), containerID)
+}
+
 func SaveContainerState(containerID string, state types.ContainerState) error {
 	stateDir := GetStateDir()
 	stateFile := filepath.Join(stateDir, containerID+".json")
@@ -639,6 +781,24 @@ func LoadContainerState(containerID string) (types.ContainerState, error) {
 	if err := json.Unmarshal(data, &state); err != nil {
 		return types.ContainerState{}, fmt.Errorf("failed to unmarshal container state: %v", err)
 	}
+	// States written before dual-stack networks had a single address
+	var legacy struct {
+		Network struct{ RequestedIP, ContainerIP string }
+	}
+	if json.Unmarshal(data, &legacy) == nil {
+		if ip := legacy.Network.RequestedIP; ip != "" && len(state.Network.RequestedIPs) == 0 {
+			state.Network.RequestedIPs = []string{ip}
+		}
+		if ip := legacy.Network.ContainerIP; ip != "" && len(state.Network.ContainerIPs) == 0 {
+			state.Network.ContainerIPs = []string{ip}
+		}
+	}
+	// States written before UserNamespace was recorded come from versions
+	// that gave containers sharing namespaces none
+	var recorded struct{ UserNamespace *bool }
+	if json.Unmarshal(data, &recorded) == nil && recorded.UserNamespace == nil {
+		state.UserNamespace = state.Namespaces.PID != NamespaceHost && len(sharedNamespaces(state)) == 0
+	}
 
 	return state, nil
 }
@@ -671,21 +831,100 @@ func ListContainers() ([]types.ContainerState, error) {
 
 func BuildArgsFromState(state types.ContainerState) []string {
 	// Create a basic set of environment variables
+	// ParseConfig skips the first positional argument
 	args := []string{
-		"/bin/sh",     // Default PATH
+		state.ID,      // Placeholder
+		"/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", // Default PATH
 		"/root",       // Default HOME
 		"root",        // Default USER
-		"/bin/bash",   // Default SHELL
+		"/bin/sh",     // Default SHELL
 		"xterm",       // Default TERM
 		"en_US.UTF-8", // Default LANG
 	}
 
-	// Add container rootfs option
-	args = append(args, "--rootfs", state.RootDir)
+	// Add container rootfs option, images are referenced by ID so
+	// retagging doesn't change what the container runs
+	if state.ImageID != "" {
+		args = append(args, "--image", state.ImageID)
+	} else {
+		args = append(args, "--rootfs", state.RootDir)
+	}
 
 	// Add container ID
 	args = append(args, "--id", state.ID)
 
+	// Add network options, those of a pod's containers are the pod's
+	if state.Pod != "" {
+		args = append(args, "--pod", state.Pod)
+	} else if state.Network.Mode != "" {
+		args = append(args, "--network", state.Network.Mode)
+	}
+	for _, ip := range state.Network.RequestedIPs {
+		if strings.Contains(ip, ":") {
+			args = append(args, "--ip6", ip)
+		} else {
+			args = append(args, "--ip", ip)
+		}
+	}
+	for _, port := range state.Network.PortMaps {
+		args = append(args, "--publish", network.FormatPortMapping(port))
+	}
+	if state.Pod == "" && state.Hostname != "" {
+		args = append(args, "--hostname", state.Hostname)
+	}
+	if state.Namespaces.PID != "" {
+		args = append(args, "--pid", state.Namespaces.PID)
+	}
+	if state.Pod == "" && state.Namespaces.IPC != "" {
+		args = append(args, "--ipc", state.Namespaces.IPC)
+	}
+	if state.Pod == "" && state.Namespaces.UTS != "" {
+		args = append(args, "--uts", state.Namespaces.UTS)
+	}
+	if state.Namespaces.User != "" {
+		args = append(args, "--userns", state.Namespaces.User)
+	}
+	for _, server := range state.Network.DNS {
+		args = append(args, "--dns", server)
+	}
+	for _, domain := range state.Network.DNSSearch {
+		args = append(args, "--dns-search", domain)
+	}
+	for _, host := range state.Network.ExtraHosts {
+		args = append(args, "--add-host", host)
+	}
+
+	// Add filesystem options
+	if !state.UseLayers {
+		args = append(args, "--no-overlay")
+	}
+	if state.ReadOnly {
+		args = append(args, "--read-only")
+	}
+	for _, tmpfs := range state.Tmpfs {
+		spec := tmpfs.Destination
+		if tmpfs.Options != "" {
+			spec += ":" + tmpfs.Options
+		}
+		args = append(args, "--tmpfs", spec)
+	}
+
+	// Add the process options. The stored command already starts with the
+	// entrypoint, so the image's entrypoint must not be applied again.
+	for _, env := range FormatEnvList(state.EnvVars) {
+		args = append(args, "--env", env)
+	}
+	args = append(args, "--entrypoint", "")
+	if state.WorkingDir != "" {
+		args = append(args, "--workdir", state.WorkingDir)
+	}
+	if state.User != "" {
+		args = append(args, "--user", state.User)
+	}
+	if state.StopSignal != "" {
+		args = append(args, "--stop-signal", state.StopSignal)
+	}
+
 	// Add command separator
 	args = append(args, "--")
 
@@ -695,6 +934,39 @@ func BuildArgsFromState(state types.ContainerState) []string {
 	return args
 }
 
+// ParseSignal accepts a signal as a name (SIGTERM or TERM) or a number
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal: %s", s)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("invalid signal: %s", s)
+}
+
+// InjectOptions inserts extra options into a child argument list, just in
+// front of the "--" that separates options from the command
+func InjectOptions(args []string, options ...string) []string {
+	for i, arg := range args {
+		if arg == "--" {
+			result := make([]string, 0, len(args)+len(options))
+			result = append(result, args[:i]...)
+			result = append(result, options...)
+			return append(result, args[i:]...)
+		}
+	}
+	return append(args, options...)
+}
+
 func ParseMountSpec(spec string) (types.Mount, error) {
 	parts := strings.Split(spec, ":")
 	if len(parts) < 2 || len(parts) > 3 {
@@ -0,0 +1,186 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"congo/internals/archive"
+	"congo/internals/filesystem"
+)
+
+// pseudoFilesystems are never copied out of a running container
+var pseudoFilesystems = map[string]bool{
+	"proc":    true,
+	"sysfs":   true,
+	"cgroup":  true,
+	"cgroup2": true,
+	"devpts":  true,
+	"mqueue":  true,
+}
+
+// CopyFromContainer copies srcPath out of a container to dest on the host,
+// following `cp -r` rules: a directory dest receives a copy named after the
+// source, otherwise dest becomes the copy. A dest of "-" writes a tar stream
+// to w instead. Files owned by the container's root are handed to the
+// calling user.
+func CopyFromContainer(containerID, srcPath, dest string, w io.Writer) error {
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to load container state: %v", err)
+	}
+
+	rootfs, err := MountRootfs(state)
+	if err != nil {
+		return err
+	}
+	defer rootfs.Release()
+
+	// A trailing symlink is copied as a link, like cp does
+	src, err := filesystem.ResolveInRoot(rootfs.Path, srcPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return fmt.Errorf("no such file or directory in container %s: %s", containerID, srcPath)
+	}
+
+	// The container's / has no name of its own, its contents are copied
+	name := filepath.Base(filepath.Clean(srcPath))
+	if name == "/" {
+		name = "."
+	}
+	opts := archive.TarOptions{
+		Name:     name,
+		SkipDirs: pseudoMounts(rootfs, src),
+		Chown:    remapOwner(state.HostUID, state.HostGID, os.Getuid(), os.Getgid()),
+	}
+	if dest == "-" {
+		return archive.Tar(w, src, opts)
+	}
+
+	extractDir := dest
+	if fi, err := os.Stat(dest); err != nil || !fi.IsDir() {
+		opts.Name = filepath.Base(dest)
+		extractDir = filepath.Dir(dest)
+	}
+	if fi, err := os.Stat(extractDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("destination directory %s does not exist", extractDir)
+	}
+
+	return copyStream(src, extractDir, opts)
+}
+
+// CopyToContainer copies src from the host into a container at destPath. The
+// copy ends up owned by the container's root user. A src of "-" reads a tar
+// stream from r and extracts it into the directory destPath, with the ids
+// CopyFromContainer writes mapped back to the container's.
+func CopyToContainer(containerID, src, destPath string, r io.Reader) error {
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to load container state: %v", err)
+	}
+
+	rootfs, err := MountRootfs(state)
+	if err != nil {
+		return err
+	}
+	defer rootfs.Release()
+
+	dest, err := filesystem.ResolveInRoot(rootfs.Path, destPath, true)
+	if err != nil {
+		return err
+	}
+
+	if src == "-" {
+		if fi, err := os.Stat(dest); err != nil || !fi.IsDir() {
+			return fmt.Errorf("destination %s must be an existing directory in container %s", destPath, containerID)
+		}
+		return archive.Untar(r, dest, archive.TarOptions{
+			Chown: remapOwner(os.Getuid(), os.Getgid(), state.HostUID, state.HostGID),
+		})
+	}
+
+	if _, err := os.Lstat(src); err != nil {
+		return fmt.Errorf("no such file or directory: %s", src)
+	}
+
+	opts := archive.TarOptions{
+		Name: filepath.Base(src),
+		Chown: func(int, int) (int, int) {
+			return state.HostUID, state.HostGID
+		},
+	}
+	extractDir := dest
+	if fi, err := os.Stat(dest); err != nil || !fi.IsDir() {
+		opts.Name = filepath.Base(dest)
+		extractDir = filepath.Dir(dest)
+	}
+	if fi, err := os.Stat(extractDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("destination directory %s does not exist in container %s", filepath.Dir(destPath), containerID)
+	}
+
+	return copyStream(src, extractDir, opts)
+}
+
+// ParseCopyPath splits a `congo cp` argument into a container ID and a path
+// inside it. Local paths (absolute, relative starting with "." or "-")
+// return an empty container ID.
+func ParseCopyPath(arg string) (string, string) {
+	if arg == "-" || strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+	id, path, ok := strings.Cut(arg, ":")
+	if !ok || id == "" {
+		return "", arg
+	}
+	return id, path
+}
+
+func copyStream(src, extractDir string, opts archive.TarOptions) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.Tar(pw, src, opts))
+	}()
+
+	err := archive.Untar(pr, extractDir, archive.TarOptions{})
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	return nil
+}
+
+// pseudoMounts returns the kernel filesystems mounted below src, relative to src
+func pseudoMounts(rootfs *Rootfs, src string) []string {
+	var skip []string
+	for _, mount := range rootfs.Mounts {
+		if !pseudoFilesystems[mount.FSType] {
+			continue
+		}
+		rel, err := filepath.Rel(src, filepath.Join(rootfs.Path, mount.MountPoint))
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			skip = append(skip, rel)
+		}
+	}
+	return skip
+}
+
+// remapOwner translates the host ids the container's root maps to into
+// other ids, everything else keeps its owner
+func remapOwner(fromUID, fromGID, toUID, toGID int) func(int, int) (int, int) {
+	return func(uid, gid int) (int, int) {
+		if uid == fromUID {
+			uid = toUID
+		}
+		if gid == fromGID {
+			gid = toGID
+		}
+		return uid, gid
+	}
+}
@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"congo/internals/archive"
+	"congo/internals/types"
+)
+
+// Kinds of filesystem changes reported by DiffContainer
+const (
+	ChangeAdded    = "A"
+	ChangeModified = "C"
+	ChangeDeleted  = "D"
+)
+
+// Change is one path in a container's writable layer
+type Change struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+// DiffContainer lists what a container changed compared to its image by
+// walking its overlay upper directory. Whiteouts are deletions, paths that
+// exist in a lower layer are modifications and everything else was added.
+func DiffContainer(containerID string) ([]Change, error) {
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load container state: %v", err)
+	}
+	if !state.UseLayers {
+		return nil, fmt.Errorf("container %s runs directly on its rootfs and has no writable layer", containerID)
+	}
+
+	lowerDirs, err := LowerDirs(state)
+	if err != nil {
+		return nil, err
+	}
+
+	upperDir := filepath.Join(GetContainerDir(containerID), types.OverlayUpperDir)
+	if _, err := os.Stat(upperDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var changes []Change
+	err = filepath.WalkDir(upperDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == upperDir {
+			return nil
+		}
+		rel := "/" + path[len(upperDir)+1:]
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if archive.IsWhiteout(fi) {
+			changes = append(changes, Change{ChangeDeleted, rel})
+			return nil
+		}
+
+		kind := ChangeAdded
+		if existsInLower(lowerDirs, rel) {
+			kind = ChangeModified
+		}
+		changes = append(changes, Change{kind, rel})
+
+		// An opaque directory hides everything the lower layers had in it
+		if fi.IsDir() && archive.IsOpaque(path) && kind == ChangeModified {
+			for _, name := range lowerEntries(lowerDirs, rel) {
+				if _, err := os.Lstat(filepath.Join(path, name)); os.IsNotExist(err) {
+					changes = append(changes, Change{ChangeDeleted, filepath.Join(rel, name)})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk writable layer of %s: %v", containerID, err)
+	}
+
+	return changes, nil
+}
+
+// existsInLower reports whether path is visible in the merged lower layers
+func existsInLower(lowerDirs []string, path string) bool {
+	for _, dir := range lowerDirs {
+		fi, err := os.Lstat(filepath.Join(dir, path))
+		if err == nil {
+			return !archive.IsWhiteout(fi)
+		}
+		// An opaque parent in this layer hides the layers below
+		if archive.IsOpaque(filepath.Join(dir, filepath.Dir(path))) {
+			return false
+		}
+	}
+	return false
+}
+
+// lowerEntries lists the names visible in directory path of the lower layers
+func lowerEntries(lowerDirs []string, path string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, dir := range lowerDirs {
+		entries, err := os.ReadDir(filepath.Join(dir, path))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if seen[entry.Name()] {
+				continue
+			}
+			seen[entry.Name()] = true
+			if fi, err := entry.Info(); err == nil && !archive.IsWhiteout(fi) {
+				names = append(names, entry.Name())
+			}
+		}
+		if archive.IsOpaque(filepath.Join(dir, path)) {
+			break
+		}
+	}
+	return names
+}
@@ -0,0 +1,272 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"congo/internals/dns"
+	"congo/internals/network"
+	"congo/internals/types"
+)
+
+// writeEtcFiles generates the hosts, hostname and resolv.conf files of a
+// container for its first network n, the child mounts them over the
+// image's. ips are the container's addresses on n, if it has any.
+func writeEtcFiles(state *types.ContainerState, n *network.Network, ips []string) error {
+	dir := GetContainerDir(state.ID)
+	if err := os.MkdirAll(dir, types.DirMode); err != nil {
+		return fmt.Errorf("failed to create container directory: %v", err)
+	}
+	hostname := containerHostname(state)
+
+	var hosts []dns.Host
+	for _, spec := range state.Network.ExtraHosts {
+		host, err := dns.ParseHost(spec)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, host)
+	}
+	names := []string{hostname}
+	if state.Name != "" && state.Name != hostname {
+		names = append(names, state.Name)
+	}
+	for _, ip := range ips {
+		hosts = append(hosts, dns.Host{IP: ip, Names: names})
+	}
+	if err := dns.WriteHosts(filepath.Join(dir, types.HostsFile), hosts); err != nil {
+		return fmt.Errorf("failed to write hosts file: %v", err)
+	}
+	if err := dns.WriteHostname(filepath.Join(dir, types.HostnameFile), hostname); err != nil {
+		return fmt.Errorf("failed to write hostname file: %v", err)
+	}
+
+	rc, err := dns.ReadResolvConf(dns.HostResolvConf)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", dns.HostResolvConf, err)
+	}
+	switch {
+	case embeddedDNS(n):
+		// --dns servers are asked by the embedded server, which listens on
+		// both gateways of a dual-stack network
+		rc.Nameservers = gateways(n)
+	case len(state.Network.DNS) > 0:
+		rc.Nameservers = state.Network.DNS
+	case n.Driver != network.DriverHost:
+		// Resolvers on the host's loopback can't be reached from another
+		// network namespace
+		rc = rc.WithoutLoopback()
+	}
+	if len(state.Network.DNSSearch) > 0 {
+		// "." means no search domains at all
+		rc.Search = nil
+		for _, domain := range state.Network.DNSSearch {
+			if domain != "." {
+				rc.Search = append(rc.Search, domain)
+			}
+		}
+	}
+	if err := dns.WriteResolvConf(filepath.Join(dir, types.ResolvConfFile), rc); err != nil {
+		return fmt.Errorf("failed to write resolv.conf: %v", err)
+	}
+	return nil
+}
+
+// shareEtcFiles sets up the files of a container sharing the network of
+// the container with ID target: its hosts and resolv.conf are copies of the
+// target's
+func shareEtcFiles(state *types.ContainerState, target string) error {
+	dir := GetContainerDir(state.ID)
+	if err := os.MkdirAll(dir, types.DirMode); err != nil {
+		return fmt.Errorf("failed to create container directory: %v", err)
+	}
+	for _, file := range []string{types.HostsFile, types.ResolvConfFile} {
+		data, err := os.ReadFile(filepath.Join(GetContainerDir(target), file))
+		if os.IsNotExist(err) {
+			// The image's own file is used
+			os.Remove(filepath.Join(dir, file))
+			continue
+		}
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, file), data, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy %s of container %s: %v", file, ShortID(target), err)
+		}
+	}
+	if err := dns.WriteHostname(filepath.Join(dir, types.HostnameFile), containerHostname(state)); err != nil {
+		return fmt.Errorf("failed to write hostname file: %v", err)
+	}
+	return nil
+}
+
+// containerHostname is the hostname a container sees, the host's or
+// another container's when it shares their UTS namespace
+func containerHostname(state *types.ContainerState) string {
+	if state.Namespaces.UTS == NamespaceHost {
+		if hostname, err := os.Hostname(); err == nil {
+			return hostname
+		}
+	}
+	if id, ok := namespaceTarget(state.Namespaces.UTS); ok {
+		if target, err := LoadContainerState(id); err == nil {
+			return containerHostname(&target)
+		}
+	}
+	return dns.Hostname(state.ID, state.Hostname)
+}
+
+// embeddedDNS reports whether containers on n resolve each other's names,
+// which user-defined networks do through a DNS server on their gateway
+func embeddedDNS(n *network.Network) bool {
+	return n.Driver == network.DriverBridge && !network.IsBuiltin(n.Name)
+}
+
+func dnsPidFile(name string) string {
+	return filepath.Join(GetStateDir(), "dns", name+".pid")
+}
+
+// startDNS makes sure the DNS server of a user-defined network runs, one
+// `congo dns` serves all the containers on it
+func startDNS(n *network.Network) error {
+	if !embeddedDNS(n) {
+		return nil
+	}
+	unlock, err := lockStateDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pidFile := dnsPidFile(n.Name)
+	if data, err := os.ReadFile(pidFile); err == nil {
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		if network.HelperRunning(pid, "dns", n.Name) {
+			return nil
+		}
+	}
+	pid, err := network.StartHelper("dns", n.Name)
+	if err != nil {
+		return fmt.Errorf("failed to start DNS server of network %s: %v", n.Name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(pidFile), types.DirMode); err != nil {
+		return err
+	}
+	return os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), types.StateFileMode)
+}
+
+// stopDNS stops the DNS server of a network, the caller holds the state
+// dir lock
+func stopDNS(name string) {
+	pidFile := dnsPidFile(name)
+	if data, err := os.ReadFile(pidFile); err == nil {
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		network.StopHelper(pid, "dns", name)
+	}
+	os.Remove(pidFile)
+}
+
+// RunDNS serves the names of the containers on a user-defined network at
+// its gateway, see dns.Run
+func RunDNS(ref string) error {
+	n, err := LookupNetwork(ref)
+	if err == nil && !embeddedDNS(n) {
+		err = fmt.Errorf("network %s has no embedded DNS", n.Name)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	var addrs []string
+	for _, gateway := range gateways(n) {
+		addrs = append(addrs, net.JoinHostPort(gateway, "53"))
+	}
+	return dns.Run(addrs, &networkResolver{network: n.Name, gateways: gateways(n)})
+}
+
+// gateways returns the IPv4 and the IPv6 gateway of n, those it has
+func gateways(n *network.Network) []string {
+	var addrs []string
+	for _, gateway := range []string{n.Gateway, n.IPv6Gateway} {
+		if gateway != "" {
+			addrs = append(addrs, gateway)
+		}
+	}
+	return addrs
+}
+
+// networkResolver resolves the running containers of a network by name,
+// hostname or short ID. States are read for each query, so containers are
+// found as soon as they start.
+type networkResolver struct {
+	network  string
+	gateways []string
+}
+
+func (r *networkResolver) Lookup(name string, client net.IP) ([]net.IP, bool) {
+	containers, err := ListContainers()
+	if err != nil {
+		log.Printf("Warning: failed to list containers: %v", err)
+		return nil, false
+	}
+
+	var ips []net.IP
+	found := false
+	for _, state := range containers {
+		ep := endpointOn(state, r.network)
+		if ep == nil || !IsRunning(state) {
+			continue
+		}
+		if name != strings.ToLower(state.Name) && name != strings.ToLower(dns.Hostname(state.ID, state.Hostname)) && name != ShortID(state.ID) {
+			continue
+		}
+		found = true
+		for _, addr := range []string{ep.IP, ep.IPv6} {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, found
+}
+
+// Upstream prefers the client's --dns servers, then the host's
+func (r *networkResolver) Upstream(client net.IP) []string {
+	if containers, err := ListContainers(); err == nil {
+		for _, state := range containers {
+			ep := endpointOn(state, r.network)
+			if ep != nil && len(state.Network.DNS) > 0 && (client.Equal(net.ParseIP(ep.IP)) || client.Equal(net.ParseIP(ep.IPv6))) {
+				return state.Network.DNS
+			}
+		}
+	}
+
+	rc, _ := dns.ReadResolvConf(dns.HostResolvConf)
+	var servers []string
+	for _, server := range rc.Nameservers {
+		if !contains(r.gateways, server) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		servers = rc.WithoutLoopback().Nameservers
+	}
+	return servers
+}
+
+func endpointOn(state types.ContainerState, name string) *types.Endpoint {
+	for i := range state.Network.Endpoints {
+		if state.Network.Endpoints[i].Network == name {
+			return &state.Network.Endpoints[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"congo/internals/filesystem"
+	"congo/internals/types"
+)
+
+// ContainerInspect is what `congo inspect` prints for a container: the
+// stored state plus what can be read live from /proc while it runs
+type ContainerInspect struct {
+	types.ContainerState
+	Running     bool
+	UpperDir    string            `json:",omitempty"`
+	CgroupPaths map[string]string `json:",omitempty"`
+	// NamespacePaths are the namespaces the process is in, Namespaces the
+	// modes it was asked for
+	NamespacePaths map[string]string      `json:",omitempty"`
+	Interfaces     []string               `json:",omitempty"`
+	HostVeths      []string               `json:",omitempty"`
+	MountInfo      []filesystem.MountInfo `json:",omitempty"`
+}
+
+// InspectContainer collects the state of a container and, if it's running,
+// its cgroups, namespaces, network interfaces and mounts
+func InspectContainer(containerID string) (*ContainerInspect, error) {
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	inspect := &ContainerInspect{ContainerState: state}
+	if state.UseLayers {
+		inspect.UpperDir = filepath.Join(GetContainerDir(state.ID), types.OverlayUpperDir)
+	}
+
+	if !IsRunning(state) {
+		return inspect, nil
+	}
+	inspect.Running = true
+
+	if inspect.CgroupPaths, err = readCgroupPaths(state.Pid); err != nil {
+		return nil, err
+	}
+	if inspect.NamespacePaths, err = readNamespaces(state.Pid); err != nil {
+		return nil, err
+	}
+	if inspect.MountInfo, err = filesystem.ReadMountInfo(state.Pid); err != nil {
+		return nil, err
+	}
+	inspect.Interfaces = readInterfaces(state.Pid)
+
+	// The host ends of the veths of every network the container is on
+	for _, ep := range state.Network.Endpoints {
+		if _, err := os.Stat(filepath.Join("/sys/class/net", ep.HostVeth)); err == nil {
+			inspect.HostVeths = append(inspect.HostVeths, ep.HostVeth)
+		}
+	}
+
+	return inspect, nil
+}
+
+// readCgroupPaths maps each cgroup hierarchy of a process to its path, the
+// cgroup v2 hierarchy is reported as "unified"
+func readCgroupPaths(pid int) (map[string]string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroups: %v", err)
+	}
+	defer f.Close()
+
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		controllers := fields[1]
+		if controllers == "" {
+			controllers = "unified"
+		}
+		paths[controllers] = fields[2]
+	}
+	return paths, scanner.Err()
+}
+
+func readNamespaces(pid int) (map[string]string, error) {
+	dir := fmt.Sprintf("/proc/%d/ns", pid)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read namespaces: %v", err)
+	}
+
+	namespaces := make(map[string]string)
+	for _, entry := range entries {
+		if link, err := os.Readlink(filepath.Join(dir, entry.Name())); err == nil {
+			namespaces[entry.Name()] = link
+		}
+	}
+	return namespaces, nil
+}
+
+// readInterfaces lists the network interfaces in the process' network namespace
+func readInterfaces(pid int) []string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return nil
+	}
+
+	var interfaces []string
+	for _, line := range strings.Split(string(data), "\n") {
+		name, _, ok := strings.Cut(line, ":")
+		if ok {
+			interfaces = append(interfaces, strings.TrimSpace(name))
+		}
+	}
+	sort.Strings(interfaces)
+	return interfaces
+}
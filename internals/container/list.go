@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"congo/internals/image"
+	"congo/internals/types"
+	"congo/internals/utils"
+)
+
+// ContainerSummary is one row of `congo ps`, the fields are what --format
+// templates see
+type ContainerSummary struct {
+	ID         string
+	Name       string
+	Image      string
+	Command    string
+	CreatedAt  time.Time
+	RunningFor string
+	State      string
+	Status     string
+	Ports      string
+	IP         string
+	Pid        int
+	Labels     map[string]string
+}
+
+// ContainerStatus returns the state a container is really in: a container
+// recorded as running whose process is gone has exited
+func ContainerStatus(state types.ContainerState) string {
+	switch state.Status {
+	case "stopped":
+		return "exited"
+	case "running":
+		if !IsRunning(state) {
+			return "exited"
+		}
+	}
+	return state.Status
+}
+
+// Summarize builds the ps row for a container, noTrunc keeps IDs and
+// commands whole
+func Summarize(state types.ContainerState, noTrunc bool) ContainerSummary {
+	summary := ContainerSummary{
+		ID:        state.ID,
+		Name:      state.Name,
+		Image:     state.Image,
+		Command:   strings.Join(state.Command, " "),
+		CreatedAt: state.CreatedAt,
+		State:     ContainerStatus(state),
+		Ports:     FormatPorts(state.Network.Ports),
+		IP:        strings.Join(state.Network.ContainerIPs, ","),
+		Labels:    state.Labels,
+	}
+	if summary.Image == "" {
+		summary.Image = state.RootDir
+	}
+	summary.RunningFor = utils.HumanDuration(time.Since(state.CreatedAt)) + " ago"
+
+	// States written before StartedAt existed only know when they were created
+	startedAt := state.StartedAt
+	if startedAt.IsZero() {
+		startedAt = state.CreatedAt
+	}
+
+	switch summary.State {
+	case "running":
+		summary.Pid = state.Pid
+		summary.Status = "Up " + utils.HumanDuration(time.Since(startedAt))
+	case "paused":
+		summary.Pid = state.Pid
+		summary.Status = "Up " + utils.HumanDuration(time.Since(startedAt)) + " (Paused)"
+	case "":
+		summary.State = "unknown"
+		summary.Status = "Unknown"
+	default:
+		summary.Status = strings.ToUpper(summary.State[:1]) + summary.State[1:]
+	}
+
+	if !noTrunc {
+		summary.ID = ShortID(summary.ID)
+		if len(summary.Command) > 30 {
+			summary.Command = summary.Command[:27] + "..."
+		}
+	}
+	return summary
+}
+
+// ShortID abbreviates a full 64 character ID to the 12 characters shown in listings
+func ShortID(id string) string {
+	if len(id) == 64 {
+		return id[:12]
+	}
+	return id
+}
+
+// FormatPorts renders port mappings like docker, e.g. "0.0.0.0:8080->80/tcp"
+func FormatPorts(ports []types.PortMapping) string {
+	var parts []string
+	for _, port := range ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		hostIP := port.HostIP
+		if hostIP == "" {
+			hostIP = "0.0.0.0"
+		}
+		parts = append(parts, fmt.Sprintf("%s->%d/%s", net.JoinHostPort(hostIP, strconv.Itoa(port.HostPort)), port.ContainerPort, protocol))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// HasAncestor reports whether a container was created from ref, given as
+// the name it was run with or anything image.Lookup resolves
+func HasAncestor(state types.ContainerState, ref string) bool {
+	if state.Image == ref {
+		return true
+	}
+	if state.ImageID == "" {
+		return false
+	}
+	img, err := image.Lookup(ref)
+	return err == nil && img.ID == state.ImageID
+}
@@ -0,0 +1,202 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"congo/internals/types"
+
+	"golang.org/x/sys/unix"
+)
+
+// namePattern is what a container name may look like, names never contain
+// a ":" so they can't be confused with `congo cp` paths
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+var nameAdjectives = []string{
+	"admiring", "bold", "brave", "busy", "calm", "clever", "cool", "dazzling",
+	"eager", "elated", "epic", "festive", "focused", "gallant", "gentle",
+	"happy", "hopeful", "jolly", "keen", "kind", "lucid", "modest", "nifty",
+	"optimistic", "peaceful", "quirky", "relaxed", "sharp", "stoic", "sweet",
+	"tender", "trusting", "upbeat", "vibrant", "wizardly", "youthful", "zealous",
+}
+
+var nameNouns = []string{
+	"antelope", "badger", "bison", "cheetah", "cobra", "crane", "dolphin",
+	"eagle", "falcon", "gecko", "gorilla", "heron", "ibis", "jaguar", "koala",
+	"lemur", "lynx", "mamba", "marmot", "narwhal", "okapi", "otter", "panda",
+	"pelican", "quokka", "raven", "salmon", "tapir", "toucan", "urchin",
+	"viper", "walrus", "wombat", "yak", "zebra",
+}
+
+// GenerateID returns a new random 64 character hex container ID
+func GenerateID() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate container ID: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ValidateName checks that name can be used as a container name
+func ValidateName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid container name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	return nil
+}
+
+// RegisterContainer saves the state of a new container, giving it a
+// generated name when it has none. Names are unique across the state store,
+// taking a name that's in use fails.
+func RegisterContainer(state *types.ContainerState) error {
+	if state.Name != "" {
+		if err := ValidateName(state.Name); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := lockStateDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	containers, err := ListContainers()
+	if err != nil {
+		return err
+	}
+	taken := make(map[string]string)
+	for _, c := range containers {
+		if c.Name != "" {
+			taken[c.Name] = c.ID
+		}
+	}
+
+	if state.Name == "" {
+		if state.Name, err = generateName(taken); err != nil {
+			return err
+		}
+	} else if id, ok := taken[state.Name]; ok {
+		return fmt.Errorf("container name %q is already in use by container %s", state.Name, ShortID(id))
+	}
+
+	return SaveContainerState(state.ID, *state)
+}
+
+// RenameContainer gives a container a new unique name
+func RenameContainer(containerID, newName string) error {
+	if err := ValidateName(newName); err != nil {
+		return err
+	}
+
+	unlock, err := lockStateDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	containers, err := ListContainers()
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		if c.Name == newName && c.ID != containerID {
+			return fmt.Errorf("container name %q is already in use by container %s", newName, ShortID(c.ID))
+		}
+	}
+
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to load container state: %v", err)
+	}
+	state.Name = newName
+	return SaveContainerState(containerID, state)
+}
+
+// ResolveContainerID turns what a user typed into a full container ID: the
+// ID itself, a container name, or an unambiguous prefix of an ID
+func ResolveContainerID(ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("no container given")
+	}
+	if _, err := os.Stat(filepath.Join(GetStateDir(), ref+".json")); err == nil && !strings.Contains(ref, "/") {
+		return ref, nil
+	}
+
+	containers, err := ListContainers()
+	if err != nil {
+		return "", err
+	}
+	for _, c := range containers {
+		if c.Name == ref {
+			return c.ID, nil
+		}
+	}
+
+	var match string
+	for _, c := range containers {
+		if strings.HasPrefix(c.ID, ref) {
+			if match != "" {
+				return "", fmt.Errorf("container ID prefix %s is ambiguous", ref)
+			}
+			match = c.ID
+		}
+	}
+	if match == "" {
+		return "", fmt.Errorf("no such container: %s", ref)
+	}
+	return match, nil
+}
+
+// generateName picks an adjective_noun name nobody uses yet, adding a number
+// once the plain combinations get crowded
+func generateName(taken map[string]string) (string, error) {
+	for i := 0; i < 10; i++ {
+		name := randomElement(nameAdjectives) + "_" + randomElement(nameNouns)
+		if i > 3 {
+			n, err := rand.Int(rand.Reader, big.NewInt(100))
+			if err != nil {
+				return "", err
+			}
+			name = fmt.Sprintf("%s%d", name, n.Int64())
+		}
+		if _, ok := taken[name]; !ok {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a unique container name")
+}
+
+func randomElement(words []string) string {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		return words[0]
+	}
+	return words[n.Int64()]
+}
+
+// lockStateDir serializes changes to container names between congo processes
+func lockStateDir() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(GetStateDir(), ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state lock: %v", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock state directory: %v", err)
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
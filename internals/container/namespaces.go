@@ -0,0 +1,401 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/cgroups"
+	"congo/internals/network"
+	"congo/internals/nsenter"
+	"congo/internals/types"
+)
+
+// Namespace modes of --pid, --ipc and --uts, an empty mode is a private
+// namespace
+const (
+	NamespaceHost      = "host"
+	NamespacePrivate   = "private"
+	NamespaceShareable = "shareable"
+	// NamespaceContainer prefixes container:<id>, the namespace of another
+	// container, which --network accepts too
+	NamespaceContainer = network.ModeContainer
+)
+
+// sharedNamespace is a namespace a container joins instead of creating it
+type sharedNamespace struct {
+	kind   string // the flag it was asked for with, e.g. "pid"
+	file   string // its name under /proc/<pid>/ns
+	flag   int
+	target string // container ID
+}
+
+// namespaceTarget returns the container named by a container:<id> mode
+func namespaceTarget(mode string) (string, bool) {
+	if !strings.HasPrefix(mode, NamespaceContainer) {
+		return "", false
+	}
+	return strings.TrimPrefix(mode, NamespaceContainer), true
+}
+
+// ValidateNamespaces checks the --network, --pid, --ipc, --uts and --userns
+// modes of config and the options they conflict with
+func ValidateNamespaces(config *types.Config) error {
+	modes := []struct {
+		kind, mode string
+		allowed    []string
+	}{
+		{"pid", config.Namespaces.PID, []string{NamespaceHost}},
+		{"ipc", config.Namespaces.IPC, []string{NamespaceHost, NamespacePrivate, NamespaceShareable}},
+		{"uts", config.Namespaces.UTS, []string{NamespaceHost}},
+	}
+	for _, m := range modes {
+		if m.mode == "" || contains(m.allowed, m.mode) {
+			continue
+		}
+		if target, ok := namespaceTarget(m.mode); ok && target != "" {
+			continue
+		}
+		return fmt.Errorf("invalid --%s mode: %s", m.kind, m.mode)
+	}
+	if user := config.Namespaces.User; user != "" && user != NamespaceHost {
+		return fmt.Errorf("invalid --userns mode: %s", user)
+	}
+	// Only root of the host can see and signal the host's processes
+	if config.Namespaces.PID == NamespaceHost && config.Namespaces.User != NamespaceHost {
+		return fmt.Errorf("--pid host needs --userns host, the container's root is the host's root then")
+	}
+	if config.Namespaces.UTS != "" && config.Hostname != "" {
+		return fmt.Errorf("--hostname can't be used with --uts %s", config.Namespaces.UTS)
+	}
+
+	target, ok := namespaceTarget(config.Network.Mode)
+	if !ok {
+		return nil
+	}
+	switch {
+	case target == "":
+		return fmt.Errorf("invalid network mode: %s", config.Network.Mode)
+	case len(config.Network.ContainerIPs) > 0:
+		return fmt.Errorf("--ip and --ip6 can't be used with --network %s", config.Network.Mode)
+	case len(config.Network.PortMaps) > 0:
+		return fmt.Errorf("ports can't be published with --network %s, publish them on %s", config.Network.Mode, target)
+	case len(config.Network.DNS) > 0 || len(config.Network.DNSSearch) > 0 || len(config.Network.ExtraHosts) > 0:
+		return fmt.Errorf("--dns, --dns-search and --add-host can't be used with --network %s", config.Network.Mode)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveNamespaces replaces the containers config shares namespaces with
+// by their full IDs, so renaming them doesn't break the container. An IPC
+// namespace can only be joined when its owner made it shareable.
+func ResolveNamespaces(config *types.Config) error {
+	for _, mode := range []*string{&config.Network.Mode, &config.Namespaces.PID, &config.Namespaces.IPC, &config.Namespaces.UTS} {
+		ref, ok := namespaceTarget(*mode)
+		if !ok {
+			continue
+		}
+		id, err := ResolveContainerID(ref)
+		if err != nil {
+			return err
+		}
+		if id == config.ContainerID {
+			return fmt.Errorf("container %s can't share its own namespaces", ref)
+		}
+		*mode = NamespaceContainer + id
+	}
+
+	if id, ok := namespaceTarget(config.Namespaces.IPC); ok {
+		target, err := LoadContainerState(id)
+		if err != nil {
+			return err
+		}
+		if ipc := target.Namespaces.IPC; ipc == "" || ipc == NamespacePrivate {
+			return fmt.Errorf("the IPC namespace of container %s is not shareable, create it with --ipc shareable", target.Name)
+		}
+	}
+	return nil
+}
+
+// sharedNamespaces lists the namespaces of other containers state joins
+func sharedNamespaces(state types.ContainerState) []sharedNamespace {
+	var shared []sharedNamespace
+	for _, ns := range []sharedNamespace{
+		{kind: "network", file: "net", flag: unix.CLONE_NEWNET, target: state.Network.Mode},
+		{kind: "pid", file: "pid", flag: unix.CLONE_NEWPID, target: state.Namespaces.PID},
+		{kind: "ipc", file: "ipc", flag: unix.CLONE_NEWIPC, target: state.Namespaces.IPC},
+		{kind: "uts", file: "uts", flag: unix.CLONE_NEWUTS, target: state.Namespaces.UTS},
+	} {
+		if id, ok := namespaceTarget(ns.target); ok {
+			ns.target = id
+			shared = append(shared, ns)
+		}
+	}
+	return shared
+}
+
+// NamespaceDependents returns the names of the containers sharing a
+// namespace of the container with the given ID
+func NamespaceDependents(containerID string) ([]string, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, state := range containers {
+		for _, ns := range sharedNamespaces(state) {
+			if ns.target == containerID {
+				names = append(names, state.Name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// CloneFlags returns the namespaces a container is created in. Namespaces
+// shared with the host or another container aren't created. Neither is a
+// user namespace with --userns host, or when the container shares
+// namespaces of another one: its root couldn't manage them (mount their
+// /proc, for one) from a user namespace of its own, it joins the other
+// container's instead.
+func CloneFlags(state types.ContainerState) uintptr {
+	flags := uintptr(unix.CLONE_NEWUTS |
+		unix.CLONE_NEWPID |
+		unix.CLONE_NEWNS |
+		unix.CLONE_NEWNET |
+		unix.CLONE_NEWIPC |
+		unix.CLONE_NEWUSER)
+	if state.Network.Mode == network.ModeHost {
+		flags &^= unix.CLONE_NEWNET
+	}
+	if state.Namespaces.PID == NamespaceHost {
+		flags &^= unix.CLONE_NEWPID
+	}
+	if state.Namespaces.IPC == NamespaceHost {
+		flags &^= unix.CLONE_NEWIPC
+	}
+	if state.Namespaces.UTS == NamespaceHost {
+		flags &^= unix.CLONE_NEWUTS
+	}
+	if state.Namespaces.User == NamespaceHost {
+		flags &^= unix.CLONE_NEWUSER
+	}
+	for _, ns := range sharedNamespaces(state) {
+		flags &^= uintptr(ns.flag) | unix.CLONE_NEWUSER
+	}
+	return flags
+}
+
+// userNamespace reports whether a container runs in a user namespace, its
+// own or the one of the container whose namespaces it shares
+func userNamespace(state types.ContainerState) bool {
+	return state.Namespaces.User != NamespaceHost
+}
+
+// StartProcess starts the child process of a container in its namespaces,
+// other attributes already set in cmd.SysProcAttr are kept, and records in
+// state whether it got a user namespace. The process of a pod's container
+// is moved into its cgroup under the pod's right away.
+func StartProcess(cmd *exec.Cmd, state *types.ContainerState) error {
+	flags := CloneFlags(*state)
+	shared := sharedNamespaces(*state)
+	state.UserNamespace = userNamespace(*state)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	var err error
+	if state.UserNamespace && len(shared) > 0 {
+		err = startInUserNamespace(cmd, shared, flags)
+	} else {
+		cmd.SysProcAttr.Cloneflags = flags
+		cmd.SysProcAttr.Unshareflags = unix.CLONE_NEWNS
+		// Container root maps to the user starting it
+		if flags&unix.CLONE_NEWUSER != 0 {
+			cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+			cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		}
+		err = startInNamespaces(cmd, shared)
+	}
+	if err != nil {
+		return err
+	}
+	if state.Pod != "" {
+		if err := cgroups.JoinCgroup(containerCgroup(*state), cmd.Process.Pid); err != nil {
+			log.Printf("Warning: failed to account container to its pod: %v", err)
+		}
+	}
+	return nil
+}
+
+// namespacePath returns the file of a shared namespace under /proc. The PID
+// namespace is the one of the target's children: a container that had to
+// create its own from its child process, see package nsenter, runs in it
+// while the process congo knows stays outside.
+func namespacePath(pid int, ns sharedNamespace) string {
+	file := ns.file
+	if ns.flag == unix.CLONE_NEWPID {
+		file = "pid_for_children"
+	}
+	return filepath.Join("/proc", fmt.Sprint(pid), "ns", file)
+}
+
+// loadNamespaceTarget returns the running container a namespace is shared with
+func loadNamespaceTarget(ns sharedNamespace) (types.ContainerState, error) {
+	target, err := LoadContainerState(ns.target)
+	if err != nil {
+		return target, fmt.Errorf("failed to load container %s whose %s namespace is shared: %v", ShortID(ns.target), ns.kind, err)
+	}
+	if !IsRunning(target) {
+		return target, fmt.Errorf("container %s whose %s namespace is shared is not running", target.Name, ns.kind)
+	}
+	return target, nil
+}
+
+// startInNamespaces starts cmd in the namespaces of other containers, as
+// root of the host. They are joined with setns from a locked OS thread
+// right before forking, the child inherits them from that thread, which is
+// thrown away afterwards.
+func startInNamespaces(cmd *exec.Cmd, shared []sharedNamespace) error {
+	var paths []string
+	for _, ns := range shared {
+		target, err := loadNamespaceTarget(ns)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, namespacePath(target.Pid, ns))
+	}
+	return startInThread(cmd, paths)
+}
+
+// startInUserNamespace starts cmd in the namespaces of other containers and
+// in their user namespace, which has to be the same for all of them, so the
+// child's root is theirs with their uid and gid mappings. The child joins
+// them itself, see package nsenter, and creates the namespaces of flags
+// afterwards, they have to belong to the joined user namespace. Only a PID
+// namespace is joined by the parent, a process joins one for its children.
+func startInUserNamespace(cmd *exec.Cmd, shared []sharedNamespace, flags uintptr) error {
+	if !nsenter.Available {
+		return fmt.Errorf("congo was built without cgo, it can't join the namespaces of other containers")
+	}
+	var paths, pidPaths []string
+	var userPath string
+	for _, ns := range shared {
+		target, err := loadNamespaceTarget(ns)
+		if err != nil {
+			return err
+		}
+		if ns.flag == unix.CLONE_NEWPID {
+			pidPaths = append(pidPaths, namespacePath(target.Pid, ns))
+		} else {
+			paths = append(paths, namespacePath(target.Pid, ns))
+		}
+
+		path := filepath.Join("/proc", fmt.Sprint(target.Pid), "ns", "user")
+		same, err := sameNamespace(path, "/proc/self/ns/user")
+		if err != nil {
+			return err
+		}
+		if same {
+			return fmt.Errorf("container %s runs without a user namespace, sharing its namespaces needs --userns host", target.Name)
+		}
+		if userPath != "" {
+			if same, err = sameNamespace(path, userPath); err != nil {
+				return err
+			} else if !same {
+				return fmt.Errorf("the containers whose namespaces are shared have different user namespaces")
+			}
+		}
+		userPath = path
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %v", err)
+	}
+	defer ready.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, readyW)
+	cmd.Env = append(cmd.Environ(),
+		nsenter.EnvNamespaces+"="+strings.Join(append([]string{userPath}, paths...), ":"),
+		fmt.Sprintf("%s=%d", nsenter.EnvUnshare, flags&^unix.CLONE_NEWUSER),
+		fmt.Sprintf("%s=%d", nsenter.EnvReady, 2+len(cmd.ExtraFiles)),
+		fmt.Sprintf("%s=%d", nsenter.EnvWait, network.SyncFd))
+	cmd.SysProcAttr.Cloneflags = 0
+	cmd.SysProcAttr.Unshareflags = 0
+
+	err = startInThread(cmd, pidPaths)
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	// The child failed to set up its namespaces if it closes the pipe
+	// without writing, it printed why
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Wait()
+		return fmt.Errorf("failed to set up the namespaces of the container")
+	}
+	return nil
+}
+
+// startInThread starts cmd from a locked OS thread that joined the
+// namespace files in paths first
+func startInThread(cmd *exec.Cmd, paths []string) error {
+	if len(paths) == 0 {
+		return cmd.Start()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		// Returning without unlocking ends the thread along with the
+		// goroutine, so no other goroutine ever runs in the namespaces
+		runtime.LockOSThread()
+		for _, path := range paths {
+			if err := setns(path, 0); err != nil {
+				errc <- fmt.Errorf("failed to join namespace %s: %v", path, err)
+				return
+			}
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
+
+// sameNamespace reports whether two namespace files are the same namespace
+func sameNamespace(a, b string) (bool, error) {
+	var stA, stB unix.Stat_t
+	if err := unix.Stat(a, &stA); err != nil {
+		return false, fmt.Errorf("failed to stat namespace %s: %v", a, err)
+	}
+	if err := unix.Stat(b, &stB); err != nil {
+		return false, fmt.Errorf("failed to stat namespace %s: %v", b, err)
+	}
+	return stA.Dev == stB.Dev && stA.Ino == stB.Ino, nil
+}
+
+func setns(path string, flag int) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.Setns(fd, flag)
+}
@@ -0,0 +1,365 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"congo/internals/ipam"
+	"congo/internals/network"
+	"congo/internals/types"
+)
+
+// ConnectNetwork sets up the network of a container whose process was just
+// started, leasing it addresses first when it goes on a bridge, then plugs
+// in the other networks it's connected to. netConfig's ContainerIPs are the
+// requested addresses, if any, and are replaced by the leased ones. The
+// container's endpoints are recorded in state.
+func ConnectNetwork(state *types.ContainerState, pid int, netConfig *types.NetworkConfig, sync io.WriteCloser) error {
+	state.Network.Endpoints = nil
+	if target, ok := namespaceTarget(netConfig.Mode); ok {
+		// The network namespace was joined as the target set it up
+		if err := shareEtcFiles(state, target); err != nil {
+			sync.Close()
+			return err
+		}
+		return network.SetupNetworking(pid, netConfig, sync)
+	}
+
+	n, err := LookupNetwork(netConfig.Mode)
+	if err != nil {
+		sync.Close()
+		return err
+	}
+	if n.Driver != network.DriverBridge {
+		if err := writeEtcFiles(state, n, nil); err != nil {
+			sync.Close()
+			return err
+		}
+		if err := network.SetupNetworking(pid, netConfig, sync); err != nil {
+			return err
+		}
+		return connectExtraNetworks(state, pid)
+	}
+
+	pools, err := AddressPools(n)
+	if err != nil {
+		sync.Close()
+		return err
+	}
+	ips, err := allocateAddresses(pools, state.ID, pid, netConfig.ContainerIPs)
+	if err != nil {
+		sync.Close()
+		return err
+	}
+
+	netConfig.Bridge = n.Bridge
+	netConfig.Subnet = n.Subnet
+	netConfig.Gateway = n.Gateway
+	netConfig.IPv6Subnet = n.IPv6Subnet
+	netConfig.IPv6Gateway = n.IPv6Gateway
+	netConfig.IPv6Mode = n.IPv6Mode
+	netConfig.ContainerIPs = ips
+	// The child mounts these right after it gets its network
+	if err := writeEtcFiles(state, n, ips); err != nil {
+		releaseAddresses(pools, state.ID)
+		sync.Close()
+		return err
+	}
+	if err := network.SetupNetworking(pid, netConfig, sync); err != nil {
+		releaseAddresses(pools, state.ID)
+		return err
+	}
+	// Name resolution is best effort, the container works without it
+	if err := startDNS(n); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	ports, backend, err := publishPorts(state.ID, netConfig.PortMaps, ips)
+	if err != nil {
+		releaseAddresses(pools, state.ID)
+		return err
+	}
+
+	hostVeth, _ := network.VethNames(pid, 0)
+	state.Network.Bridge = n.Bridge
+	state.Network.ContainerIPs = ips
+	state.Network.Ports = ports
+	state.Network.Firewall = backend
+	state.Network.Endpoints = []types.Endpoint{newEndpoint(n, network.ContainerInterface, hostVeth, ips)}
+	return connectExtraNetworks(state, pid)
+}
+
+// newEndpoint records an interface on n with the addresses leased from
+// AddressPools, one of each family n has
+func newEndpoint(n *network.Network, iface, hostVeth string, ips []string) types.Endpoint {
+	ep := types.Endpoint{
+		Network:   n.Name,
+		Interface: iface,
+		HostVeth:  hostVeth,
+	}
+	for _, ip := range ips {
+		if net.ParseIP(ip).To4() != nil {
+			ep.IP, ep.Gateway = ip, n.Gateway
+		} else {
+			ep.IPv6, ep.IPv6Gateway = ip, n.IPv6Gateway
+		}
+	}
+	return ep
+}
+
+// allocateAddresses leases a container an address from each pool, a
+// requested one of the pool's family if there is one. Requested addresses
+// no pool can hand out are refused. Either all pools lease an address or
+// none does.
+func allocateAddresses(pools []*ipam.Pool, containerID string, pid int, requested []string) ([]string, error) {
+	var want [2]net.IP
+	var have [2]bool
+	for _, pool := range pools {
+		if pool.IPv6() {
+			have[1] = true
+		} else {
+			have[0] = true
+		}
+	}
+	for _, addr := range requested {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", addr)
+		}
+		family := 0
+		if ip.To4() == nil {
+			family = 1
+		}
+		if !have[family] {
+			return nil, fmt.Errorf("address %s can't be used, the network has no %s subnet", addr, ipFamily(ip))
+		}
+		want[family] = ip
+	}
+
+	var ips []string
+	for i, pool := range pools {
+		family := 0
+		if pool.IPv6() {
+			family = 1
+		}
+		ip, err := pool.Allocate(containerID, pid, want[family])
+		if err != nil {
+			releaseAddresses(pools[:i], containerID)
+			return nil, err
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+// releaseAddresses gives back the leases of a container in pools and
+// returns the first error
+func releaseAddresses(pools []*ipam.Pool, containerID string) error {
+	var firstErr error
+	for _, pool := range pools {
+		if err := pool.Release(containerID); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// connectExtraNetworks plugs in the networks a container was connected to
+// besides its first one
+func connectExtraNetworks(state *types.ContainerState, pid int) error {
+	for _, name := range state.Network.Networks {
+		n, err := LookupNetwork(name)
+		if err == nil {
+			err = attachNetwork(state, pid, n, nil)
+		}
+		if err != nil {
+			network.UnpublishPorts(state.ID, state.Network.Firewall, state.Network.Ports)
+			ReleaseNetwork(state)
+			return fmt.Errorf("failed to connect to network %s: %v", name, err)
+		}
+		if err := startDNS(n); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return nil
+}
+
+// attachNetwork leases addresses on n and hot-plugs it into the running
+// container as its next ethN interface, the caller starts the network's DNS
+// server
+func attachNetwork(state *types.ContainerState, pid int, n *network.Network, requested []string) error {
+	if n.Driver != network.DriverBridge {
+		return fmt.Errorf("network %s can't be connected to a container", n.Name)
+	}
+	pools, err := AddressPools(n)
+	if err != nil {
+		return err
+	}
+	ips, err := allocateAddresses(pools, state.ID, pid, requested)
+	if err != nil {
+		return err
+	}
+
+	// eth0 is always the first network's, even when that's none
+	index := 1
+	for hasInterface(state.Network.Endpoints, fmt.Sprintf("eth%d", index)) {
+		index++
+	}
+	hostVeth, _ := network.VethNames(pid, index)
+	ep := newEndpoint(n, fmt.Sprintf("eth%d", index), hostVeth, ips)
+	if err := network.AttachInterface(pid, n, &ep); err != nil {
+		releaseAddresses(pools, state.ID)
+		return err
+	}
+	state.Network.Endpoints = append(state.Network.Endpoints, ep)
+	return nil
+}
+
+func hasInterface(endpoints []types.Endpoint, name string) bool {
+	for _, ep := range endpoints {
+		if ep.Interface == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectContainer connects a container to another network. A running
+// container gets the interface right away, a stopped one when it starts;
+// addresses, an IPv4 and an IPv6 one at most, can only be requested for a
+// running one.
+func ConnectContainer(networkRef, containerID string, ips []string) error {
+	unlock, err := lockStateDir()
+	if err != nil {
+		return err
+	}
+	n, attached, err := connectContainer(networkRef, containerID, ips)
+	unlock()
+	if err != nil {
+		return err
+	}
+	// It takes the state lock itself
+	if attached {
+		if err := startDNS(n); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return nil
+}
+
+// connectContainer is ConnectContainer under the state lock, it reports
+// whether the network was plugged into the running container
+func connectContainer(networkRef, containerID string, ips []string) (*network.Network, bool, error) {
+	n, err := LookupNetwork(networkRef)
+	if err != nil {
+		return nil, false, err
+	}
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return nil, false, err
+	}
+	if onNetwork(state.Network.Mode, state.Network.Networks, n.Name) {
+		return nil, false, fmt.Errorf("container %s is already connected to network %s", state.Name, n.Name)
+	}
+	if state.Network.Mode == network.ModeHost {
+		return nil, false, fmt.Errorf("container %s uses the host network, it can't be connected to others", state.Name)
+	}
+	if _, ok := namespaceTarget(state.Network.Mode); ok {
+		return nil, false, fmt.Errorf("container %s shares the network of another container, it can't be connected to others", state.Name)
+	}
+	if n.Driver != network.DriverBridge {
+		return nil, false, fmt.Errorf("network %s can't be connected to a container", n.Name)
+	}
+
+	running := IsRunning(state)
+	if running {
+		if err := attachNetwork(&state, state.Pid, n, ips); err != nil {
+			return nil, false, err
+		}
+	} else if len(ips) > 0 {
+		return nil, false, fmt.Errorf("--ip and --ip6 need a running container, %s is %s", state.Name, state.Status)
+	}
+
+	state.Network.Networks = append(state.Network.Networks, n.Name)
+	return n, running, SaveContainerState(state.ID, state)
+}
+
+// DisconnectContainer undoes ConnectContainer, a container can't leave its
+// first network
+func DisconnectContainer(networkRef, containerID string) error {
+	unlock, err := lockStateDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	n, err := LookupNetwork(networkRef)
+	if err != nil {
+		return err
+	}
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return err
+	}
+	if onNetwork(state.Network.Mode, nil, n.Name) {
+		return fmt.Errorf("network %s is the first network of container %s, it can't be disconnected", n.Name, state.Name)
+	}
+
+	var networks []string
+	for _, name := range state.Network.Networks {
+		if name != n.Name {
+			networks = append(networks, name)
+		}
+	}
+	if len(networks) == len(state.Network.Networks) {
+		return fmt.Errorf("container %s is not connected to network %s", state.Name, n.Name)
+	}
+	state.Network.Networks = networks
+
+	var endpoints []types.Endpoint
+	for _, ep := range state.Network.Endpoints {
+		if ep.Network != n.Name {
+			endpoints = append(endpoints, ep)
+			continue
+		}
+		if err := network.DetachInterface(&ep); err != nil {
+			return fmt.Errorf("failed to unplug %s: %v", ep.Interface, err)
+		}
+	}
+	state.Network.Endpoints = endpoints
+
+	if pools, err := AddressPools(n); err == nil {
+		if err := releaseAddresses(pools, state.ID); err != nil {
+			log.Printf("Warning: failed to release container address: %v", err)
+		}
+	}
+	return SaveContainerState(state.ID, state)
+}
+
+// ReleaseNetwork gives back the addresses a stopped container leased on
+// its networks and forgets its endpoints and published ports
+func ReleaseNetwork(state *types.ContainerState) error {
+	var firstErr error
+	for _, name := range append([]string{state.Network.Mode}, state.Network.Networks...) {
+		n, err := LookupNetwork(name)
+		if err != nil || n.Driver != network.DriverBridge {
+			continue
+		}
+		pools, err := AddressPools(n)
+		if err == nil {
+			err = releaseAddresses(pools, state.ID)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	state.Network.ContainerIPs = nil
+	state.Network.Endpoints = nil
+	state.Network.Ports = nil
+	state.Network.Firewall = ""
+	return firstErr
+}
@@ -0,0 +1,446 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"congo/internals/ipam"
+	"congo/internals/network"
+)
+
+// NetworkDetails is what `congo network inspect` shows
+type NetworkDetails struct {
+	*network.Network
+	// Containers attached to the network by ID
+	Containers map[string]NetworkContainer
+}
+
+// NetworkContainer is a running container's endpoint on a network
+type NetworkContainer struct {
+	Name        string
+	Interface   string
+	IPAddress   string
+	IPv6Address string `json:",omitempty"`
+}
+
+// GetNetworksDir returns where user-defined networks are kept
+func GetNetworksDir() string {
+	return filepath.Join(GetStateDir(), "networks")
+}
+
+// NetworkOptions are the settings of `congo network create`
+type NetworkOptions struct {
+	// Subnets and Gateways hold an IPv4 and an IPv6 value at most
+	Subnets  []string
+	Gateways []string
+	// IPv6 makes the network dual-stack, an IPv6 subnet or gateway implies
+	// it. IPv6Mode is network.IPv6NAT, the default, or network.IPv6Routed.
+	IPv6     bool
+	IPv6Mode string
+	// NoIPv4 leaves out the IPv4 subnet, the network is IPv6-only
+	NoIPv4 bool
+	Labels map[string]string
+}
+
+// CreateNetwork defines a bridge network. Without an IPv4 subnet a free
+// 172.x.0.0/16 or 192.168.x.0/20 is picked, unless opts.NoIPv4, without an
+// IPv6 subnet a random unique local /64. Gateways default to the subnets'
+// first addresses. The bridge itself is only created when the first
+// container joins.
+func CreateNetwork(name string, opts NetworkOptions) (*network.Network, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, fmt.Errorf("invalid network name: %v", err)
+	}
+	if network.IsBuiltin(name) {
+		return nil, fmt.Errorf("network name %s is reserved", name)
+	}
+	subnet, subnet6, err := splitFamilies("subnet", opts.Subnets, func(s string) (net.IP, error) {
+		ip, _, err := net.ParseCIDR(s)
+		return ip, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	gateway, gateway6, err := splitFamilies("gateway", opts.Gateways, func(s string) (net.IP, error) {
+		if ip := net.ParseIP(s); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("not an IP address")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.NoIPv4 && (subnet != "" || gateway != "") {
+		return nil, fmt.Errorf("an IPv4 subnet or gateway can't be used with --ipv4=false")
+	}
+	ipv6 := opts.IPv6 || opts.NoIPv4 || subnet6 != "" || gateway6 != ""
+	switch {
+	case opts.IPv6Mode != "" && !ipv6:
+		return nil, fmt.Errorf("--ipv6-mode needs an IPv6 network, add --ipv6")
+	case opts.IPv6Mode == "" && ipv6:
+		opts.IPv6Mode = network.IPv6NAT
+	case opts.IPv6Mode != "" && opts.IPv6Mode != network.IPv6NAT && opts.IPv6Mode != network.IPv6Routed:
+		return nil, fmt.Errorf("invalid IPv6 mode %s, expected %s or %s", opts.IPv6Mode, network.IPv6NAT, network.IPv6Routed)
+	}
+
+	unlock, err := lockStateDir()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	existing, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range existing {
+		if n.Name == name {
+			return nil, fmt.Errorf("network %s already exists", name)
+		}
+	}
+
+	if !opts.NoIPv4 {
+		if subnet == "" {
+			if subnet, err = freeSubnet(existing); err != nil {
+				return nil, err
+			}
+		}
+		if subnet, gateway, err = checkSubnet(existing, subnet, gateway, func(n *network.Network) string { return n.Subnet }); err != nil {
+			return nil, err
+		}
+	}
+	if ipv6 {
+		if subnet6 == "" {
+			if subnet6, err = freeIPv6Subnet(existing); err != nil {
+				return nil, err
+			}
+		}
+		if subnet6, gateway6, err = checkSubnet(existing, subnet6, gateway6, func(n *network.Network) string { return n.IPv6Subnet }); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := GenerateID()
+	if err != nil {
+		return nil, err
+	}
+	n := &network.Network{
+		ID:          id,
+		Name:        name,
+		Driver:      network.DriverBridge,
+		Bridge:      network.BridgePrefix + id[:9],
+		Subnet:      subnet,
+		Gateway:     gateway,
+		IPv6Subnet:  subnet6,
+		IPv6Gateway: gateway6,
+		IPv6Mode:    opts.IPv6Mode,
+		Labels:      opts.Labels,
+		Created:     time.Now(),
+	}
+	// The pools check the gateways fit the subnets
+	if _, err := AddressPools(n); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(GetNetworksDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create networks directory: %v", err)
+	}
+	data, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal network: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(GetNetworksDir(), name+".json"), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save network: %v", err)
+	}
+	return n, nil
+}
+
+// splitFamilies sorts values into an IPv4 and an IPv6 one, parse returns
+// the address a value is about
+func splitFamilies(kind string, values []string, parse func(string) (net.IP, error)) (string, string, error) {
+	var v4, v6 string
+	for _, value := range values {
+		ip, err := parse(value)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid %s %s: %v", kind, value, err)
+		}
+		family := &v6
+		if ip.To4() != nil {
+			family = &v4
+		}
+		if *family != "" {
+			return "", "", fmt.Errorf("more than one %s %s given", ipFamily(ip), kind)
+		}
+		*family = value
+	}
+	return v4, v6, nil
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// checkSubnet normalizes a subnet, makes sure no other network's subnet
+// of the same family, as returned by other, overlaps with it and picks the
+// gateway when it's empty
+func checkSubnet(existing []*network.Network, subnet, gateway string, other func(*network.Network) string) (string, string, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+	for _, n := range existing {
+		if overlaps(ipnet, other(n)) {
+			return "", "", fmt.Errorf("subnet %s overlaps with network %s (%s)", ipnet, n.Name, other(n))
+		}
+	}
+	if gateway == "" {
+		prefix, _ := netip.ParsePrefix(ipnet.String())
+		gateway = prefix.Addr().Next().String()
+	}
+	return ipnet.String(), gateway, nil
+}
+
+// ListNetworks returns the built-in networks followed by the user-defined
+// ones sorted by name
+func ListNetworks() ([]*network.Network, error) {
+	networks := network.BuiltinNetworks()
+
+	files, err := os.ReadDir(GetNetworksDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read networks directory: %v", err)
+	}
+	var defined []*network.Network
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(GetNetworksDir(), file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read network %s: %v", file.Name(), err)
+		}
+		var n network.Network
+		if err := json.Unmarshal(data, &n); err != nil {
+			return nil, fmt.Errorf("failed to parse network %s: %v", file.Name(), err)
+		}
+		defined = append(defined, &n)
+	}
+	sort.Slice(defined, func(i, j int) bool { return defined[i].Name < defined[j].Name })
+	return append(networks, defined...), nil
+}
+
+// LookupNetwork finds a network by name or unique ID prefix, an empty ref
+// is the default bridge network
+func LookupNetwork(ref string) (*network.Network, error) {
+	if ref == "" {
+		ref = network.ModeBridge
+	}
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	var match *network.Network
+	for _, n := range networks {
+		if n.Name == ref || n.ID == ref {
+			return n, nil
+		}
+		if strings.HasPrefix(n.ID, ref) {
+			if match != nil {
+				return nil, fmt.Errorf("network ID prefix %s is ambiguous", ref)
+			}
+			match = n
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no such network: %s", ref)
+	}
+	return match, nil
+}
+
+// RemoveNetwork deletes a user-defined network nothing is connected to,
+// along with its bridge and address leases
+func RemoveNetwork(ref string) (*network.Network, error) {
+	unlock, err := lockStateDir()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	n, err := LookupNetwork(ref)
+	if err != nil {
+		return nil, err
+	}
+	if network.IsBuiltin(n.Name) {
+		return nil, fmt.Errorf("network %s is built in and can't be removed", n.Name)
+	}
+
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, state := range containers {
+		if onNetwork(state.Network.Mode, state.Network.Networks, n.Name) {
+			users = append(users, state.Name)
+		}
+	}
+	if len(users) > 0 {
+		return nil, fmt.Errorf("network %s is in use by containers: %s", n.Name, strings.Join(users, ", "))
+	}
+
+	stopDNS(n.Name)
+	if err := network.RemoveBridge(n); err != nil {
+		return nil, fmt.Errorf("failed to remove bridge %s: %v", n.Bridge, err)
+	}
+	for _, leases := range []string{leaseFile(n, false), leaseFile(n, true)} {
+		os.Remove(leases)
+		os.Remove(leases + ".lock")
+	}
+	if err := os.Remove(filepath.Join(GetNetworksDir(), n.Name+".json")); err != nil {
+		return nil, fmt.Errorf("failed to remove network: %v", err)
+	}
+	return n, nil
+}
+
+// InspectNetwork returns a network with the running containers attached
+func InspectNetwork(ref string) (*NetworkDetails, error) {
+	n, err := LookupNetwork(ref)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	details := &NetworkDetails{Network: n, Containers: make(map[string]NetworkContainer)}
+	for _, state := range containers {
+		if !IsRunning(state) {
+			continue
+		}
+		if state.Network.Mode == n.Name && len(state.Network.Endpoints) == 0 {
+			// Host and none have no endpoints
+			details.Containers[state.ID] = NetworkContainer{Name: state.Name}
+		}
+		for _, ep := range state.Network.Endpoints {
+			if ep.Network == n.Name {
+				details.Containers[state.ID] = NetworkContainer{
+					Name:        state.Name,
+					Interface:   ep.Interface,
+					IPAddress:   ep.IP,
+					IPv6Address: ep.IPv6,
+				}
+			}
+		}
+	}
+	return details, nil
+}
+
+// onNetwork reports whether a container with the given first and extra
+// networks is on the network name
+func onNetwork(mode string, extra []string, name string) bool {
+	if mode == name || (mode == "" && name == network.ModeBridge) {
+		return true
+	}
+	for _, n := range extra {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// freeSubnet picks the first candidate subnet no network overlaps with
+func freeSubnet(existing []*network.Network) (string, error) {
+	var candidates []string
+	for i := 21; i <= 31; i++ {
+		candidates = append(candidates, fmt.Sprintf("172.%d.0.0/16", i))
+	}
+	for i := 0; i < 256; i += 16 {
+		candidates = append(candidates, fmt.Sprintf("192.168.%d.0/20", i))
+	}
+
+	for _, candidate := range candidates {
+		_, ipnet, _ := net.ParseCIDR(candidate)
+		free := true
+		for _, n := range existing {
+			free = free && !overlaps(ipnet, n.Subnet)
+		}
+		if free {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free subnet left for a new network, pass --subnet")
+}
+
+// freeIPv6Subnet picks a unique local /64 with a random global ID, as RFC
+// 4193 suggests, that no network uses
+func freeIPv6Subnet(existing []*network.Network) (string, error) {
+	for tries := 0; tries < 10; tries++ {
+		ip := make(net.IP, net.IPv6len)
+		ip[0] = 0xfd
+		if _, err := rand.Read(ip[1:6]); err != nil {
+			return "", fmt.Errorf("failed to pick an IPv6 subnet: %v", err)
+		}
+		ipnet := &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+		free := true
+		for _, n := range existing {
+			free = free && !overlaps(ipnet, n.IPv6Subnet)
+		}
+		if free {
+			return ipnet.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no free IPv6 subnet found for a new network, pass --subnet")
+}
+
+func overlaps(ipnet *net.IPNet, subnet string) bool {
+	_, other, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return false
+	}
+	return ipnet.Contains(other.IP) || other.Contains(ipnet.IP)
+}
+
+// AddressPools returns the IPAM pools of a bridge network's subnets, the
+// IPv4 one first
+func AddressPools(n *network.Network) ([]*ipam.Pool, error) {
+	var pools []*ipam.Pool
+	if n.Subnet != "" {
+		pool, err := ipam.NewPool(leaseFile(n, false), n.Subnet, n.Gateway)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	if n.IPv6Subnet != "" {
+		pool, err := ipam.NewPool(leaseFile(n, true), n.IPv6Subnet, n.IPv6Gateway)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// leaseFile is where the leases of a network's IPv4 or IPv6 subnet live
+func leaseFile(n *network.Network, ipv6 bool) string {
+	if ipv6 {
+		return filepath.Join(GetStateDir(), "ipam", n.Bridge+"-v6.json")
+	}
+	return filepath.Join(GetStateDir(), "ipam", n.Bridge+".json")
+}
@@ -0,0 +1,443 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/cgroups"
+	"congo/internals/dns"
+	"congo/internals/network"
+	"congo/internals/types"
+)
+
+// Pod is a group of containers sharing the network, IPC and UTS namespaces
+// held by its infra container
+type Pod struct {
+	ID      string
+	Name    string
+	InfraID string
+	Labels  map[string]string `json:",omitempty"`
+	Created time.Time
+}
+
+// GetPodsDir returns where pods are kept
+func GetPodsDir() string {
+	return filepath.Join(GetStateDir(), "pods")
+}
+
+// podCgroup returns the cgroup parent the processes of a pod's containers
+// are moved into, so its counters account for the whole pod
+func podCgroup(podID string) string {
+	return "congo-pod-" + ShortID(podID)
+}
+
+// containerCgroup returns the cgroup of a container below the root of each
+// hierarchy, a pod's containers have theirs under the pod's
+func containerCgroup(state types.ContainerState) string {
+	if state.Pod != "" {
+		return filepath.Join(podCgroup(state.Pod), cgroups.ContainerCgroup(state.ID))
+	}
+	return cgroups.ContainerCgroup(state.ID)
+}
+
+// CreatePod defines a pod and starts its infra container, which holds the
+// namespaces on networkMode with ports published and hostname set. An
+// empty name is generated, an empty hostname is the pod's name.
+func CreatePod(name, hostname, networkMode string, ports []types.PortMapping, labels map[string]string) (*Pod, error) {
+	if name != "" {
+		if err := ValidateName(name); err != nil {
+			return nil, fmt.Errorf("invalid pod name: %v", err)
+		}
+	}
+	n, err := LookupNetwork(networkMode)
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) > 0 && n.Driver != network.DriverBridge {
+		return nil, fmt.Errorf("ports can only be published on a bridge network")
+	}
+	if networkMode != "" {
+		networkMode = n.Name
+	}
+
+	pod, err := savePod(name, labels)
+	if err != nil {
+		return nil, err
+	}
+	if hostname == "" {
+		hostname = pod.Name
+	}
+
+	infra := types.ContainerState{
+		ID:         pod.InfraID,
+		Name:       pod.Name + "-infra",
+		Status:     "created",
+		CreatedAt:  pod.Created,
+		Command:    []string{"infra"},
+		Hostname:   hostname,
+		Namespaces: types.NamespaceModes{IPC: NamespaceShareable},
+		HostUID:    os.Getuid(),
+		HostGID:    os.Getgid(),
+		Pod:        pod.ID,
+		Infra:      true,
+	}
+	infra.Network.Mode = networkMode
+	infra.Network.PortMaps = ports
+	err = RegisterContainer(&infra)
+	if err == nil {
+		if err = startInfra(&infra); err != nil {
+			os.Remove(filepath.Join(GetStateDir(), infra.ID+".json"))
+			os.RemoveAll(GetContainerDir(infra.ID))
+		}
+	}
+	if err != nil {
+		os.Remove(podFile(pod.Name))
+		return nil, err
+	}
+	return pod, nil
+}
+
+func podFile(name string) string {
+	return filepath.Join(GetPodsDir(), name+".json")
+}
+
+// savePod records a new pod, settling its name
+func savePod(name string, labels map[string]string) (*Pod, error) {
+	unlock, err := lockStateDir()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	pods, err := ListPods()
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[string]string)
+	for _, p := range pods {
+		taken[p.Name] = p.ID
+	}
+	if name == "" {
+		if name, err = generateName(taken); err != nil {
+			return nil, err
+		}
+	} else if id, ok := taken[name]; ok {
+		return nil, fmt.Errorf("pod name %q is already in use by pod %s", name, ShortID(id))
+	}
+
+	pod := &Pod{Name: name, Labels: labels, Created: time.Now()}
+	if pod.ID, err = GenerateID(); err != nil {
+		return nil, err
+	}
+	if pod.InfraID, err = GenerateID(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(GetPodsDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pods directory: %v", err)
+	}
+	data, err := json.MarshalIndent(pod, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pod: %v", err)
+	}
+	if err := os.WriteFile(podFile(pod.Name), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save pod: %v", err)
+	}
+	return pod, nil
+}
+
+// ListPods returns the pods sorted by name
+func ListPods() ([]*Pod, error) {
+	files, err := os.ReadDir(GetPodsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read pods directory: %v", err)
+	}
+	var pods []*Pod
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(GetPodsDir(), file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod %s: %v", file.Name(), err)
+		}
+		var p Pod
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("failed to parse pod %s: %v", file.Name(), err)
+		}
+		pods = append(pods, &p)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+// LookupPod finds a pod by name or unique ID prefix
+func LookupPod(ref string) (*Pod, error) {
+	pods, err := ListPods()
+	if err != nil {
+		return nil, err
+	}
+
+	var match *Pod
+	for _, p := range pods {
+		if p.Name == ref || p.ID == ref {
+			return p, nil
+		}
+		if ref != "" && strings.HasPrefix(p.ID, ref) {
+			if match != nil {
+				return nil, fmt.Errorf("pod ID prefix %s is ambiguous", ref)
+			}
+			match = p
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no such pod: %s", ref)
+	}
+	return match, nil
+}
+
+// podContainers returns the states of a pod's containers, without its
+// infra container
+func podContainers(pod *Pod) ([]types.ContainerState, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var members []types.ContainerState
+	for _, state := range containers {
+		if state.Pod == pod.ID && !state.Infra {
+			members = append(members, state)
+		}
+	}
+	return members, nil
+}
+
+// JoinPod puts a container into the pod named by config.Pod, sharing the
+// namespaces of the pod's infra container. Options about those namespaces
+// belong to the pod.
+func JoinPod(config *types.Config) error {
+	if config.Pod == "" {
+		return nil
+	}
+	switch {
+	// The default network counts as none given
+	case config.Network.Mode != "" && config.Network.Mode != network.ModeBridge, len(config.Network.ContainerIPs) > 0, len(config.Network.PortMaps) > 0:
+		return fmt.Errorf("containers of a pod use its network, set --network and ports on `congo pod create`")
+	case config.Namespaces.IPC != "", config.Namespaces.UTS != "", config.Hostname != "":
+		return fmt.Errorf("--ipc, --uts and --hostname can't be used with --pod")
+	case len(config.Network.DNS) > 0 || len(config.Network.DNSSearch) > 0 || len(config.Network.ExtraHosts) > 0:
+		return fmt.Errorf("--dns, --dns-search and --add-host can't be used with --pod")
+	}
+
+	pod, err := LookupPod(config.Pod)
+	if err != nil {
+		return err
+	}
+	mode := NamespaceContainer + pod.InfraID
+	config.Pod = pod.ID
+	config.CgroupParent = podCgroup(pod.ID)
+	config.Network.Mode = mode
+	config.Namespaces.IPC = mode
+	config.Namespaces.UTS = mode
+	return nil
+}
+
+// startInfra starts the process of a pod's infra container, which is
+// congo itself waiting for SIGTERM in the pod's namespaces
+func startInfra(state *types.ContainerState) error {
+	cmd := exec.Command("/proc/self/exe", "infra", state.ID)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create sync pipe: %v", err)
+	}
+	cmd.ExtraFiles = []*os.File{syncR}
+
+	if err := StartProcess(cmd, state); err != nil {
+		syncR.Close()
+		syncW.Close()
+		return fmt.Errorf("failed to start infra container: %v", err)
+	}
+	syncR.Close()
+
+	netConfig := types.NetworkConfig{
+		Mode:         state.Network.Mode,
+		Bridge:       types.DefaultBridgeName,
+		ContainerIPs: state.Network.RequestedIPs,
+		PortMaps:     state.Network.PortMaps,
+	}
+	if err := ConnectNetwork(state, cmd.Process.Pid, &netConfig, syncW); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("failed to set up pod network: %v", err)
+	}
+
+	line, _ := bufio.NewReader(out).ReadString('\n')
+	if line = strings.TrimSpace(line); line != network.HelperReady {
+		cmd.Process.Kill()
+		cmd.Wait()
+		network.UnpublishPorts(state.ID, state.Network.Firewall, state.Network.Ports)
+		ReleaseNetwork(state)
+		if line == "" {
+			line = "infra container exited"
+		}
+		return fmt.Errorf("%s", line)
+	}
+
+	state.Pid = cmd.Process.Pid
+	state.Status = "running"
+	state.HostUID = os.Getuid()
+	state.HostGID = os.Getgid()
+	state.StartedAt = time.Now()
+	// The infra process outlives this one, nobody waits for it here
+	cmd.Process.Release()
+	return SaveContainerState(state.ID, *state)
+}
+
+// RunInfra is the process of an infra container: it configures the network
+// namespace it was started in, sets the pod's hostname and holds the
+// namespaces until SIGTERM. Readiness or the error is reported on stdout.
+func RunInfra(containerID string) error {
+	state, err := LoadContainerState(containerID)
+	if err == nil {
+		err = network.ConfigureContainer(&types.Config{Network: types.NetworkConfig{Mode: state.Network.Mode}})
+	}
+	if err == nil {
+		err = unix.Sethostname([]byte(dns.Hostname(state.ID, state.Hostname)))
+	}
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	fmt.Println(network.HelperReady)
+	os.Stdout.Close()
+	<-signals
+	return nil
+}
+
+// StopPod stops the containers of a pod, then its infra container
+func StopPod(ref string, force bool) (*Pod, error) {
+	pod, err := LookupPod(ref)
+	if err != nil {
+		return nil, err
+	}
+	members, err := podContainers(pod)
+	if err != nil {
+		return nil, err
+	}
+	var failed []string
+	for _, state := range members {
+		if !IsRunning(state) {
+			continue
+		}
+		if err := StopContainer(state.ID, force); err != nil {
+			log.Printf("Error stopping container %s: %v", state.Name, err)
+			failed = append(failed, state.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("failed to stop containers %s of pod %s", strings.Join(failed, ", "), pod.Name)
+	}
+
+	if infra, err := LoadContainerState(pod.InfraID); err == nil && IsRunning(infra) {
+		if err := StopContainer(infra.ID, force); err != nil {
+			return nil, err
+		}
+	}
+	return pod, nil
+}
+
+// RemovePod removes a pod along with its containers and cgroup. A pod with
+// running containers is only removed with force, which stops them first.
+func RemovePod(ref string, force bool) (*Pod, error) {
+	pod, err := LookupPod(ref)
+	if err != nil {
+		return nil, err
+	}
+	members, err := podContainers(pod)
+	if err != nil {
+		return nil, err
+	}
+	// A pod whose infra container's state is lost can still be removed
+	infra, _ := LoadContainerState(pod.InfraID)
+
+	running := IsRunning(infra)
+	for _, state := range members {
+		running = running || IsRunning(state)
+	}
+	if running {
+		if !force {
+			return nil, fmt.Errorf("pod %s has running containers, stop it first or use --force", pod.Name)
+		}
+		if _, err := StopPod(pod.ID, true); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, state := range members {
+		if err := RemoveContainer(state.ID); err != nil {
+			return nil, fmt.Errorf("failed to remove container %s: %v", state.Name, err)
+		}
+	}
+	if infra.ID != "" {
+		if infra, err = LoadContainerState(infra.ID); err != nil {
+			return nil, err
+		}
+		if err := removeContainer(infra); err != nil {
+			return nil, fmt.Errorf("failed to remove infra container: %v", err)
+		}
+	}
+	cgroups.RemoveParent(podCgroup(pod.ID))
+	if err := os.Remove(podFile(pod.Name)); err != nil {
+		return nil, fmt.Errorf("failed to remove pod: %v", err)
+	}
+	return pod, nil
+}
+
+// PodStatus is running when all the containers of a pod run, degraded when
+// only some do
+func PodStatus(pod *Pod) (string, int, error) {
+	members, err := podContainers(pod)
+	if err != nil {
+		return "", 0, err
+	}
+	infra, _ := LoadContainerState(pod.InfraID)
+
+	running := 0
+	for _, state := range append(members, infra) {
+		if IsRunning(state) {
+			running++
+		}
+	}
+	switch {
+	case running == 0 && infra.Status == "created":
+		return "created", len(members), nil
+	case running == 0:
+		return "stopped", len(members), nil
+	case running == len(members)+1:
+		return "running", len(members), nil
+	}
+	return "degraded", len(members), nil
+}
@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"fmt"
+
+	"congo/internals/network"
+	"congo/internals/types"
+)
+
+// maxPortTries bounds the search for a host port no container published
+const maxPortTries = 100
+
+// publishPorts picks host ports for the mappings that left them open and
+// publishes the container's ports, returning them with the firewall backend
+// used. Host ports another running container published are refused,
+// whatever host address they're bound to.
+func publishPorts(containerID string, ports []types.PortMapping, containerIPs []string) ([]types.PortMapping, string, error) {
+	if len(ports) == 0 {
+		return nil, "", nil
+	}
+
+	unlock, err := lockStateDir()
+	if err != nil {
+		return nil, "", err
+	}
+	defer unlock()
+
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, "", err
+	}
+	used := make(map[string]string)
+	for _, state := range containers {
+		if state.ID == containerID || !IsRunning(state) {
+			continue
+		}
+		for _, port := range state.Network.Ports {
+			used[portKey(port)] = state.Name
+		}
+	}
+
+	resolved := make([]types.PortMapping, 0, len(ports))
+	for _, port := range ports {
+		if port.HostPort == 0 {
+			for tries := 0; ; tries++ {
+				if tries == maxPortTries {
+					return nil, "", fmt.Errorf("no free host port for %d/%s", port.ContainerPort, port.Protocol)
+				}
+				if port.HostPort, err = network.FreePort(port.Protocol, port.HostIP); err != nil {
+					return nil, "", fmt.Errorf("failed to pick a host port: %v", err)
+				}
+				if _, taken := used[portKey(port)]; !taken {
+					break
+				}
+			}
+		} else if name, taken := used[portKey(port)]; taken {
+			return nil, "", fmt.Errorf("host port %d/%s is already published by container %s", port.HostPort, port.Protocol, name)
+		}
+		used[portKey(port)] = containerID
+		resolved = append(resolved, port)
+	}
+	return network.PublishPorts(containerID, resolved, containerIPs)
+}
+
+// PublishedPorts returns the mappings of a running container, with
+// containerPort (e.g. "80" or "80/udp") only those of that port
+func PublishedPorts(containerID, containerPort string) ([]types.PortMapping, error) {
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if !IsRunning(state) {
+		return nil, nil
+	}
+	if containerPort == "" {
+		return state.Network.Ports, nil
+	}
+
+	want, err := network.ParsePortMapping(containerPort)
+	if err != nil {
+		return nil, err
+	}
+	var ports []types.PortMapping
+	for _, port := range state.Network.Ports {
+		if port.ContainerPort == want.ContainerPort && port.Protocol == want.Protocol {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no public port %d/%s published for container %s", want.ContainerPort, want.Protocol, state.Name)
+	}
+	return ports, nil
+}
+
+func portKey(port types.PortMapping) string {
+	return fmt.Sprintf("%d/%s", port.HostPort, port.Protocol)
+}
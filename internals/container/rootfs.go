@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"congo/internals/archive"
+	"congo/internals/filesystem"
+	"congo/internals/image"
+	"congo/internals/types"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rootfs is a container's root filesystem made reachable from the host
+type Rootfs struct {
+	// Path is where the container's / can be found on the host
+	Path string
+	// Mounts are the mounts inside the container (volumes, tmpfs, /proc,
+	// ...) with mount points relative to Path, their contents aren't part of
+	// the container's own filesystem
+	Mounts []filesystem.MountInfo
+
+	release func() error
+}
+
+// Release undoes whatever was needed to reach the filesystem
+func (r *Rootfs) Release() error {
+	if r.release == nil {
+		return nil
+	}
+	return r.release()
+}
+
+// IsRunning reports whether the container's process is still alive
+func IsRunning(state types.ContainerState) bool {
+	if state.Status != "running" || state.Pid <= 0 {
+		return false
+	}
+	return syscall.Kill(state.Pid, 0) == nil
+}
+
+// MountRootfs gives access to a container's filesystem from the host. A
+// running container is reached through /proc/<pid>/root. A stopped one gets
+// its overlay mounted again on a scratch directory, with its own upper dir so
+// writes end up where the container will see them.
+func MountRootfs(state types.ContainerState) (*Rootfs, error) {
+	if IsRunning(state) {
+		mounts, err := filesystem.ReadMountInfo(state.Pid)
+		if err != nil {
+			return nil, err
+		}
+		// The trailing slash makes walks follow the magic link
+		rootfs := &Rootfs{Path: fmt.Sprintf("/proc/%d/root/", state.Pid)}
+		for _, mount := range mounts {
+			if mount.MountPoint != "/" {
+				rootfs.Mounts = append(rootfs.Mounts, mount)
+			}
+		}
+		return rootfs, nil
+	}
+
+	if !state.UseLayers {
+		if state.RootDir == "" {
+			return nil, fmt.Errorf("container %s has no filesystem", state.ID)
+		}
+		return &Rootfs{Path: state.RootDir}, nil
+	}
+
+	lowerDirs, err := LowerDirs(state)
+	if err != nil {
+		return nil, err
+	}
+
+	containerDir := GetContainerDir(state.ID)
+	upperDir := filepath.Join(containerDir, types.OverlayUpperDir)
+	workDir := filepath.Join(containerDir, types.OverlayWorkDir)
+	for _, dir := range []string{upperDir, workDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create overlay directory %s: %v", dir, err)
+		}
+	}
+
+	target, err := os.MkdirTemp(containerDir, "mnt-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mount point: %v", err)
+	}
+	// The overlay metadata in the upper dir has to be read the way the
+	// container writes it, a container that never ran will start as its
+	// --userns mode says
+	userXattr := state.UserNamespace
+	if state.Status == "created" {
+		userXattr = userNamespace(state)
+	}
+	if err := filesystem.MountOverlay(lowerDirs, upperDir, workDir, target, userXattr); err != nil {
+		os.Remove(target)
+		return nil, err
+	}
+
+	return &Rootfs{
+		Path: target,
+		release: func() error {
+			if err := unix.Unmount(target, 0); err != nil {
+				return fmt.Errorf("failed to unmount %s: %v", target, err)
+			}
+			return os.Remove(target)
+		},
+	}, nil
+}
+
+// LowerDirs returns the read-only layers under a container's overlay, top-most first
+func LowerDirs(state types.ContainerState) ([]string, error) {
+	if state.ImageID == "" {
+		return []string{state.RootDir}, nil
+	}
+	img, err := image.LoadImage(state.ImageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load image of container %s: %v", state.ID, err)
+	}
+	return image.LayerPaths(img), nil
+}
+
+// ExportContainer streams a container's merged filesystem to w as a flat tar,
+// leaving out volumes and other mounts
+func ExportContainer(containerID string, w io.Writer) error {
+	state, err := LoadContainerState(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to load container state: %v", err)
+	}
+
+	rootfs, err := MountRootfs(state)
+	if err != nil {
+		return err
+	}
+	defer rootfs.Release()
+
+	var skip []string
+	for _, mount := range rootfs.Mounts {
+		skip = append(skip, mount.MountPoint)
+	}
+	if err := archive.Tar(w, rootfs.Path, archive.TarOptions{SkipDirs: skip}); err != nil {
+		return fmt.Errorf("failed to export container %s: %v", containerID, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// HostResolvConf is where the host's resolver configuration is read from
+const HostResolvConf = "/etc/resolv.conf"
+
+// defaultNameservers are used when the host only has resolvers on its own
+// loopback, containers can't reach those
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// Hostname is the hostname of a container, the one it was given or its
+// short ID
+func Hostname(containerID, hostname string) string {
+	if hostname != "" {
+		return hostname
+	}
+	if len(containerID) > 12 {
+		return containerID[:12]
+	}
+	if containerID == "" {
+		return "container"
+	}
+	return containerID
+}
+
+// ResolvConf is the part of resolv.conf congo understands, other lines are
+// dropped
+type ResolvConf struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+// ReadResolvConf parses a resolv.conf, a missing file is an empty one
+func ReadResolvConf(path string) (ResolvConf, error) {
+	var rc ResolvConf
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return rc, nil
+	} else if err != nil {
+		return rc, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			rc.Nameservers = append(rc.Nameservers, fields[1])
+		case "search", "domain":
+			// The last of them wins
+			rc.Search = fields[1:]
+		case "options":
+			rc.Options = append(rc.Options, fields[1:]...)
+		}
+	}
+	return rc, scanner.Err()
+}
+
+// WithoutLoopback drops nameservers on loopback addresses, e.g. a local
+// caching resolver, falling back to public ones when none are left
+func (rc ResolvConf) WithoutLoopback() ResolvConf {
+	var servers []string
+	for _, server := range rc.Nameservers {
+		if ip := net.ParseIP(server); ip != nil && !ip.IsLoopback() {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		servers = defaultNameservers
+	}
+	rc.Nameservers = servers
+	return rc
+}
+
+// WriteResolvConf writes rc in resolv.conf format
+func WriteResolvConf(path string, rc ResolvConf) error {
+	var b strings.Builder
+	for _, server := range rc.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(rc.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(rc.Search, " "))
+	}
+	if len(rc.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(rc.Options, " "))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// WriteHostname writes an /etc/hostname
+func WriteHostname(path, hostname string) error {
+	return os.WriteFile(path, []byte(hostname+"\n"), 0644)
+}
+
+// Host is one line of a hosts file
+type Host struct {
+	IP    string
+	Names []string
+}
+
+// ParseHost parses an --add-host value, name:ip
+func ParseHost(spec string) (Host, error) {
+	name, ip, ok := strings.Cut(spec, ":")
+	if !ok || name == "" || net.ParseIP(ip) == nil {
+		return Host{}, fmt.Errorf("invalid extra host %s, expected name:ip", spec)
+	}
+	return Host{IP: ip, Names: []string{name}}, nil
+}
+
+// WriteHosts writes a hosts file with the loopback entries first, then
+// hosts in order
+func WriteHosts(path string, hosts []Host) error {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	b.WriteString("fe00::0\tip6-localnet\n")
+	b.WriteString("ff00::0\tip6-mcastprefix\n")
+	b.WriteString("ff02::1\tip6-allnodes\n")
+	b.WriteString("ff02::2\tip6-allrouters\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "%s\t%s\n", host.IP, strings.Join(host.Names, " "))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Record types and classes from RFC 1035 and RFC 3596
+const (
+	TypeA    = 1
+	TypeAAAA = 28
+	ClassIN  = 1
+)
+
+// Response codes
+const (
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+)
+
+const (
+	headerSize = 12
+	flagQR     = 1 << 15
+	flagRD     = 1 << 8
+	flagRA     = 1 << 7
+	opcodeMask = 0xf << 11
+)
+
+// answerTTL is how long clients may cache container addresses
+const answerTTL = 600
+
+var errMalformed = errors.New("malformed DNS message")
+
+// Question is the single question of a query
+type Question struct {
+	Name  string // lower case, without the trailing dot
+	Type  uint16
+	Class uint16
+}
+
+// parseQuery returns the question of a standard query and where it ends
+func parseQuery(msg []byte) (Question, int, error) {
+	var q Question
+	if len(msg) < headerSize {
+		return q, 0, errMalformed
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return q, 0, errMalformed
+	}
+
+	var labels []string
+	off := headerSize
+	for {
+		if off >= len(msg) {
+			return q, 0, errMalformed
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		// Questions are never compressed, pointers have the top bits set
+		if n > 63 || off+n > len(msg) {
+			return q, 0, errMalformed
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return q, 0, errMalformed
+	}
+	q.Name = strings.ToLower(strings.Join(labels, "."))
+	q.Type = binary.BigEndian.Uint16(msg[off : off+2])
+	q.Class = binary.BigEndian.Uint16(msg[off+2 : off+4])
+	return q, off + 4, nil
+}
+
+// reply builds the response to query, whose question ends at qEnd, with A
+// or AAAA records for ips
+func reply(query []byte, qEnd int, rcode uint16, qtype uint16, ips []net.IP) []byte {
+	flags := binary.BigEndian.Uint16(query[2:4])
+	resp := make([]byte, headerSize, qEnd+len(ips)*28)
+	copy(resp[0:2], query[0:2])
+	binary.BigEndian.PutUint16(resp[2:4], flagQR|flags&(opcodeMask|flagRD)|flagRA|rcode)
+	if qEnd > headerSize {
+		binary.BigEndian.PutUint16(resp[4:6], 1)
+		resp = append(resp, query[headerSize:qEnd]...)
+	}
+
+	var count uint16
+	for _, ip := range ips {
+		data := ip.To4()
+		if qtype == TypeAAAA {
+			if data != nil {
+				continue
+			}
+			data = ip.To16()
+		} else if data == nil {
+			continue
+		}
+		// The name is a pointer to the question's
+		rr := []byte{0xc0, headerSize, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(rr[2:4], qtype)
+		binary.BigEndian.PutUint16(rr[4:6], ClassIN)
+		binary.BigEndian.PutUint32(rr[6:10], answerTTL)
+		binary.BigEndian.PutUint16(rr[10:12], uint16(len(data)))
+		resp = append(append(resp, rr...), data...)
+		count++
+	}
+	binary.BigEndian.PutUint16(resp[6:8], count)
+	return resp
+}
@@ -0,0 +1,232 @@
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"congo/internals/network"
+)
+
+const (
+	// upstreamTimeout bounds each attempt at a forwarded query
+	upstreamTimeout = 5 * time.Second
+	// tcpIdleTimeout closes TCP clients gone quiet
+	tcpIdleTimeout = 30 * time.Second
+)
+
+// Resolver knows the containers a server answers for
+type Resolver interface {
+	// Lookup returns the addresses of a container name as client sees
+	// them, false when name isn't a container's
+	Lookup(name string, client net.IP) ([]net.IP, bool)
+	// Upstream returns the nameservers other queries of client go to
+	Upstream(client net.IP) []string
+}
+
+// Run answers DNS queries on addrs, e.g. a network's IPv4 and IPv6
+// gateways, over UDP and TCP. Container names are resolved by r, everything
+// else is forwarded upstream. It prints network.HelperReady or the listen
+// error on stdout, closes stdout and serves until SIGTERM.
+func Run(addrs []string, r Resolver) error {
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	s := &server{resolver: r}
+	var serves []func() error
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			closeAll()
+			fmt.Println(err)
+			return err
+		}
+		closers = append(closers, conn)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeAll()
+			fmt.Println(err)
+			return err
+		}
+		closers = append(closers, l)
+		serves = append(serves, func() error { return s.serveUDP(conn) }, func() error { return s.serveTCP(l) })
+	}
+
+	fmt.Println(network.HelperReady)
+	os.Stdout.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		closeAll()
+	}()
+
+	errs := make(chan error, len(serves))
+	for _, serve := range serves {
+		go func(serve func() error) { errs <- serve() }(serve)
+	}
+	err := <-errs
+	closeAll()
+	for i := 1; i < len(serves); i++ {
+		<-errs
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+type server struct {
+	resolver Resolver
+}
+
+func (s *server) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.answer(query, addrIP(addr), "udp"); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *server) serveTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+// serveConn answers the length-prefixed queries of a TCP client
+func (s *server) serveConn(c net.Conn) {
+	defer c.Close()
+	for {
+		c.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readTCP(c)
+		if err != nil {
+			return
+		}
+		resp := s.answer(query, addrIP(c.RemoteAddr()), "tcp")
+		if resp == nil {
+			return
+		}
+		if err := writeTCP(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// answer resolves container names itself and forwards the rest, proto is
+// what the query came in over. Nothing is sent back for garbage.
+func (s *server) answer(query []byte, client net.IP, proto string) []byte {
+	if len(query) < headerSize || binary.BigEndian.Uint16(query[2:4])&flagQR != 0 {
+		return nil
+	}
+	q, end, err := parseQuery(query)
+	if err != nil {
+		return reply(query, headerSize, rcodeFormErr, 0, nil)
+	}
+	if binary.BigEndian.Uint16(query[2:4])&opcodeMask != 0 {
+		return reply(query, end, rcodeNotImp, q.Type, nil)
+	}
+
+	if q.Class == ClassIN {
+		if ips, ok := s.resolver.Lookup(q.Name, client); ok {
+			// Other record types of a container name have no data
+			if q.Type != TypeA && q.Type != TypeAAAA {
+				ips = nil
+			}
+			return reply(query, end, 0, q.Type, ips)
+		}
+	}
+
+	for _, server := range s.resolver.Upstream(client) {
+		if resp, err := forward(query, server, proto); err == nil {
+			return resp
+		}
+	}
+	return reply(query, end, rcodeServFail, q.Type, nil)
+}
+
+// forward relays a query to an upstream nameserver and returns its answer
+// unchanged
+func forward(query []byte, server, proto string) ([]byte, error) {
+	conn, err := net.DialTimeout(proto, net.JoinHostPort(server, "53"), upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if proto == "tcp" {
+		if err := writeTCP(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCP(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Stray answers to other queries are skipped
+		if n >= headerSize && buf[0] == query[0] && buf[1] == query[1] {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+func readTCP(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCP(w io.Writer, msg []byte) error {
+	out := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(out, uint16(len(msg)))
+	_, err := w.Write(append(out, msg...))
+	return err
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
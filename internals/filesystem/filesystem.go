@@ -5,42 +5,245 @@ package filesystem
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
     "golang.org/x/sys/unix"
+	"congo/internals/archive"
 	"congo/internals/types"
 )
 
+// SetupLayeredRootfs mounts a private overlay for the container, with the
+// image as the read-only lowerdir and the container's own upper/work dirs
+// under the state root, then pivots into the merged directory
 func SetupLayeredRootfs(config *types.Config) error {
-    // Create work and upper directories
-    workDir := filepath.Join(os.TempDir(), "overlay-work")
-    upperDir := config.Rootfs
+    if config.ContainerID == "" {
+        return fmt.Errorf("container ID is required for a layered rootfs")
+    }
 
-    if err := os.MkdirAll(workDir, 0755); err != nil {
-        return fmt.Errorf("failed to create work directory: %v", err)
+    // Lower layers are ordered top-most first, a plain rootfs is a single layer
+    lowerDirs := config.ImageLayers
+    if len(lowerDirs) == 0 {
+        if config.Rootfs == "" {
+            return fmt.Errorf("no rootfs or image layers specified")
+        }
+        lowerDirs = []string{config.Rootfs}
     }
 
-    if err := os.MkdirAll(upperDir, 0755); err != nil {
-        return fmt.Errorf("failed to create upper directory: %v", err)
+    containerDir := filepath.Join(config.StateDir, config.ContainerID)
+    upperDir := filepath.Join(containerDir, types.OverlayUpperDir)
+    workDir := filepath.Join(containerDir, types.OverlayWorkDir)
+    mergedDir := filepath.Join(containerDir, types.OverlayMergedDir)
+
+    for _, dir := range []string{upperDir, workDir, mergedDir} {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return fmt.Errorf("failed to create overlay directory %s: %v", dir, err)
+        }
+    }
+
+    if err := makeRootPrivate(); err != nil {
+        return err
+    }
+
+    // trusted.* xattrs can't be set from a user namespace, overlay has to keep its metadata in user.*
+    if err := MountOverlay(lowerDirs, upperDir, workDir, mergedDir, InUserNamespace()); err != nil {
+        return err
+    }
+
+    if err := setupVolumes(config, mergedDir); err != nil {
+        return err
+    }
+    if err := setupEtcFiles(config, mergedDir); err != nil {
+        return err
     }
 
-    lowerDirs := strings.Join(config.ImageLayers, ":")
-    overlayOpts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDirs, upperDir, workDir)
+    return pivotRoot(mergedDir)
+}
 
-    if err := unix.Mount("overlay", "/", "overlay", 0, overlayOpts); err != nil {
+// MountOverlay mounts an overlay of lowerDirs (top-most first) at target.
+// Without an upper directory the overlay is read-only. userXattr keeps
+// overlay metadata in user.* xattrs, which is what containers running in a
+// user namespace use, so it has to match when their upper dir is reused.
+func MountOverlay(lowerDirs []string, upperDir, workDir, target string, userXattr bool) error {
+    opts := "lowerdir=" + strings.Join(lowerDirs, ":")
+    if upperDir != "" {
+        opts += ",upperdir=" + upperDir + ",workdir=" + workDir
+    }
+    if userXattr {
+        opts += ",userxattr"
+    }
+
+    if err := unix.Mount("overlay", target, "overlay", 0, opts); err != nil {
         return fmt.Errorf("failed to mount overlay filesystem: %v", err)
     }
+    return nil
+}
+
+func SetupRootfs(config *types.Config) error {
+    if err := makeRootPrivate(); err != nil {
+        return err
+    }
+
+    if err := setupVolumes(config, config.Rootfs); err != nil {
+        return err
+    }
+    if err := setupEtcFiles(config, config.Rootfs); err != nil {
+        return err
+    }
+
+    return pivotRoot(config.Rootfs)
+}
+
+// setupVolumes bind mounts the container's volumes into the new root. This
+// has to happen before pivoting, host paths are gone afterwards. Volumes the
+// image declares get an anonymous directory under the container's state dir
+// unless a mount already covers them.
+func setupVolumes(config *types.Config, root string) error {
+    mounts := append([]types.Mount{}, config.Mounts...)
+
+    for _, volume := range config.Volumes {
+        covered := false
+        for _, mount := range config.Mounts {
+            if filepath.Clean(mount.Destination) == volume {
+                covered = true
+                break
+            }
+        }
+        if covered {
+            continue
+        }
+
+        source := filepath.Join(config.StateDir, config.ContainerID, "volumes", strings.ReplaceAll(strings.Trim(volume, "/"), "/", "_"))
+        if _, err := os.Stat(source); os.IsNotExist(err) {
+            // A new volume starts out with what the image has at that path
+            if err := populateVolume(filepath.Join(root, volume), source); err != nil {
+                return err
+            }
+        }
+        mounts = append(mounts, types.Mount{Source: source, Destination: volume})
+    }
+
+    return SetupMounts(root, mounts)
+}
+
+// setupEtcFiles bind mounts the hosts, hostname and resolv.conf files the
+// parent generated over the image's, unless the user mounted their own
+func setupEtcFiles(config *types.Config, root string) error {
+    var mounts []types.Mount
+    for _, name := range []string{types.HostsFile, types.HostnameFile, types.ResolvConfFile} {
+        source := filepath.Join(config.StateDir, config.ContainerID, name)
+        dest := filepath.Join("/etc", name)
+        if _, err := os.Stat(source); err != nil {
+            continue
+        }
+        covered := false
+        for _, mount := range config.Mounts {
+            if filepath.Clean(mount.Destination) == dest {
+                covered = true
+                break
+            }
+        }
+        if !covered {
+            mounts = append(mounts, types.Mount{Source: source, Destination: dest})
+        }
+    }
+    return SetupMounts(root, mounts)
+}
 
+func populateVolume(src, dest string) error {
+    tmp := dest + ".tmp"
+    if err := os.MkdirAll(tmp, 0755); err != nil {
+        return fmt.Errorf("failed to create volume directory %s: %v", dest, err)
+    }
+
+    if _, err := os.Stat(src); err == nil {
+        pr, pw := io.Pipe()
+        go func() {
+            pw.CloseWithError(archive.Tar(pw, src, archive.TarOptions{}))
+        }()
+        err := archive.Untar(pr, tmp, archive.TarOptions{})
+        pr.CloseWithError(err)
+        if err != nil {
+            os.RemoveAll(tmp)
+            return fmt.Errorf("failed to populate volume %s: %v", dest, err)
+        }
+    }
+
+    return os.Rename(tmp, dest)
+}
+
+// SetupMounts bind mounts host paths into root, destinations are taken
+// relative to root
+func SetupMounts(root string, mounts []types.Mount) error {
+    for _, mount := range mounts {
+        dest, err := archive.SafeJoin(root, mount.Destination)
+        if err != nil {
+            return err
+        }
+
+        // Files can be bind mounted too, the mount point has to match
+        if fi, err := os.Stat(mount.Source); err == nil && !fi.IsDir() {
+            if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+                return fmt.Errorf("failed to create mount point: %v", err)
+            }
+            f, err := os.OpenFile(dest, os.O_CREATE, 0644)
+            if err != nil {
+                return fmt.Errorf("failed to create mount point: %v", err)
+            }
+            f.Close()
+        } else if err := os.MkdirAll(dest, 0755); err != nil {
+            return fmt.Errorf("failed to create mount point: %v", err)
+        }
+
+        if err := unix.Mount(mount.Source, dest, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+            return fmt.Errorf("failed to bind mount %s: %v", mount.Source, err)
+        }
+        // MS_RDONLY is ignored on the initial bind, it needs a remount
+        if mount.ReadOnly {
+            if err := RemountReadOnly(dest); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// SetupWorkingDir changes into the container's working directory, creating
+// it if the image doesn't have it yet
+func SetupWorkingDir(dir string) error {
+    if dir == "" {
+        return nil
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return fmt.Errorf("failed to create working directory %s: %v", dir, err)
+    }
+    if err := os.Chdir(dir); err != nil {
+        return fmt.Errorf("failed to change to working directory %s: %v", dir, err)
+    }
     return nil
 }
 
-func SetupRootfs(rootfs string) error {
-    // Make root mount private
+// InUserNamespace reports whether the calling process runs in a user
+// namespace other than the initial one
+func InUserNamespace() bool {
+    data, err := os.ReadFile("/proc/self/uid_map")
+    if err != nil {
+        return false
+    }
+    fields := strings.Fields(string(data))
+    return !(len(fields) == 3 && fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295")
+}
+
+func makeRootPrivate() error {
+    // Make root mount private so nothing below propagates back to the host
     if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
         return fmt.Errorf("error making root private: %v", err)
     }
+    return nil
+}
 
+func pivotRoot(rootfs string) error {
     // Bind mount the new rootfs onto itself
     if err := unix.Mount(rootfs, rootfs, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
         return fmt.Errorf("error binding rootfs: %v", err)
@@ -72,10 +275,98 @@ func SetupRootfs(rootfs string) error {
         return fmt.Errorf("error removing pivot dir: %v", err)
     }
 
-    // Mount proc inside the new root
+    // Mount proc inside the new root, minimal images may not ship the mount point
+    if err := os.MkdirAll("/proc", 0555); err != nil {
+        return fmt.Errorf("error creating /proc: %v", err)
+    }
     if err := unix.Mount("proc", "/proc", "proc", 0, ""); err != nil {
         return fmt.Errorf("error mounting proc: %v", err)
     }
 
     return nil
-}
\ No newline at end of file
+}
+
+// tmpfsFlags maps the generic mount options accepted by --tmpfs to mount
+// flags, anything else is passed to tmpfs as mount data
+var tmpfsFlags = map[string]struct {
+    clear bool
+    flag  uintptr
+}{
+    "ro":       {false, unix.MS_RDONLY},
+    "rw":       {true, unix.MS_RDONLY},
+    "nosuid":   {false, unix.MS_NOSUID},
+    "suid":     {true, unix.MS_NOSUID},
+    "nodev":    {false, unix.MS_NODEV},
+    "dev":      {true, unix.MS_NODEV},
+    "noexec":   {false, unix.MS_NOEXEC},
+    "exec":     {true, unix.MS_NOEXEC},
+    "noatime":  {false, unix.MS_NOATIME},
+    "relatime": {false, unix.MS_RELATIME},
+}
+
+func SetupTmpfs(mounts []types.TmpfsMount) error {
+    for _, mount := range mounts {
+        if err := os.MkdirAll(mount.Destination, 0755); err != nil {
+            return fmt.Errorf("failed to create tmpfs mount point %s: %v", mount.Destination, err)
+        }
+
+        // Same defaults as docker: tmpfs mounts never carry setuid binaries or device nodes
+        flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV)
+        var data []string
+        for _, opt := range strings.Split(mount.Options, ",") {
+            if opt == "" {
+                continue
+            }
+            if f, ok := tmpfsFlags[opt]; ok {
+                if f.clear {
+                    flags &^= f.flag
+                } else {
+                    flags |= f.flag
+                }
+                continue
+            }
+            data = append(data, opt)
+        }
+
+        if err := unix.Mount("tmpfs", mount.Destination, "tmpfs", flags, strings.Join(data, ",")); err != nil {
+            return fmt.Errorf("failed to mount tmpfs at %s: %v", mount.Destination, err)
+        }
+    }
+    return nil
+}
+
+// mountFlags maps the ST_* flags statfs reports to the MS_* flags of mount,
+// most have the same value but ST_RELATIME doesn't
+var mountFlags = []struct {
+    st int64
+    ms uintptr
+}{
+    {unix.ST_NOSUID, unix.MS_NOSUID},
+    {unix.ST_NODEV, unix.MS_NODEV},
+    {unix.ST_NOEXEC, unix.MS_NOEXEC},
+    {unix.ST_NOATIME, unix.MS_NOATIME},
+    {unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+    {unix.ST_RELATIME, unix.MS_RELATIME},
+}
+
+// RemountReadOnly makes the mount at path read-only. The flags already on the
+// mount are kept because the kernel refuses to clear locked flags (nosuid,
+// nodev, ...) from inside a user namespace.
+func RemountReadOnly(path string) error {
+    var st unix.Statfs_t
+    if err := unix.Statfs(path, &st); err != nil {
+        return fmt.Errorf("failed to stat mount %s: %v", path, err)
+    }
+
+    flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+    for _, f := range mountFlags {
+        if st.Flags&f.st != 0 {
+            flags |= f.ms
+        }
+    }
+    if err := unix.Mount("", path, "", flags, ""); err != nil {
+        return fmt.Errorf("failed to remount %s read-only: %v", path, err)
+    }
+
+    return nil
+}
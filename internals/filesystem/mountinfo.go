@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package filesystem
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MountInfo is one line of /proc/<pid>/mountinfo
+type MountInfo struct {
+	ID         int    `json:"id"`
+	Parent     int    `json:"parent"`
+	Device     string `json:"device"`
+	Root       string `json:"root"`
+	MountPoint string `json:"mount_point"`
+	Options    string `json:"options"`
+	FSType     string `json:"fstype"`
+	Source     string `json:"source"`
+	SuperOpts  string `json:"super_options"`
+}
+
+// ReadMountInfo returns the mounts seen by a process, mount points are
+// relative to the process' root directory
+func ReadMountInfo(pid int) ([]MountInfo, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/mountinfo", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %v", err)
+	}
+	defer f.Close()
+
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		fields := strings.Fields(pre)
+		postFields := strings.Fields(post)
+		if !ok || len(fields) < 6 || len(postFields) < 3 {
+			continue
+		}
+
+		id, _ := strconv.Atoi(fields[0])
+		parent, _ := strconv.Atoi(fields[1])
+		mounts = append(mounts, MountInfo{
+			ID:         id,
+			Parent:     parent,
+			Device:     fields[2],
+			Root:       unescapeMountPath(fields[3]),
+			MountPoint: unescapeMountPath(fields[4]),
+			Options:    fields[5],
+			FSType:     postFields[0],
+			Source:     unescapeMountPath(postFields[1]),
+			SuperOpts:  postFields[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %v", err)
+	}
+
+	return mounts, nil
+}
+
+// unescapeMountPath undoes the octal escaping (\040 for a space) the kernel
+// applies to paths in mountinfo
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+package filesystem
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks matches the kernel's limit on symlinks followed in one lookup
+const maxSymlinks = 40
+
+// ResolveInRoot resolves path inside root as if root were "/": symlinks are
+// followed with absolute targets taken relative to root, and ".." never
+// climbs above it. The returned host path contains no symlinks, except for
+// the last component when followLast is false. Components that don't exist
+// are kept as they are.
+func ResolveInRoot(root, path string, followLast bool) (string, error) {
+	parts := strings.Split(path, "/")
+	resolved := "/"
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		if len(parts) == 0 && !followLast {
+			resolved = next
+			break
+		}
+
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
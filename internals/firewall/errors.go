@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package firewall
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// CommandError is a failed external command with what it printed
+type CommandError struct {
+	Args   []string
+	Output string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("%s: %v", strings.Join(e.Args, " "), e.Err)
+	}
+	return fmt.Sprintf("%s: %v: %s", strings.Join(e.Args, " "), e.Err, e.Output)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// NftablesError is an nftables request the kernel refused, errors.Is works
+// against the errno
+type NftablesError struct {
+	Op  string
+	Err syscall.Errno
+}
+
+func (e *NftablesError) Error() string {
+	return fmt.Sprintf("nftables %s: %v", e.Op, e.Err)
+}
+
+func (e *NftablesError) Unwrap() error {
+	return e.Err
+}
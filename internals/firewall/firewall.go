@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+
+	"congo/internals/types"
+)
+
+// Backend names, also accepted in $CONGO_FIREWALL
+const (
+	BackendIptables = "iptables"
+	BackendNftables = "nftables"
+	// BackendNone disables firewall rules, ports are published by
+	// userspace proxies and containers get no NAT
+	BackendNone = "none"
+)
+
+// EnvBackend overrides the backend detection
+const EnvBackend = "CONGO_FIREWALL"
+
+// ErrDisabled is returned for BackendNone
+var ErrDisabled = errors.New("firewall disabled by $" + EnvBackend)
+
+// Bridge is a congo bridge as the firewall sees it
+type Bridge struct {
+	Name string
+	// Subnet is empty on IPv6-only bridges
+	Subnet string
+	// IPv6Subnet is empty on IPv4-only bridges. Its traffic to outside
+	// networks is masqueraded too, unless IPv6Routed: then the subnet is
+	// routed to the host and containers keep their addresses.
+	IPv6Subnet string
+	IPv6Routed bool
+}
+
+// Firewall sets up the NAT and filtering congo's networks need. Every
+// bridge and every container with published ports gets rules of its own,
+// so removing them never touches anything else.
+type Firewall interface {
+	Name() string
+	// SetupBridge lets the containers on a bridge reach outside networks
+	// through NAT and isolates them from other congo bridges. Setting up a
+	// bridge again replaces its rules.
+	SetupBridge(b Bridge) error
+	// RemoveBridge drops what SetupBridge added, a bridge without rules is
+	// not an error
+	RemoveBridge(b Bridge) error
+	// PublishPorts forwards host ports to a container, for connections
+	// coming in from outside as well as from the host itself. Each port is
+	// forwarded to the container's address of the host address' family,
+	// ports without a host address to all of its addresses.
+	PublishPorts(containerID string, containerIPs []string, ports []types.PortMapping) error
+	// UnpublishPorts drops all the port forwarding of a container at once
+	UnpublishPorts(containerID string) error
+}
+
+// New returns the backend to use: the one named in $CONGO_FIREWALL,
+// otherwise iptables when it's installed, since the host's own iptables
+// rules would drop forwarded traffic nftables accepted, and nftables
+// otherwise. It fails when neither can be used.
+func New() (Firewall, error) {
+	if name := os.Getenv(EnvBackend); name != "" {
+		return Get(name)
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return &iptables{}, nil
+	}
+	if nftablesAvailable() {
+		return &nftables{}, nil
+	}
+	return nil, fmt.Errorf("neither iptables nor nftables is available")
+}
+
+// Get returns a backend by name, e.g. the one that set up rules which now
+// have to be removed
+func Get(name string) (Firewall, error) {
+	switch name {
+	case BackendIptables:
+		if _, err := exec.LookPath("iptables"); err != nil {
+			return nil, fmt.Errorf("iptables is not installed")
+		}
+		return &iptables{}, nil
+	case BackendNftables:
+		if !nftablesAvailable() {
+			return nil, fmt.Errorf("the kernel doesn't support nftables")
+		}
+		return &nftables{}, nil
+	case BackendNone:
+		return nil, ErrDisabled
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q, expected iptables, nftables or none", name)
+}
+
+// chainID is the part of a container ID in its chain names
+func chainID(containerID string) string {
+	if len(containerID) > 12 {
+		return containerID[:12]
+	}
+	return containerID
+}
+
+// portTargets pairs each container address with the ports forwarded to it.
+// A port bound to an address of a family the container has no address of
+// can't be forwarded.
+func portTargets(containerIPs []string, ports []types.PortMapping) (map[string][]types.PortMapping, error) {
+	targets := make(map[string][]types.PortMapping)
+	for _, port := range ports {
+		hostIP := net.ParseIP(port.HostIP)
+		found := false
+		for _, addr := range containerIPs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid container address %s", addr)
+			}
+			if hostIP == nil || (hostIP.To4() == nil) == (ip.To4() == nil) {
+				targets[addr] = append(targets[addr], port)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("container has no address of the family of host address %s", port.HostIP)
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,234 @@
+//go:build linux
+// +build linux
+
+package firewall
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"congo/internals/types"
+)
+
+// iptables keeps the forwarding of each container in a nat chain of its
+// own, jumped to from PREROUTING and OUTPUT for local destinations
+type iptables struct{}
+
+func (*iptables) Name() string {
+	return BackendIptables
+}
+
+func (*iptables) SetupBridge(b Bridge) error {
+	for _, set := range bridgeRuleSets(b, false) {
+		if err := set.setup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setup adds the rules of a bridge that are missing
+func (set ruleSet) setup() error {
+	// Isolation has to come before the ACCEPT rules of any bridge, it's
+	// inserted at the top, traffic staying on the bridge first
+	isolation := set.rules[:2]
+	present := true
+	for _, rule := range isolation {
+		present = present && set.run(ruleArgs("-C", rule)...) == nil
+	}
+	if !present {
+		for _, rule := range isolation {
+			set.run(ruleArgs("-D", rule)...)
+		}
+		for i := len(isolation) - 1; i >= 0; i-- {
+			if err := set.run(ruleArgs("-I", isolation[i])...); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, rule := range set.rules[2:] {
+		// Only append rules that aren't there yet, -C checks for them
+		if set.run(ruleArgs("-C", rule)...) == nil {
+			continue
+		}
+		if err := set.run(ruleArgs("-A", rule)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*iptables) RemoveBridge(b Bridge) error {
+	// Masquerading rules are removed whatever the IPv6 mode is now
+	for _, set := range bridgeRuleSets(b, true) {
+		for _, rule := range set.rules {
+			set.run(ruleArgs("-D", rule)...)
+		}
+	}
+	return nil
+}
+
+func (fw *iptables) PublishPorts(containerID string, containerIPs []string, ports []types.PortMapping) error {
+	targets, err := portTargets(containerIPs, ports)
+	if err != nil {
+		return err
+	}
+	// Start from an empty chain, e.g. after a crash left one behind
+	fw.UnpublishPorts(containerID)
+
+	chain := iptablesChain(containerID)
+	for containerIP, ports := range targets {
+		run := Iptables
+		if net.ParseIP(containerIP).To4() == nil {
+			run = Ip6tables
+		}
+		if err := publishChain(run, chain, containerIP, ports); err != nil {
+			fw.UnpublishPorts(containerID)
+			return err
+		}
+	}
+	return nil
+}
+
+// publishChain fills the nat chain of a container's ports in one family
+// and jumps to it
+func publishChain(run func(...string) error, chain, containerIP string, ports []types.PortMapping) error {
+	if err := run("-t", "nat", "-N", chain); err != nil {
+		return err
+	}
+	for _, port := range ports {
+		rule := []string{"-t", "nat", "-A", chain, "-p", port.Protocol}
+		if ip := net.ParseIP(port.HostIP); ip != nil && !ip.IsUnspecified() {
+			rule = append(rule, "-d", port.HostIP)
+		}
+		rule = append(rule, "--dport", strconv.Itoa(port.HostPort),
+			"-j", "DNAT", "--to-destination", net.JoinHostPort(containerIP, strconv.Itoa(port.ContainerPort)))
+		if err := run(rule...); err != nil {
+			return err
+		}
+	}
+	ipv6 := net.ParseIP(containerIP).To4() == nil
+	for _, jump := range jumpRules(chain, ipv6) {
+		if err := run(ruleArgs("-A", jump)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*iptables) UnpublishPorts(containerID string) error {
+	chain := iptablesChain(containerID)
+	var firstErr error
+	for _, family := range []struct {
+		run  func(...string) error
+		ipv6 bool
+	}{{Iptables, false}, {Ip6tables, true}} {
+		for _, jump := range jumpRules(chain, family.ipv6) {
+			// Deleting removes one copy of a rule, repeat until none is left
+			for family.run(ruleArgs("-D", jump)...) == nil {
+			}
+		}
+		if family.run("-t", "nat", "-F", chain) != nil {
+			// No chain, nothing was published
+			continue
+		}
+		if err := family.run("-t", "nat", "-X", chain); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// iptablesChain is the nat chain of a container's published ports, chain
+// names are limited to 28 characters
+func iptablesChain(containerID string) string {
+	return "CONGO-" + chainID(containerID)
+}
+
+// jumpRules send connections to local addresses to a container's chain.
+// The kernel won't route IPv6 loopback traffic to another host, ::1 is
+// left alone.
+func jumpRules(chain string, ipv6 bool) [][]string {
+	var rules [][]string
+	for _, hook := range []string{"PREROUTING", "OUTPUT"} {
+		rule := []string{"-t", "nat", hook, "-m", "addrtype", "--dst-type", "LOCAL"}
+		if ipv6 {
+			rule = append(rule, "!", "-d", "::1")
+		}
+		rules = append(rules, append(rule, "-j", chain))
+	}
+	return rules
+}
+
+// ruleSet is the rules of a bridge in one family and the command adding
+// them
+type ruleSet struct {
+	run   func(...string) error
+	rules [][]string
+}
+
+// bridgeRuleSets are the rules of a bridge, the IPv4 ones and the IPv6 ones
+// of the subnets it has. allMasquerade includes the IPv6 masquerading rule
+// of a routed subnet.
+func bridgeRuleSets(b Bridge, allMasquerade bool) []ruleSet {
+	var sets []ruleSet
+	if b.Subnet != "" {
+		sets = append(sets, ruleSet{Iptables, bridgeRules(b.Name, b.Subnet, "127.0.0.0/8")})
+	}
+	if b.IPv6Subnet != "" {
+		rules := bridgeRules(b.Name, b.IPv6Subnet, "")
+		if b.IPv6Routed && !allMasquerade {
+			rules = append(rules[:2], rules[3:]...)
+		}
+		sets = append(sets, ruleSet{Ip6tables, rules})
+	}
+	return sets
+}
+
+// bridgeRules are the rules of a bridge as table, chain and rule spec.
+// congo+ matches every congo bridge. Connections from loopback are
+// masqueraded when it's given, those to published ports leave that way.
+func bridgeRules(bridge, subnet, loopback string) [][]string {
+	rules := [][]string{
+		{"-t", "filter", "FORWARD", "-i", bridge, "-o", bridge, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-i", bridge, "-o", "congo+", "-j", "DROP"},
+		{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-o", bridge, "-j", "MASQUERADE"},
+	}
+	if loopback != "" {
+		rules = append(rules, []string{"-t", "nat", "POSTROUTING", "-s", loopback, "-o", bridge, "-j", "MASQUERADE"})
+	}
+	return append(rules,
+		[]string{"-t", "filter", "FORWARD", "-i", bridge, "-j", "ACCEPT"},
+		[]string{"-t", "filter", "FORWARD", "-o", bridge, "-j", "ACCEPT"},
+	)
+}
+
+func ruleArgs(action string, rule []string) []string {
+	table, spec := rule[:2], rule[2:]
+	return append(append(append([]string{}, table...), action), spec...)
+}
+
+// Iptables runs iptables, a failure is a *CommandError carrying its output
+func Iptables(args ...string) error {
+	return runCommand("iptables", args...)
+}
+
+// Ip6tables runs ip6tables like Iptables
+func Ip6tables(args ...string) error {
+	return runCommand("ip6tables", args...)
+}
+
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return &CommandError{
+			Args:   append([]string{name}, args...),
+			Output: strings.TrimSpace(string(out)),
+			Err:    err,
+		}
+	}
+	return nil
+}
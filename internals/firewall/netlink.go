@@ -0,0 +1,205 @@
+//go:build linux
+// +build linux
+
+package firewall
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/netlink"
+)
+
+// sizeofNfgenmsg is the size of struct nfgenmsg heading every nfnetlink
+// payload
+const sizeofNfgenmsg = 4
+
+// nfReplyTimeout bounds the wait for the kernel's answers to a batch
+const nfReplyTimeout = 5 * time.Second
+
+var nfSeq uint32
+
+// be32Attr is a number attribute, nftables wants them in network byte order
+func be32Attr(typ uint16, v uint32) netlink.Attr {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return netlink.Attr{Type: typ, Data: b}
+}
+
+// nfMsg is one nftables message of a batch
+type nfMsg struct {
+	typ    uint16
+	flags  uint16
+	family uint8 // NFPROTO_IPV4 or NFPROTO_IPV6, unspecified for dumps
+	attrs  []netlink.Attr
+}
+
+// serialize frames the message with the nfnetlink header, resID is only
+// set on the batch delimiters
+func (m nfMsg) serialize(seq uint32, resID uint16) []byte {
+	typ := m.typ
+	if typ != unix.NFNL_MSG_BATCH_BEGIN && typ != unix.NFNL_MSG_BATCH_END {
+		typ |= unix.NFNL_SUBSYS_NFTABLES << 8
+	}
+
+	body := make([]byte, sizeofNfgenmsg)
+	body[0] = m.family
+	body[1] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(body[2:4], resID)
+	for _, attr := range m.attrs {
+		body = append(body, attr.Serialize()...)
+	}
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|m.flags)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	return append(msg, body...)
+}
+
+func nfSocket(op string) (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return -1, &NftablesError{Op: op, Err: netlink.Errno(err)}
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return -1, &NftablesError{Op: op, Err: netlink.Errno(err)}
+	}
+	tv := unix.NsecToTimeval(nfReplyTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return -1, &NftablesError{Op: op, Err: netlink.Errno(err)}
+	}
+	return fd, nil
+}
+
+// nftBatch sends the messages as one transaction, the kernel applies all
+// of them or none. Every message is acknowledged, the first refusal comes
+// back as a *NftablesError.
+func nftBatch(op string, msgs []nfMsg) error {
+	fd, err := nfSocket(op)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	pending := make(map[uint32]bool)
+	begin := atomic.AddUint32(&nfSeq, uint32(len(msgs))+2) - uint32(len(msgs)) - 1
+	pending[begin] = true
+	buf := nfMsg{typ: unix.NFNL_MSG_BATCH_BEGIN}.serialize(begin, unix.NFNL_SUBSYS_NFTABLES)
+	for i, msg := range msgs {
+		seq := begin + uint32(i) + 1
+		msg.flags |= unix.NLM_F_ACK
+		pending[seq] = true
+		buf = append(buf, msg.serialize(seq, 0)...)
+	}
+	end := begin + uint32(len(msgs)) + 1
+	buf = append(buf, nfMsg{typ: unix.NFNL_MSG_BATCH_END}.serialize(end, unix.NFNL_SUBSYS_NFTABLES)...)
+
+	if err := unix.Sendto(fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return &NftablesError{Op: op, Err: netlink.Errno(err)}
+	}
+
+	// The batch delimiters are only answered when the batch as a whole is
+	// refused, e.g. without CAP_NET_ADMIN
+	delete(pending, begin)
+	var failed error
+	reply := make([]byte, 1<<16)
+	for len(pending) > 0 {
+		n, _, err := unix.Recvfrom(fd, reply, 0)
+		if err != nil {
+			return &NftablesError{Op: op, Err: netlink.Errno(err)}
+		}
+		for _, m := range splitMessages(reply[:n]) {
+			if m.typ != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.data) < 4 {
+				return &NftablesError{Op: op, Err: unix.EBADMSG}
+			}
+			errno := -int32(binary.NativeEndian.Uint32(m.data[0:4]))
+			if m.seq == begin {
+				return &NftablesError{Op: op, Err: syscall.Errno(errno)}
+			}
+			delete(pending, m.seq)
+			if errno != 0 && failed == nil {
+				failed = &NftablesError{Op: op, Err: syscall.Errno(errno)}
+			}
+		}
+	}
+	return failed
+}
+
+// nftDump lists the objects of every family, e.g. every chain, and returns
+// the payloads of the replies, each starting with its family
+func nftDump(op string, msgType uint16) ([][]byte, error) {
+	fd, err := nfSocket(op)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	seq := atomic.AddUint32(&nfSeq, 1)
+	msg := nfMsg{typ: msgType, flags: unix.NLM_F_DUMP}.serialize(seq, 0)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, &NftablesError{Op: op, Err: netlink.Errno(err)}
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, &NftablesError{Op: op, Err: netlink.Errno(err)}
+		}
+		for _, m := range splitMessages(buf[:n]) {
+			switch m.typ {
+			case unix.NLMSG_DONE:
+				return replies, nil
+			case unix.NLMSG_ERROR:
+				if len(m.data) < 4 {
+					return nil, &NftablesError{Op: op, Err: unix.EBADMSG}
+				}
+				if errno := -int32(binary.NativeEndian.Uint32(m.data[0:4])); errno != 0 {
+					return nil, &NftablesError{Op: op, Err: syscall.Errno(errno)}
+				}
+			default:
+				if len(m.data) >= sizeofNfgenmsg {
+					replies = append(replies, append([]byte(nil), m.data...))
+				}
+			}
+		}
+	}
+}
+
+type nlMessage struct {
+	typ  uint16
+	seq  uint32
+	data []byte
+}
+
+func splitMessages(b []byte) []nlMessage {
+	var msgs []nlMessage
+	for len(b) >= unix.SizeofNlMsghdr {
+		length := int(binary.NativeEndian.Uint32(b[0:4]))
+		if length < unix.SizeofNlMsghdr || length > len(b) {
+			break
+		}
+		msgs = append(msgs, nlMessage{
+			typ:  binary.NativeEndian.Uint16(b[4:6]),
+			seq:  binary.NativeEndian.Uint32(b[8:12]),
+			data: b[unix.SizeofNlMsghdr:length],
+		})
+		if netlink.Align(length) >= len(b) {
+			break
+		}
+		b = b[netlink.Align(length):]
+	}
+	return msgs
+}
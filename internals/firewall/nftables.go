@@ -0,0 +1,389 @@
+//go:build linux
+// +build linux
+
+package firewall
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/netlink"
+	"congo/internals/types"
+)
+
+// nftTable is the name of the ip and ip6 tables holding every congo chain,
+// nothing else is put in them
+const nftTable = "congo"
+
+// nftFamilies are the families congo has a table in
+var nftFamilies = []uint8{unix.NFPROTO_IPV4, unix.NFPROTO_IPV6}
+
+// Netfilter verdicts and priorities from linux/netfilter.h
+const (
+	nfDrop   = 0
+	nfAccept = 1
+
+	priorityFilter = 0
+	priorityDstNAT = -100
+	prioritySrcNAT = 100
+)
+
+// ifNameSize is IFNAMSIZ, interface names are compared NUL padded
+const ifNameSize = 16
+
+// nftables gives every bridge and every container base chains of their
+// own in the congo table. Changes go to the kernel as one batch, so a
+// container's rules come and go atomically.
+type nftables struct{}
+
+func (*nftables) Name() string {
+	return BackendNftables
+}
+
+func (*nftables) SetupBridge(b Bridge) error {
+	var msgs []nfMsg
+	if b.Subnet != "" {
+		_, ipnet, err := net.ParseCIDR(b.Subnet)
+		if err != nil || ipnet.IP.To4() == nil {
+			return fmt.Errorf("invalid IPv4 subnet %s", b.Subnet)
+		}
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		msgs = bridgeChains(unix.NFPROTO_IPV4, b.Name, ipnet, loopback)
+	}
+
+	if b.IPv6Subnet != "" {
+		_, ipnet6, err := net.ParseCIDR(b.IPv6Subnet)
+		if err != nil || ipnet6.IP.To4() != nil {
+			return fmt.Errorf("invalid IPv6 subnet %s", b.IPv6Subnet)
+		}
+		if b.IPv6Routed {
+			ipnet6 = nil
+		}
+		msgs = append(msgs, bridgeChains(unix.NFPROTO_IPV6, b.Name, ipnet6, nil)...)
+	}
+	return nftBatch("set up bridge "+b.Name, msgs)
+}
+
+// bridgeChains are the chains of a bridge in one family. Traffic from
+// masquerade leaving through other interfaces is masqueraded, as is traffic
+// from loopback going onto the bridge. Either can be nil.
+func bridgeChains(family uint8, bridge string, masquerade, loopback *net.IPNet) []nfMsg {
+	forward := "forward-" + bridge
+	postrouting := "postrouting-" + bridge
+	msgs := []nfMsg{newTable(family)}
+	msgs = append(msgs, newBaseChain(family, forward, "filter", unix.NF_INET_FORWARD, priorityFilter)...)
+	msgs = append(msgs,
+		// Traffic staying on the bridge, then isolation from the others
+		newRule(family, forward, matchIfname(unix.NFT_META_IIFNAME, bridge, unix.NFT_CMP_EQ),
+			matchIfname(unix.NFT_META_OIFNAME, bridge, unix.NFT_CMP_EQ), exprVerdict(nfAccept)),
+		newRule(family, forward, matchIfname(unix.NFT_META_IIFNAME, bridge, unix.NFT_CMP_EQ),
+			matchIfnamePrefix(unix.NFT_META_OIFNAME, "congo"), exprVerdict(nfDrop)),
+		newRule(family, forward, matchIfname(unix.NFT_META_IIFNAME, bridge, unix.NFT_CMP_EQ), exprVerdict(nfAccept)),
+		newRule(family, forward, matchIfname(unix.NFT_META_OIFNAME, bridge, unix.NFT_CMP_EQ), exprVerdict(nfAccept)),
+	)
+	msgs = append(msgs, newBaseChain(family, postrouting, "nat", unix.NF_INET_POST_ROUTING, prioritySrcNAT)...)
+	if masquerade != nil {
+		msgs = append(msgs, newRule(family, postrouting, matchSaddr(masquerade),
+			matchIfname(unix.NFT_META_OIFNAME, bridge, unix.NFT_CMP_NEQ), exprMasq()))
+	}
+	if loopback != nil {
+		msgs = append(msgs, newRule(family, postrouting, matchSaddr(loopback),
+			matchIfname(unix.NFT_META_OIFNAME, bridge, unix.NFT_CMP_EQ), exprMasq()))
+	}
+	return msgs
+}
+
+func (*nftables) RemoveBridge(b Bridge) error {
+	return deleteChains("remove bridge "+b.Name, "forward-"+b.Name, "postrouting-"+b.Name)
+}
+
+func (*nftables) PublishPorts(containerID string, containerIPs []string, ports []types.PortMapping) error {
+	targets, err := portTargets(containerIPs, ports)
+	if err != nil {
+		return err
+	}
+
+	var msgs []nfMsg
+	for containerIP, ports := range targets {
+		ip := net.ParseIP(containerIP)
+		family := uint8(unix.NFPROTO_IPV6)
+		if ip.To4() != nil {
+			ip, family = ip.To4(), unix.NFPROTO_IPV4
+		}
+		msgs = append(msgs, newTable(family))
+		for _, hook := range []struct {
+			name string
+			num  uint32
+		}{{"prerouting", unix.NF_INET_PRE_ROUTING}, {"output", unix.NF_INET_LOCAL_OUT}} {
+			chain := nftChain(containerID, hook.name)
+			msgs = append(msgs, newBaseChain(family, chain, "nat", hook.num, priorityDstNAT)...)
+			for _, port := range ports {
+				var exprs [][]netlink.Attr
+				if hostIP := net.ParseIP(port.HostIP); hostIP != nil && !hostIP.IsUnspecified() {
+					exprs = append(exprs, matchDaddr(hostIP, unix.NFT_CMP_EQ))
+				} else {
+					exprs = append(exprs, matchLocalDaddr())
+					if family == unix.NFPROTO_IPV6 {
+						// IPv6 loopback traffic can't be routed elsewhere
+						exprs = append(exprs, matchDaddr(net.IPv6loopback, unix.NFT_CMP_NEQ))
+					}
+				}
+				exprs = append(exprs, matchPort(port.Protocol, port.HostPort), exprDNAT(family, ip, port.ContainerPort))
+				msgs = append(msgs, newRule(family, chain, exprs...))
+			}
+		}
+	}
+	return nftBatch("publish ports of "+chainID(containerID), msgs)
+}
+
+func (*nftables) UnpublishPorts(containerID string) error {
+	return deleteChains("unpublish ports of "+chainID(containerID),
+		nftChain(containerID, "prerouting"), nftChain(containerID, "output"))
+}
+
+func nftChain(containerID, hook string) string {
+	return "ports-" + chainID(containerID) + "-" + hook
+}
+
+// nftablesAvailable reports whether the kernel answers nftables requests
+func nftablesAvailable() bool {
+	_, err := nftDump("list tables", unix.NFT_MSG_GETTABLE)
+	return err == nil
+}
+
+// deleteChains flushes and deletes those of the chains that exist in
+// either table in one batch, the kernel applies all of it or nothing
+func deleteChains(op string, chains ...string) error {
+	replies, err := nftDump("list chains", unix.NFT_MSG_GETCHAIN)
+	if err != nil {
+		return err
+	}
+	type familyChain struct {
+		family uint8
+		name   string
+	}
+	existing := make(map[familyChain]bool)
+	for _, reply := range replies {
+		attrs := netlink.ParseAttrs(reply[sizeofNfgenmsg:])
+		if netlink.AttrString(attrs[unix.NFTA_CHAIN_TABLE]) == nftTable {
+			existing[familyChain{reply[0], netlink.AttrString(attrs[unix.NFTA_CHAIN_NAME])}] = true
+		}
+	}
+
+	var msgs []nfMsg
+	for _, family := range nftFamilies {
+		for _, chain := range chains {
+			if existing[familyChain{family, chain}] {
+				msgs = append(msgs, flushChain(family, chain), nfMsg{
+					typ:    unix.NFT_MSG_DELCHAIN,
+					family: family,
+					attrs:  []netlink.Attr{netlink.StringAttr(unix.NFTA_CHAIN_TABLE, nftTable), netlink.StringAttr(unix.NFTA_CHAIN_NAME, chain)},
+				})
+			}
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return nftBatch(op, msgs)
+}
+
+func newTable(family uint8) nfMsg {
+	return nfMsg{
+		typ:    unix.NFT_MSG_NEWTABLE,
+		flags:  unix.NLM_F_CREATE,
+		family: family,
+		attrs:  []netlink.Attr{netlink.StringAttr(unix.NFTA_TABLE_NAME, nftTable)},
+	}
+}
+
+// newBaseChain creates a chain on a hook, or empties it when it exists, so
+// the rules that follow replace the old ones
+func newBaseChain(family uint8, name, chainType string, hook uint32, priority int32) []nfMsg {
+	return []nfMsg{
+		{
+			typ:    unix.NFT_MSG_NEWCHAIN,
+			flags:  unix.NLM_F_CREATE,
+			family: family,
+			attrs: []netlink.Attr{
+				netlink.StringAttr(unix.NFTA_CHAIN_TABLE, nftTable),
+				netlink.StringAttr(unix.NFTA_CHAIN_NAME, name),
+				netlink.NestedAttr(unix.NFTA_CHAIN_HOOK,
+					be32Attr(unix.NFTA_HOOK_HOOKNUM, hook),
+					be32Attr(unix.NFTA_HOOK_PRIORITY, uint32(priority))),
+				be32Attr(unix.NFTA_CHAIN_POLICY, nfAccept),
+				netlink.StringAttr(unix.NFTA_CHAIN_TYPE, chainType),
+			},
+		},
+		flushChain(family, name),
+	}
+}
+
+func flushChain(family uint8, name string) nfMsg {
+	return nfMsg{
+		typ:    unix.NFT_MSG_DELRULE,
+		family: family,
+		attrs:  []netlink.Attr{netlink.StringAttr(unix.NFTA_RULE_TABLE, nftTable), netlink.StringAttr(unix.NFTA_RULE_CHAIN, name)},
+	}
+}
+
+// newRule appends a rule made of the given expressions to a chain
+func newRule(family uint8, chain string, exprs ...[]netlink.Attr) nfMsg {
+	var list []netlink.Attr
+	for _, e := range exprs {
+		list = append(list, e...)
+	}
+	return nfMsg{
+		typ:    unix.NFT_MSG_NEWRULE,
+		flags:  unix.NLM_F_CREATE | unix.NLM_F_APPEND,
+		family: family,
+		attrs: []netlink.Attr{
+			netlink.StringAttr(unix.NFTA_RULE_TABLE, nftTable),
+			netlink.StringAttr(unix.NFTA_RULE_CHAIN, chain),
+			netlink.NestedAttr(unix.NFTA_RULE_EXPRESSIONS, list...),
+		},
+	}
+}
+
+// Expressions, each match loads into register 1 and compares
+
+func expr(name string, data ...netlink.Attr) netlink.Attr {
+	attrs := []netlink.Attr{netlink.StringAttr(unix.NFTA_EXPR_NAME, name)}
+	if len(data) > 0 {
+		attrs = append(attrs, netlink.NestedAttr(unix.NFTA_EXPR_DATA, data...))
+	}
+	return netlink.NestedAttr(unix.NFTA_LIST_ELEM, attrs...)
+}
+
+func exprMeta(key uint32) netlink.Attr {
+	return expr("meta", be32Attr(unix.NFTA_META_KEY, key), be32Attr(unix.NFTA_META_DREG, unix.NFT_REG_1))
+}
+
+func exprPayload(base, offset, length uint32) netlink.Attr {
+	return expr("payload",
+		be32Attr(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_PAYLOAD_BASE, base),
+		be32Attr(unix.NFTA_PAYLOAD_OFFSET, offset),
+		be32Attr(unix.NFTA_PAYLOAD_LEN, length))
+}
+
+func exprCmp(op uint32, data []byte) netlink.Attr {
+	return expr("cmp",
+		be32Attr(unix.NFTA_CMP_SREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_CMP_OP, op),
+		netlink.NestedAttr(unix.NFTA_CMP_DATA, netlink.Attr{Type: unix.NFTA_DATA_VALUE, Data: data}))
+}
+
+func exprBitwise(mask []byte) netlink.Attr {
+	return expr("bitwise",
+		be32Attr(unix.NFTA_BITWISE_SREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_BITWISE_DREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_BITWISE_LEN, uint32(len(mask))),
+		netlink.NestedAttr(unix.NFTA_BITWISE_MASK, netlink.Attr{Type: unix.NFTA_DATA_VALUE, Data: mask}),
+		netlink.NestedAttr(unix.NFTA_BITWISE_XOR, netlink.Attr{Type: unix.NFTA_DATA_VALUE, Data: make([]byte, len(mask))}))
+}
+
+func exprVerdict(code uint32) []netlink.Attr {
+	return []netlink.Attr{expr("immediate",
+		be32Attr(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT),
+		netlink.NestedAttr(unix.NFTA_IMMEDIATE_DATA,
+			netlink.NestedAttr(unix.NFTA_DATA_VERDICT, be32Attr(unix.NFTA_VERDICT_CODE, code))))}
+}
+
+func exprMasq() []netlink.Attr {
+	return []netlink.Attr{expr("masq")}
+}
+
+// exprDNAT rewrites the destination to ip:port, an IPv6 address fills all
+// 16 bytes of register 1
+func exprDNAT(family uint8, ip net.IP, port int) []netlink.Attr {
+	portData := make([]byte, 2)
+	binary.BigEndian.PutUint16(portData, uint16(port))
+	return []netlink.Attr{
+		expr("immediate",
+			be32Attr(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_1),
+			netlink.NestedAttr(unix.NFTA_IMMEDIATE_DATA, netlink.Attr{Type: unix.NFTA_DATA_VALUE, Data: ip})),
+		expr("immediate",
+			be32Attr(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_2),
+			netlink.NestedAttr(unix.NFTA_IMMEDIATE_DATA, netlink.Attr{Type: unix.NFTA_DATA_VALUE, Data: portData})),
+		expr("nat",
+			be32Attr(unix.NFTA_NAT_TYPE, unix.NFT_NAT_DNAT),
+			be32Attr(unix.NFTA_NAT_FAMILY, uint32(family)),
+			be32Attr(unix.NFTA_NAT_REG_ADDR_MIN, unix.NFT_REG_1),
+			be32Attr(unix.NFTA_NAT_REG_PROTO_MIN, unix.NFT_REG_2)),
+	}
+}
+
+func matchIfname(key uint32, name string, op uint32) []netlink.Attr {
+	data := make([]byte, ifNameSize)
+	copy(data, name)
+	return []netlink.Attr{exprMeta(key), exprCmp(op, data)}
+}
+
+// matchIfnamePrefix is a name with a trailing wildcard, only the prefix
+// is compared
+func matchIfnamePrefix(key uint32, prefix string) []netlink.Attr {
+	return []netlink.Attr{exprMeta(key), exprCmp(unix.NFT_CMP_EQ, []byte(prefix))}
+}
+
+// matchSaddr compares the source address of an IPv4 or IPv6 header, they
+// sit at different offsets
+func matchSaddr(subnet *net.IPNet) []netlink.Attr {
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		return []netlink.Attr{
+			exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 12, 4),
+			exprBitwise(subnet.Mask[len(subnet.Mask)-4:]),
+			exprCmp(unix.NFT_CMP_EQ, ip4),
+		}
+	}
+	return []netlink.Attr{
+		exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 8, 16),
+		exprBitwise(subnet.Mask),
+		exprCmp(unix.NFT_CMP_EQ, subnet.IP.To16()),
+	}
+}
+
+func matchDaddr(ip net.IP, op uint32) []netlink.Attr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return []netlink.Attr{
+			exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 16, 4),
+			exprCmp(op, ip4),
+		}
+	}
+	return []netlink.Attr{
+		exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 24, 16),
+		exprCmp(op, ip.To16()),
+	}
+}
+
+// matchLocalDaddr matches packets to any address of the host, fib
+// reports the address type in host byte order
+func matchLocalDaddr() []netlink.Attr {
+	local := make([]byte, 4)
+	binary.NativeEndian.PutUint32(local, unix.RTN_LOCAL)
+	return []netlink.Attr{
+		expr("fib",
+			be32Attr(unix.NFTA_FIB_DREG, unix.NFT_REG_1),
+			be32Attr(unix.NFTA_FIB_RESULT, unix.NFT_FIB_RESULT_ADDRTYPE),
+			be32Attr(unix.NFTA_FIB_FLAGS, unix.NFTA_FIB_F_DADDR)),
+		exprCmp(unix.NFT_CMP_EQ, local),
+	}
+}
+
+func matchPort(protocol string, port int) []netlink.Attr {
+	proto := byte(unix.IPPROTO_TCP)
+	if protocol == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+	portData := make([]byte, 2)
+	binary.BigEndian.PutUint16(portData, uint16(port))
+	return []netlink.Attr{
+		exprMeta(unix.NFT_META_L4PROTO),
+		exprCmp(unix.NFT_CMP_EQ, []byte{proto}),
+		exprPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 2, 2),
+		exprCmp(unix.NFT_CMP_EQ, portData),
+	}
+}
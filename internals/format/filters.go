@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package format
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Filters holds --filter key=value arguments, a key given several times
+// matches any of its values
+type Filters map[string][]string
+
+// Add parses a key=value filter argument, only keys in allowed are accepted
+func (f Filters) Add(arg string, allowed ...string) error {
+	key, value, ok := strings.Cut(arg, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid filter %q, expected key=value", arg)
+	}
+	for _, a := range allowed {
+		if a == key {
+			f[key] = append(f[key], value)
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported filter %q, supported filters: %s", key, strings.Join(allowed, ", "))
+}
+
+// Has reports whether any filter was given for key
+func (f Filters) Has(key string) bool {
+	return len(f[key]) > 0
+}
+
+// Match reports whether value matches one of the filters for key, or true
+// when there are none
+func (f Filters) Match(key, value string) bool {
+	if !f.Has(key) {
+		return true
+	}
+	for _, want := range f[key] {
+		if want == value {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchFunc is Match with a custom comparison, e.g. prefix matching
+func (f Filters) MatchFunc(key string, match func(want string) bool) bool {
+	if !f.Has(key) {
+		return true
+	}
+	for _, want := range f[key] {
+		if match(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchLabels reports whether labels satisfy every "label" filter, given
+// either as a bare key that must be present or as key=value. "label!"
+// filters (written label!=key or label!=key=value) must not match.
+func (f Filters) MatchLabels(labels map[string]string) bool {
+	for _, filter := range f["label"] {
+		if !hasLabel(labels, filter) {
+			return false
+		}
+	}
+	for _, filter := range f["label!"] {
+		if hasLabel(labels, filter) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasLabel(labels map[string]string, filter string) bool {
+	key, value, hasValue := strings.Cut(filter, "=")
+	got, ok := labels[key]
+	return ok && (!hasValue || got == value)
+}
@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+var funcs = template.FuncMap{
+	// {{json .Config}} prints a value as JSON
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"truncate": func(s string, n int) string {
+		if len(s) <= n {
+			return s
+		}
+		return s[:n]
+	},
+}
+
+// Parse compiles a --format template. Like docker, "\t" and "\n" written
+// literally on the command line are turned into tabs and newlines.
+func Parse(format string) (*template.Template, error) {
+	format = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(format)
+	tmpl, err := template.New("format").Funcs(funcs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// Execute renders v with tmpl followed by a newline
+func Execute(w io.Writer, tmpl *template.Template, v interface{}) error {
+	if err := tmpl.Execute(w, v); err != nil {
+		return fmt.Errorf("failed to execute format template: %v", err)
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// JSON prints v as indented JSON
+func JSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
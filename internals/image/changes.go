@@ -0,0 +1,184 @@
+//go:build linux
+// +build linux
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ApplyChange applies a Congofile-style instruction (CMD, ENTRYPOINT, ENV,
+// WORKDIR, USER, EXPOSE, VOLUME, LABEL or STOPSIGNAL) to an image config, as
+// used by `congo commit --change`
+func ApplyChange(cfg *ImageConfig, change string) error {
+	instruction, rest, _ := strings.Cut(strings.TrimSpace(change), " ")
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return fmt.Errorf("%s requires an argument", strings.ToUpper(instruction))
+	}
+
+	switch strings.ToUpper(instruction) {
+	case "CMD":
+		cmd, err := ParseCommand(rest)
+		if err != nil {
+			return err
+		}
+		cfg.Cmd = cmd
+	case "ENTRYPOINT":
+		entrypoint, err := ParseCommand(rest)
+		if err != nil {
+			return err
+		}
+		cfg.Entrypoint = entrypoint
+	case "ENV":
+		pairs, err := parsePairs(rest)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			cfg.Env = SetEnv(cfg.Env, pair[0], pair[1])
+		}
+	case "LABEL":
+		pairs, err := parsePairs(rest)
+		if err != nil {
+			return err
+		}
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		for _, pair := range pairs {
+			cfg.Labels[pair[0]] = pair[1]
+		}
+	case "WORKDIR":
+		// Relative directories build on the previous one
+		if !path.IsAbs(rest) {
+			rest = path.Join("/", cfg.WorkingDir, rest)
+		}
+		cfg.WorkingDir = path.Clean(rest)
+	case "USER":
+		cfg.User = rest
+	case "STOPSIGNAL":
+		cfg.StopSignal = rest
+	case "EXPOSE":
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range strings.Fields(rest) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			cfg.ExposedPorts[port] = struct{}{}
+		}
+	case "VOLUME":
+		volumes := strings.Fields(rest)
+		if strings.HasPrefix(rest, "[") {
+			if err := json.Unmarshal([]byte(rest), &volumes); err != nil {
+				return fmt.Errorf("invalid VOLUME: %v", err)
+			}
+		}
+		if cfg.Volumes == nil {
+			cfg.Volumes = make(map[string]struct{})
+		}
+		for _, volume := range volumes {
+			cfg.Volumes[path.Clean(volume)] = struct{}{}
+		}
+	default:
+		return fmt.Errorf("unsupported change instruction: %s", instruction)
+	}
+
+	return nil
+}
+
+// ParseCommand parses the argument of CMD or ENTRYPOINT, either the JSON
+// exec form or the shell form which runs through /bin/sh -c
+func ParseCommand(arg string) ([]string, error) {
+	if strings.HasPrefix(arg, "[") {
+		var cmd []string
+		if err := json.Unmarshal([]byte(arg), &cmd); err != nil {
+			return nil, fmt.Errorf("invalid exec form %s: %v", arg, err)
+		}
+		return cmd, nil
+	}
+	return []string{"/bin/sh", "-c", arg}, nil
+}
+
+// SetEnv sets key in a KEY=value list, replacing an existing entry
+func SetEnv(env []string, key, value string) []string {
+	for i, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); k == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+// parsePairs parses "k1=v1 k2=v2" (values may be quoted) or the legacy
+// "key value" form used by ENV and LABEL
+func parsePairs(arg string) ([][2]string, error) {
+	words, err := splitWords(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(words) > 0 && !strings.Contains(words[0], "=") {
+		key, value, _ := strings.Cut(arg, " ")
+		return [][2]string{{key, strings.TrimSpace(value)}}, nil
+	}
+
+	var pairs [][2]string
+	for _, word := range words {
+		key, value, ok := strings.Cut(word, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %s", word)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs, nil
+}
+
+// splitWords splits on whitespace, honouring single and double quotes and
+// backslash escapes the way a shell would
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != '\'' && r == '\\' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %s", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,404 @@
+//go:build linux
+// +build linux
+
+package image
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/archive"
+	"congo/internals/types"
+)
+
+// ImageConfig holds the runtime defaults of an image, field names follow the
+// OCI image config
+type ImageConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// History records how a layer (or a config-only change) was created
+type History struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// Image is the manifest of a stored image: an ordered list of layer digests
+// (base layer first) plus the config used to run it
+type Image struct {
+	ID        string      `json:"id"`
+	Parent    string      `json:"parent,omitempty"`
+	Layers    []string    `json:"layers"`
+	Config    ImageConfig `json:"config"`
+	Created   time.Time   `json:"created"`
+	Container string      `json:"container,omitempty"`
+	History   []History   `json:"history,omitempty"`
+}
+
+func GetImageDir() string {
+	dir := filepath.Join(types.DefaultImageDir, "sha256")
+	os.MkdirAll(dir, 0755)
+	return types.DefaultImageDir
+}
+
+func GetLayerDir() string {
+	dir := filepath.Join(types.DefaultLayerDir, "sha256")
+	os.MkdirAll(dir, 0755)
+	return types.DefaultLayerDir
+}
+
+// SplitDigest validates a "sha256:<hex>" digest and returns its hex part
+func SplitDigest(digest string) (string, error) {
+	algo, hexPart, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" || len(hexPart) != 64 {
+		return "", fmt.Errorf("invalid digest: %s", digest)
+	}
+	if _, err := hex.DecodeString(hexPart); err != nil {
+		return "", fmt.Errorf("invalid digest: %s", digest)
+	}
+	return hexPart, nil
+}
+
+// LayerPath returns the directory a layer is stored in, it holds the raw
+// layer.tar and the unpacked diff/ directory used as an overlay lowerdir
+func LayerPath(digest string) string {
+	hexPart := strings.TrimPrefix(digest, "sha256:")
+	return filepath.Join(GetLayerDir(), "sha256", hexPart)
+}
+
+func LayerDiffDir(digest string) string {
+	return filepath.Join(LayerPath(digest), "diff")
+}
+
+func LayerTarPath(digest string) string {
+	return filepath.Join(LayerPath(digest), "layer.tar")
+}
+
+func HasLayer(digest string) bool {
+	_, err := os.Stat(LayerDiffDir(digest))
+	return err == nil
+}
+
+// LockLayers takes a shared lock on the layer store. Whoever stores layers
+// holds it until an image referring to them is saved and tagged, layers
+// nothing refers to are only garbage collected under the exclusive lock.
+func LockLayers() (func(), error) {
+	return lockLayers(unix.LOCK_SH)
+}
+
+func lockLayers(how int) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(GetLayerDir(), ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer store lock: %v", err)
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock layer store: %v", err)
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// PutLayer stores an uncompressed layer tarball under its sha256 digest and
+// unpacks it for use as an overlay lowerdir. Storing a layer that already
+// exists is a no-op. The caller holds LockLayers.
+func PutLayer(r io.Reader) (string, error) {
+	return putLayer(r, nil)
+}
+
+// putLayer is PutLayer with a check run once the tarball is read, before
+// anything is committed to the store
+func putLayer(r io.Reader, verify func() error) (string, error) {
+	layerDir := GetLayerDir()
+
+	tmp, err := os.CreateTemp(layerDir, ".tmp-layer-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary layer file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		return "", fmt.Errorf("failed to write layer: %v", err)
+	}
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if verify != nil {
+		if err := verify(); err != nil {
+			return "", err
+		}
+	}
+
+	if HasLayer(digest) {
+		return digest, nil
+	}
+
+	// Unpack next to the final location so a half-extracted layer is never visible
+	extractDir, err := os.MkdirTemp(layerDir, ".tmp-extract-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary layer directory: %v", err)
+	}
+	defer os.RemoveAll(extractDir)
+	if err := os.Chmod(extractDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create temporary layer directory: %v", err)
+	}
+
+	diffDir := filepath.Join(extractDir, "diff")
+	if err := os.Mkdir(diffDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create layer directory: %v", err)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind layer: %v", err)
+	}
+	if err := archive.Untar(tmp, diffDir, archive.TarOptions{OverlayWhiteouts: true}); err != nil {
+		return "", fmt.Errorf("failed to unpack layer %s: %v", digest, err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(extractDir, "layer.tar")); err != nil {
+		return "", fmt.Errorf("failed to store layer tarball: %v", err)
+	}
+	if err := os.Rename(extractDir, LayerPath(digest)); err != nil {
+		return "", fmt.Errorf("failed to store layer %s: %v", digest, err)
+	}
+
+	return digest, nil
+}
+
+// PutLayerFromDir stores the contents of dir as a layer
+func PutLayerFromDir(dir string, opts archive.TarOptions) (string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.Tar(pw, dir, opts))
+	}()
+
+	digest, err := PutLayer(pr)
+	pr.CloseWithError(err)
+	return digest, err
+}
+
+// Import creates a single-layer image from a flat root filesystem tarball,
+// plain or gzip compressed, and tags it with ref. source is recorded in the
+// image history.
+func Import(r io.Reader, ref, source string) (*Image, error) {
+	unlock, err := LockLayers()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	br := bufio.NewReader(r)
+	var layer io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %v", source, err)
+		}
+		defer gz.Close()
+		layer = gz
+	}
+
+	digest, err := PutLayer(layer)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Layers:  []string{digest},
+		Created: time.Now(),
+	}
+	img.History = []History{{Created: img.Created, CreatedBy: "congo import " + source}}
+	if _, err := SaveImage(img); err != nil {
+		return nil, err
+	}
+	if err := Tag(ref, img.ID); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// LayerPaths returns the unpacked layer directories of an image ordered for
+// overlayfs, top-most layer first
+func LayerPaths(img *Image) []string {
+	paths := make([]string, 0, len(img.Layers))
+	for i := len(img.Layers) - 1; i >= 0; i-- {
+		paths = append(paths, LayerDiffDir(img.Layers[i]))
+	}
+	return paths
+}
+
+func imagePath(id string) string {
+	return filepath.Join(GetImageDir(), "sha256", strings.TrimPrefix(id, "sha256:")+".json")
+}
+
+// SaveImage stores an image manifest, its ID is the digest of the manifest
+func SaveImage(img *Image) (string, error) {
+	img.ID = ""
+	data, err := json.Marshal(img)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal image: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	img.ID = "sha256:" + hex.EncodeToString(sum[:])
+
+	data, err = json.MarshalIndent(img, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal image: %v", err)
+	}
+	if err := os.WriteFile(imagePath(img.ID), data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write image manifest: %v", err)
+	}
+
+	return img.ID, nil
+}
+
+func LoadImage(id string) (*Image, error) {
+	if _, err := SplitDigest(id); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(imagePath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image manifest: %v", err)
+	}
+
+	var img Image
+	if err := json.Unmarshal(data, &img); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal image manifest: %v", err)
+	}
+
+	return &img, nil
+}
+
+// NormalizeRef adds the default "latest" tag to a reference without one
+func NormalizeRef(ref string) string {
+	name := ref
+	if i := strings.LastIndex(ref, "/"); i >= 0 {
+		name = ref[i+1:]
+	}
+	if !strings.Contains(name, ":") {
+		return ref + ":latest"
+	}
+	return ref
+}
+
+func repositoriesPath() string {
+	return filepath.Join(GetImageDir(), "repositories.json")
+}
+
+// LoadRepositories returns the map of image references to image IDs
+func LoadRepositories() (map[string]string, error) {
+	repos := make(map[string]string)
+
+	data, err := os.ReadFile(repositoriesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return repos, nil
+		}
+		return nil, fmt.Errorf("failed to read repositories: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &repos); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal repositories: %v", err)
+	}
+
+	return repos, nil
+}
+
+// updateRepositories applies fn to the references in repositories.json
+// under a flock, so concurrent congo processes don't lose each other's tags.
+// The file is replaced with a rename, readers never see it half written.
+func updateRepositories(fn func(repos map[string]string) error) error {
+	if err := os.MkdirAll(GetImageDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create image directory: %v", err)
+	}
+	lock, err := os.OpenFile(repositoriesPath()+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open repositories lock: %v", err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock repositories: %v", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	repos, err := LoadRepositories()
+	if err != nil {
+		return err
+	}
+	if err := fn(repos); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(repos, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal repositories: %v", err)
+	}
+	tmp := repositoriesPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write repositories: %v", err)
+	}
+	return os.Rename(tmp, repositoriesPath())
+}
+
+// Tag points ref at the image id, replacing whatever it pointed at before
+func Tag(ref, id string) error {
+	if _, err := LoadImage(id); err != nil {
+		return err
+	}
+
+	return updateRepositories(func(repos map[string]string) error {
+		repos[NormalizeRef(ref)] = id
+		return nil
+	})
+}
+
+// Lookup resolves an image reference (name[:tag]) or image ID to an image
+func Lookup(ref string) (*Image, error) {
+	repos, err := LoadRepositories()
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := repos[NormalizeRef(ref)]; ok {
+		return LoadImage(id)
+	}
+
+	// Fall back to a full or abbreviated image ID
+	if strings.HasPrefix(ref, "sha256:") || isHex(ref) {
+		return lookupID(ref)
+	}
+
+	return nil, fmt.Errorf("image %s not found", ref)
+}
+
+func isHex(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	_, err := hex.DecodeString(s + strings.Repeat("0", len(s)%2))
+	return err == nil
+}
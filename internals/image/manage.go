@@ -0,0 +1,344 @@
+//go:build linux
+// +build linux
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ImageInspect is what `congo image inspect` prints for an image
+type ImageInspect struct {
+	*Image
+	RepoTags []string `json:"repo_tags"`
+	Size     int64    `json:"size"`
+}
+
+// HistoryEntry is one row of `congo image history`, newest first
+type HistoryEntry struct {
+	History
+	ID   string
+	Size int64
+}
+
+// ListImages returns every image in the store, newest first
+func ListImages() ([]*Image, error) {
+	dir := filepath.Join(GetImageDir(), "sha256")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image directory: %v", err)
+	}
+
+	var images []*Image
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		img, err := LoadImage("sha256:" + strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].Created.After(images[j].Created) })
+	return images, nil
+}
+
+// ShortID returns the 12 character form of an image ID
+func ShortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// RepoTags returns the references pointing at an image
+func RepoTags(repos map[string]string, id string) []string {
+	var tags []string
+	for ref, refID := range repos {
+		if refID == id {
+			tags = append(tags, ref)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// SplitRef splits a normalized reference into repository and tag
+func SplitRef(ref string) (string, string) {
+	ref = NormalizeRef(ref)
+	i := strings.LastIndex(ref, ":")
+	return ref[:i], ref[i+1:]
+}
+
+func layerSize(digest string) int64 {
+	fi, err := os.Stat(LayerTarPath(digest))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Size returns the total size of an image's layers
+func Size(img *Image) int64 {
+	var size int64
+	for _, layer := range img.Layers {
+		size += layerSize(layer)
+	}
+	return size
+}
+
+// lookupID resolves a full image ID or an unambiguous prefix of one
+func lookupID(prefix string) (*Image, error) {
+	prefix = strings.TrimPrefix(prefix, "sha256:")
+	if len(prefix) == 64 {
+		return LoadImage("sha256:" + prefix)
+	}
+
+	images, err := ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var match *Image
+	for _, img := range images {
+		if strings.HasPrefix(strings.TrimPrefix(img.ID, "sha256:"), prefix) {
+			if match != nil {
+				return nil, fmt.Errorf("image ID prefix %s is ambiguous", prefix)
+			}
+			match = img
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("image %s not found", prefix)
+	}
+	return match, nil
+}
+
+func Inspect(ref string) (*ImageInspect, error) {
+	img, err := Lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := LoadRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageInspect{
+		Image:    img,
+		RepoTags: RepoTags(repos, img.ID),
+		Size:     Size(img),
+	}, nil
+}
+
+// ImageHistory pairs an image's history with its layers. Entries marked as
+// empty layers only changed the config.
+func ImageHistory(ref string) ([]HistoryEntry, error) {
+	img, err := Lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	history := img.History
+	if len(history) == 0 {
+		// Images without history get one anonymous entry per layer
+		for range img.Layers {
+			history = append(history, History{Created: img.Created})
+		}
+	}
+
+	var entries []HistoryEntry
+	layer := 0
+	for _, h := range history {
+		entry := HistoryEntry{History: h, ID: "<missing>"}
+		if !h.EmptyLayer && layer < len(img.Layers) {
+			entry.Size = layerSize(img.Layers[layer])
+			layer++
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) > 0 {
+		entries[len(entries)-1].ID = img.ID
+	}
+
+	// Newest first, like docker history
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// Untag removes a reference, the image itself stays in the store
+func Untag(ref string) error {
+	ref = NormalizeRef(ref)
+	return updateRepositories(func(repos map[string]string) error {
+		if _, ok := repos[ref]; !ok {
+			return fmt.Errorf("no such image reference: %s", ref)
+		}
+		delete(repos, ref)
+		return nil
+	})
+}
+
+// RemoveImage removes a reference, and the image once nothing refers to it
+// anymore. Images used by a container (inUse holds their IDs) are never
+// deleted. It returns a line per untagged reference and deleted image.
+func RemoveImage(ref string, inUse map[string]bool) ([]string, error) {
+	img, err := Lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := LoadRepositories()
+	if err != nil {
+		return nil, err
+	}
+	tags := RepoTags(repos, img.ID)
+
+	var removed []string
+	byTag := !strings.HasPrefix(ref, "sha256:") && repos[NormalizeRef(ref)] == img.ID
+
+	// Removing one of several names only drops that name
+	if byTag && len(tags) > 1 {
+		if err := Untag(ref); err != nil {
+			return nil, err
+		}
+		return []string{"Untagged: " + NormalizeRef(ref)}, nil
+	}
+
+	if inUse[img.ID] {
+		return nil, fmt.Errorf("image %s is in use by a container", ShortID(img.ID))
+	}
+	if !byTag && len(tags) > 1 {
+		return nil, fmt.Errorf("image %s is referenced by multiple names %v, remove them by name", ShortID(img.ID), tags)
+	}
+
+	// Tags added since are dropped too, they'd point at a deleted image
+	err = updateRepositories(func(repos map[string]string) error {
+		for _, tag := range RepoTags(repos, img.ID) {
+			delete(repos, tag)
+			removed = append(removed, "Untagged: "+tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(imagePath(img.ID)); err != nil {
+		return nil, fmt.Errorf("failed to remove image manifest: %v", err)
+	}
+	removed = append(removed, "Deleted: "+img.ID)
+
+	layers, _, err := GarbageCollectLayers()
+	if err != nil {
+		return removed, err
+	}
+	for _, layer := range layers {
+		removed = append(removed, "Deleted layer: "+layer)
+	}
+
+	return removed, nil
+}
+
+// Prune removes untagged images, or with all every image, that no
+// container uses and match accepts (nil accepts all), then the layers left
+// unreferenced. It returns the removed
+// image IDs and the number of bytes reclaimed.
+func Prune(all bool, inUse map[string]bool, match func(*Image) bool) ([]string, int64, error) {
+	// Nothing stores layers meanwhile, an image that is saved but not
+	// tagged yet isn't taken for an untagged one
+	unlock, err := lockLayers(unix.LOCK_EX)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	images, err := ListImages()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Images are picked under the lock, so one tagged meanwhile is kept
+	var removed []string
+	err = updateRepositories(func(repos map[string]string) error {
+		for _, img := range images {
+			tags := RepoTags(repos, img.ID)
+			if inUse[img.ID] || (!all && len(tags) > 0) || (match != nil && !match(img)) {
+				continue
+			}
+			for _, tag := range tags {
+				delete(repos, tag)
+			}
+			if err := os.Remove(imagePath(img.ID)); err != nil {
+				return fmt.Errorf("failed to remove image manifest: %v", err)
+			}
+			removed = append(removed, img.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, 0, err
+	}
+
+	_, reclaimed, err := gcLayers()
+	return removed, reclaimed, err
+}
+
+// GarbageCollectLayers removes layers no image refers to. Containers hold on
+// to their layers through the image they run, which is never deleted while
+// the container exists, and layers being stored are kept by LockLayers.
+func GarbageCollectLayers() ([]string, int64, error) {
+	unlock, err := lockLayers(unix.LOCK_EX)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+	return gcLayers()
+}
+
+// gcLayers is GarbageCollectLayers with the layer store locked
+func gcLayers() ([]string, int64, error) {
+	images, err := ListImages()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, img := range images {
+		for _, layer := range img.Layers {
+			referenced[layer] = true
+		}
+	}
+
+	dir := filepath.Join(GetLayerDir(), "sha256")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read layer directory: %v", err)
+	}
+
+	var removed []string
+	var reclaimed int64
+	for _, entry := range entries {
+		digest := "sha256:" + entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || referenced[digest] {
+			continue
+		}
+		size := layerSize(digest)
+		if err := os.RemoveAll(LayerPath(digest)); err != nil {
+			return removed, reclaimed, fmt.Errorf("failed to remove layer %s: %v", digest, err)
+		}
+		removed = append(removed, digest)
+		reclaimed += size
+	}
+
+	return removed, reclaimed, nil
+}
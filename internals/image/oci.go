@@ -0,0 +1,572 @@
+//go:build linux
+// +build linux
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"congo/internals/archive"
+)
+
+// Media types understood when loading images, docker's are accepted as well
+// since `docker save` and registries still hand them out
+const (
+	MediaTypeOCIIndex        = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest     = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig       = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer        = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGzip    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCILayerZstd    = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeDockerList      = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest  = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	AnnotationRefName       = "org.opencontainers.image.ref.name"
+	AnnotationContainerdRef = "io.containerd.image.name"
+
+	ociLayoutVersion = "1.0.0"
+)
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Index is an OCI image index (or docker manifest list)
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// OCIConfig is the image config blob referenced by a manifest
+type OCIConfig struct {
+	Created      *time.Time  `json:"created,omitempty"`
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	Variant      string      `json:"variant,omitempty"`
+	Config       ImageConfig `json:"config"`
+	RootFS       RootFS      `json:"rootfs"`
+	History      []History   `json:"history,omitempty"`
+}
+
+// dockerManifestEntry is one image of the legacy `docker save` format
+type dockerManifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// IsIndex reports whether a media type is an index of per-platform manifests
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerList
+}
+
+// MatchPlatform picks the manifest matching the running platform
+func MatchPlatform(manifests []Descriptor) (Descriptor, error) {
+	for _, desc := range manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.OS == runtime.GOOS && desc.Platform.Architecture == runtime.GOARCH {
+			return desc, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("no manifest for platform %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// verifier checks the digest of everything read through it once it hits EOF
+type verifier struct {
+	r      io.Reader
+	hash   hash.Hash
+	digest string
+}
+
+// NewVerifier wraps r so that reaching EOF fails unless the content matched digest
+func NewVerifier(r io.Reader, digest string) io.Reader {
+	return &verifier{r: r, hash: sha256.New(), digest: digest}
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := "sha256:" + hex.EncodeToString(v.hash.Sum(nil)); got != v.digest {
+			return n, fmt.Errorf("digest mismatch: expected %s, got %s", v.digest, got)
+		}
+	}
+	return n, err
+}
+
+// DecompressLayer returns the uncompressed tar stream of a layer blob
+func DecompressLayer(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip") || strings.HasSuffix(mediaType, ".gzip"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return nil, fmt.Errorf("zstd compressed layers are not supported")
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// ImportLayer stores a (possibly compressed) layer blob and returns its diff ID
+func ImportLayer(r io.Reader, desc Descriptor) (string, error) {
+	blob := NewVerifier(r, desc.Digest)
+
+	layer, err := DecompressLayer(blob, desc.MediaType)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress layer %s: %v", desc.Digest, err)
+	}
+	defer layer.Close()
+
+	// Drain what's left (e.g. gzip trailer padding) so the digest gets
+	// checked before the layer is stored
+	return putLayer(layer, func() error {
+		if _, err := io.Copy(io.Discard, blob); err != nil {
+			return fmt.Errorf("failed to verify layer %s: %v", desc.Digest, err)
+		}
+		return nil
+	})
+}
+
+// ImageFromConfig creates and stores an image from an OCI config and the diff
+// IDs of its already imported layers
+func ImageFromConfig(cfg OCIConfig, diffIDs []string) (*Image, error) {
+	if len(cfg.RootFS.DiffIDs) > 0 && len(cfg.RootFS.DiffIDs) != len(diffIDs) {
+		return nil, fmt.Errorf("image config lists %d layers, manifest has %d", len(cfg.RootFS.DiffIDs), len(diffIDs))
+	}
+	for i, diffID := range cfg.RootFS.DiffIDs {
+		if diffID != diffIDs[i] {
+			return nil, fmt.Errorf("layer %d has diff ID %s, config expects %s", i, diffIDs[i], diffID)
+		}
+	}
+
+	img := &Image{
+		Layers:  diffIDs,
+		Config:  cfg.Config,
+		History: cfg.History,
+	}
+	if cfg.Created != nil {
+		img.Created = *cfg.Created
+	}
+
+	if _, err := SaveImage(img); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// LoadArchive imports every image of an OCI image-layout tarball (or a legacy
+// `docker save` tarball) into the store. Images are tagged with name when
+// given, otherwise with the reference names recorded in the archive (see
+// layoutRef). It returns the references (or IDs of untagged images) that
+// were loaded.
+func LoadArchive(r io.Reader, name string) ([]string, error) {
+	unlock, err := LockLayers()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dir, err := os.MkdirTemp(GetImageDir(), ".tmp-load-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := archive.Untar(r, dir, archive.TarOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to unpack image archive: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+			return loadDockerArchive(dir, name)
+		}
+		return nil, fmt.Errorf("not an OCI image layout: index.json is missing")
+	}
+
+	var layout struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if err := readJSON(filepath.Join(dir, "oci-layout"), &layout); err != nil {
+		return nil, err
+	}
+	if layout.ImageLayoutVersion != ociLayoutVersion {
+		return nil, fmt.Errorf("unsupported image layout version %q", layout.ImageLayoutVersion)
+	}
+
+	var index Index
+	if err := readJSON(filepath.Join(dir, "index.json"), &index); err != nil {
+		return nil, err
+	}
+
+	var loaded []string
+	for _, desc := range index.Manifests {
+		ref := layoutRef(desc, name)
+
+		img, err := loadLayoutManifest(dir, desc)
+		if err != nil {
+			return nil, err
+		}
+
+		if ref == "" {
+			loaded = append(loaded, img.ID)
+			continue
+		}
+		if err := Tag(ref, img.ID); err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, NormalizeRef(ref))
+	}
+
+	return loaded, nil
+}
+
+// layoutRef returns the reference to tag an image of an OCI layout with.
+// org.opencontainers.image.ref.name is usually just the tag (skopeo and
+// image save write it that way), so it's added to a name without a tag and
+// ignored when there's no repository to go with it.
+func layoutRef(desc Descriptor, name string) string {
+	refName := desc.Annotations[AnnotationRefName]
+	tagOnly := refName != "" && !strings.ContainsAny(refName, "/:")
+	switch {
+	case name != "":
+		if tagOnly && NormalizeRef(name) != name {
+			return name + ":" + refName
+		}
+		return name
+	case desc.Annotations[AnnotationContainerdRef] != "":
+		return desc.Annotations[AnnotationContainerdRef]
+	case tagOnly:
+		log.Printf("Warning: image %s is only named by its tag %s, leaving it untagged, give a name to tag it", desc.Digest, refName)
+		return ""
+	}
+	return refName
+}
+
+func loadLayoutManifest(dir string, desc Descriptor) (*Image, error) {
+	// Nested indexes hold one manifest per platform
+	if IsIndex(desc.MediaType) {
+		var index Index
+		if err := readBlobJSON(dir, desc, &index); err != nil {
+			return nil, err
+		}
+		platformDesc, err := MatchPlatform(index.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		return loadLayoutManifest(dir, platformDesc)
+	}
+
+	var manifest Manifest
+	if err := readBlobJSON(dir, desc, &manifest); err != nil {
+		return nil, err
+	}
+
+	var cfg OCIConfig
+	if err := readBlobJSON(dir, manifest.Config, &cfg); err != nil {
+		return nil, err
+	}
+
+	diffIDs := make([]string, 0, len(manifest.Layers))
+	for _, layerDesc := range manifest.Layers {
+		f, err := openBlob(dir, layerDesc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		diffID, err := ImportLayer(f, layerDesc)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	return ImageFromConfig(cfg, diffIDs)
+}
+
+func loadDockerArchive(dir, name string) ([]string, error) {
+	var entries []dockerManifestEntry
+	if err := readJSON(filepath.Join(dir, "manifest.json"), &entries); err != nil {
+		return nil, err
+	}
+
+	var loaded []string
+	for _, entry := range entries {
+		var cfg OCIConfig
+		if err := readJSON(filepath.Join(dir, filepath.Clean("/"+entry.Config)), &cfg); err != nil {
+			return nil, err
+		}
+
+		diffIDs := make([]string, 0, len(entry.Layers))
+		for _, layerPath := range entry.Layers {
+			f, err := os.Open(filepath.Join(dir, filepath.Clean("/"+layerPath)))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open layer %s: %v", layerPath, err)
+			}
+			diffID, err := PutLayer(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			diffIDs = append(diffIDs, diffID)
+		}
+
+		img, err := ImageFromConfig(cfg, diffIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		refs := entry.RepoTags
+		if name != "" {
+			refs = []string{name}
+		}
+		if len(refs) == 0 {
+			loaded = append(loaded, img.ID)
+		}
+		for _, ref := range refs {
+			if err := Tag(ref, img.ID); err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, NormalizeRef(ref))
+		}
+	}
+
+	return loaded, nil
+}
+
+func openBlob(dir, digest string) (*os.File, error) {
+	hexPart, err := SplitDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, "blobs", "sha256", hexPart))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob %s: %v", digest, err)
+	}
+	return f, nil
+}
+
+func readBlobJSON(dir string, desc Descriptor, v interface{}) error {
+	f, err := openBlob(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(NewVerifier(f, desc.Digest))
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %v", desc.Digest, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse blob %s: %v", desc.Digest, err)
+	}
+	return nil
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filepath.Base(path), err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// OCIConfigFor builds the OCI config blob of a stored image
+func OCIConfigFor(img *Image) OCIConfig {
+	created := img.Created
+	return OCIConfig{
+		Created:      &created,
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		Config:       img.Config,
+		RootFS: RootFS{
+			Type:    "layers",
+			DiffIDs: img.Layers,
+		},
+		History: img.History,
+	}
+}
+
+// ManifestFor builds the config and manifest blobs of a stored image. Layers
+// are referenced uncompressed, so their digests are the stored layer digests.
+func ManifestFor(img *Image) (configBlob, manifestBlob []byte, err error) {
+	configBlob, err = json.Marshal(OCIConfigFor(img))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal image config: %v", err)
+	}
+
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config: Descriptor{
+			MediaType: MediaTypeOCIConfig,
+			Digest:    DigestOf(configBlob),
+			Size:      int64(len(configBlob)),
+		},
+	}
+	for _, layer := range img.Layers {
+		fi, err := os.Stat(LayerTarPath(layer))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to stat layer %s: %v", layer, err)
+		}
+		manifest.Layers = append(manifest.Layers, Descriptor{
+			MediaType: MediaTypeOCILayer,
+			Digest:    layer,
+			Size:      fi.Size(),
+		})
+	}
+
+	manifestBlob, err = json.Marshal(manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal image manifest: %v", err)
+	}
+
+	return configBlob, manifestBlob, nil
+}
+
+// SaveArchive writes an image as an OCI image-layout tarball to w
+func SaveArchive(ref string, w io.Writer) error {
+	img, err := Lookup(ref)
+	if err != nil {
+		return err
+	}
+
+	configBlob, manifestBlob, err := ManifestFor(img)
+	if err != nil {
+		return err
+	}
+
+	annotations := map[string]string{}
+	if !strings.HasPrefix(ref, "sha256:") {
+		fullRef := NormalizeRef(ref)
+		annotations[AnnotationContainerdRef] = fullRef
+		annotations[AnnotationRefName] = fullRef[strings.LastIndex(fullRef, ":")+1:]
+	}
+
+	index, err := json.Marshal(Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests: []Descriptor{{
+			MediaType:   MediaTypeOCIManifest,
+			Digest:      DigestOf(manifestBlob),
+			Size:        int64(len(manifestBlob)),
+			Annotations: annotations,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal image index: %v", err)
+	}
+
+	layout, _ := json.Marshal(map[string]string{"imageLayoutVersion": ociLayoutVersion})
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: now}); err != nil {
+			return fmt.Errorf("failed to write image archive: %v", err)
+		}
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"oci-layout", layout},
+		{"index.json", index},
+		{blobName(DigestOf(manifestBlob)), manifestBlob},
+		{blobName(DigestOf(configBlob)), configBlob},
+	}
+	for _, file := range files {
+		if err := writeTarFile(tw, file.name, int64(len(file.data)), bytes.NewReader(file.data), now); err != nil {
+			return err
+		}
+	}
+
+	for _, layer := range img.Layers {
+		f, err := os.Open(LayerTarPath(layer))
+		if err != nil {
+			return fmt.Errorf("failed to open layer %s: %v", layer, err)
+		}
+		fi, err := f.Stat()
+		if err == nil {
+			err = writeTarFile(tw, blobName(layer), fi.Size(), f, now)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader, mtime time.Time) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  mtime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+func blobName(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// DigestOf returns the sha256 digest of data
+func DigestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
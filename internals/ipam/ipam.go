@@ -0,0 +1,316 @@
+//go:build linux
+// +build linux
+
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lease is an address handed to a container
+type Lease struct {
+	IP          string
+	ContainerID string
+	// Pid of the container's process, the lease goes stale once it's gone
+	Pid int
+	// PidStart is when that process started, in clock ticks since boot, so
+	// another process reusing the pid doesn't keep the lease alive
+	PidStart  uint64 `json:",omitempty"`
+	Allocated time.Time
+}
+
+// leaseFile is the on-disk form of a pool
+type leaseFile struct {
+	Subnet string
+	// Last is the most recently allocated address, allocation continues
+	// after it so a released address isn't handed out again right away
+	Last   string
+	Leases map[string]Lease
+}
+
+// Pool hands out the addresses of one IPv4 or IPv6 subnet. Leases are kept
+// in a JSON file and every operation holds a flock on it, so concurrent
+// congo processes never give out the same address.
+type Pool struct {
+	Subnet  *net.IPNet
+	Gateway net.IP
+	path    string
+	prefix  netip.Prefix
+	gateway netip.Addr
+}
+
+// NewPool returns the pool for subnet whose leases are stored at path
+func NewPool(path, subnet, gateway string) (*Pool, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+	prefix = prefix.Masked()
+	gw, err := netip.ParseAddr(gateway)
+	if err != nil || gw.Zone() != "" || !prefix.Contains(gw.Unmap()) {
+		return nil, fmt.Errorf("gateway %s is not in subnet %s", gateway, subnet)
+	}
+	gw = gw.Unmap()
+	if prefix.Bits() > gw.BitLen()-2 {
+		return nil, fmt.Errorf("subnet %s is too small", subnet)
+	}
+	return &Pool{
+		Subnet:  &net.IPNet{IP: prefix.Addr().AsSlice(), Mask: net.CIDRMask(prefix.Bits(), gw.BitLen())},
+		Gateway: gw.AsSlice(),
+		path:    path,
+		prefix:  prefix,
+		gateway: gw,
+	}, nil
+}
+
+// IPv6 reports whether the pool hands out IPv6 addresses
+func (p *Pool) IPv6() bool {
+	return p.prefix.Addr().Is6()
+}
+
+// Allocate leases an address to a container: requested if given, otherwise
+// the next free one. A container holds at most one lease per pool, an older
+// one is replaced. Leases of dead containers are dropped first.
+func (p *Pool) Allocate(containerID string, pid int, requested net.IP) (net.IP, error) {
+	var ip net.IP
+	err := p.update(func(f *leaseFile) error {
+		reconcile(f)
+		for addr, lease := range f.Leases {
+			if lease.ContainerID == containerID {
+				delete(f.Leases, addr)
+			}
+		}
+
+		if requested != nil {
+			if err := p.checkRequested(requested); err != nil {
+				return err
+			}
+			if lease, ok := f.Leases[toAddr(requested).String()]; ok {
+				return fmt.Errorf("address %s is already in use by container %s", requested, lease.ContainerID)
+			}
+			ip = addrIP(toAddr(requested))
+		} else {
+			var err error
+			if ip, err = p.nextFree(f); err != nil {
+				return err
+			}
+		}
+
+		f.Leases[ip.String()] = Lease{
+			IP:          ip.String(),
+			ContainerID: containerID,
+			Pid:         pid,
+			PidStart:    processStart(pid),
+			Allocated:   time.Now(),
+		}
+		f.Last = ip.String()
+		return nil
+	})
+	return ip, err
+}
+
+// Release gives back whatever a container leased, releasing twice is fine
+func (p *Pool) Release(containerID string) error {
+	return p.update(func(f *leaseFile) error {
+		for addr, lease := range f.Leases {
+			if lease.ContainerID == containerID {
+				delete(f.Leases, addr)
+			}
+		}
+		return nil
+	})
+}
+
+// Reconcile drops the leases of containers whose process is gone and
+// returns them
+func (p *Pool) Reconcile() ([]Lease, error) {
+	var removed []Lease
+	err := p.update(func(f *leaseFile) error {
+		removed = reconcile(f)
+		return nil
+	})
+	return removed, err
+}
+
+// Leases returns the current leases sorted by address
+func (p *Pool) Leases() ([]Lease, error) {
+	var leases []Lease
+	err := p.update(func(f *leaseFile) error {
+		for _, lease := range f.Leases {
+			leases = append(leases, lease)
+		}
+		return nil
+	})
+	sort.Slice(leases, func(i, j int) bool {
+		return toAddr(net.ParseIP(leases[i].IP)).Less(toAddr(net.ParseIP(leases[j].IP)))
+	})
+	return leases, err
+}
+
+func (p *Pool) checkRequested(ip net.IP) error {
+	addr := toAddr(ip)
+	if !addr.IsValid() || !p.prefix.Contains(addr) {
+		return fmt.Errorf("address %s is not in subnet %s", ip, p.Subnet)
+	}
+	if addr == p.gateway {
+		return fmt.Errorf("address %s is the gateway of subnet %s", ip, p.Subnet)
+	}
+	first, last := p.hostRange()
+	if addr.Less(first) || last.Less(addr) {
+		return fmt.Errorf("address %s is reserved in subnet %s", ip, p.Subnet)
+	}
+	return nil
+}
+
+// nextFree finds the first unleased address after the last one allocated,
+// wrapping around at the end of the subnet. Only the gateway and leased
+// addresses are skipped, so one more candidate than those is enough, even
+// in an IPv6 subnet too large to walk.
+func (p *Pool) nextFree(f *leaseFile) (net.IP, error) {
+	first, last := p.hostRange()
+	start := first
+	if prev := toAddr(net.ParseIP(f.Last)); prev.IsValid() && p.prefix.Contains(prev) && prev.Less(last) && !prev.Less(first) {
+		start = prev.Next()
+	}
+
+	addr := start
+	for i := 0; i < len(f.Leases)+2; i++ {
+		if _, ok := f.Leases[addr.String()]; !ok && addr != p.gateway {
+			return addrIP(addr), nil
+		}
+		if addr = addr.Next(); last.Less(addr) {
+			addr = first
+		}
+		if addr == start {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no free addresses left in subnet %s", p.Subnet)
+}
+
+// hostRange is the first and last usable address, leaving out the network
+// address and, in IPv4 subnets, the broadcast address
+func (p *Pool) hostRange() (netip.Addr, netip.Addr) {
+	network := p.prefix.Addr()
+	b := network.AsSlice()
+	for bit := p.prefix.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(b)
+	if network.Is4() {
+		last = last.Prev()
+	}
+	return network.Next(), last
+}
+
+// update runs fn on the lease file under an exclusive lock and writes the
+// result back
+func (p *Pool) update(fn func(*leaseFile) error) error {
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return fmt.Errorf("failed to create IPAM directory: %v", err)
+	}
+	lock, err := os.OpenFile(p.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open IPAM lock: %v", err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock IPAM leases: %v", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	f := &leaseFile{Subnet: p.Subnet.String(), Leases: make(map[string]Lease)}
+	data, err := os.ReadFile(p.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read IPAM leases: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, f); err != nil {
+			return fmt.Errorf("failed to parse IPAM leases %s: %v", p.path, err)
+		}
+		if f.Leases == nil {
+			f.Leases = make(map[string]Lease)
+		}
+	}
+
+	if err := fn(f); err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal IPAM leases: %v", err)
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write IPAM leases: %v", err)
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// reconcile drops leases whose container process no longer exists
+func reconcile(f *leaseFile) []Lease {
+	var removed []Lease
+	for addr, lease := range f.Leases {
+		if lease.Pid <= 0 {
+			continue
+		}
+		gone := syscall.Kill(lease.Pid, 0) == syscall.ESRCH
+		// Leases from before PidStart was recorded only have the pid
+		if !gone && lease.PidStart != 0 {
+			gone = processStart(lease.Pid) != lease.PidStart
+		}
+		if gone {
+			delete(f.Leases, addr)
+			removed = append(removed, lease)
+		}
+	}
+	return removed
+}
+
+// processStart returns the start time of a process from /proc/<pid>/stat,
+// 0 if it can't be read
+func processStart(pid int) uint64 {
+	if pid <= 0 {
+		return 0
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name may contain spaces, the fields after it don't;
+	// starttime is the 22nd field, the 20th after the name
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return 0
+	}
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+	return start
+}
+
+// toAddr converts an address, IPv4 ones in their 16-byte form included,
+// the zero Addr is returned for nil
+func toAddr(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+func addrIP(addr netip.Addr) net.IP {
+	return net.IP(addr.AsSlice())
+}
@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+// Package netlink encodes and decodes the attributes shared by the netlink
+// families congo talks to, rtnetlink in network and nfnetlink in firewall
+package netlink
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Attr is a netlink attribute, either holding data or nested attributes
+type Attr struct {
+	Type     uint16
+	Data     []byte
+	Children []Attr
+}
+
+// Serialize encodes the attribute and its children, padded to alignment
+func (a Attr) Serialize() []byte {
+	payload := append([]byte(nil), a.Data...)
+	for _, child := range a.Children {
+		payload = append(payload, child.Serialize()...)
+	}
+	length := unix.SizeofNlAttr + len(payload)
+	b := make([]byte, Align(length))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(b[2:4], a.Type)
+	copy(b[unix.SizeofNlAttr:], payload)
+	return b
+}
+
+// StringAttr is a NUL terminated string attribute
+func StringAttr(typ uint16, s string) Attr {
+	return Attr{Type: typ, Data: append([]byte(s), 0)}
+}
+
+// Uint32Attr is a number attribute in host byte order
+func Uint32Attr(typ uint16, v uint32) Attr {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return Attr{Type: typ, Data: b}
+}
+
+// NestedAttr holds children, flagged as nested
+func NestedAttr(typ uint16, children ...Attr) Attr {
+	return Attr{Type: typ | unix.NLA_F_NESTED, Children: children}
+}
+
+// Align rounds n up to the netlink alignment
+func Align(n int) int {
+	return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+}
+
+// ParseAttrs splits a buffer of attributes by type, nested ones are left
+// for the caller to parse
+func ParseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofNlAttr {
+		length := int(binary.NativeEndian.Uint16(b[0:2]))
+		typ := binary.NativeEndian.Uint16(b[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if length < unix.SizeofNlAttr || length > len(b) {
+			break
+		}
+		attrs[typ] = b[unix.SizeofNlAttr:length]
+		if Align(length) > len(b) {
+			break
+		}
+		b = b[Align(length):]
+	}
+	return attrs
+}
+
+// AttrString decodes a NUL terminated string attribute
+func AttrString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// Errno returns the errno of a failed socket call, EINVAL for other errors
+func Errno(err error) syscall.Errno {
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+	return unix.EINVAL
+}
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// NetlinkError is an rtnetlink request the kernel refused, errors.Is works
+// against the errno (e.g. unix.EEXIST, unix.EPERM)
+type NetlinkError struct {
+	Op  string
+	Err syscall.Errno
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("netlink %s: %v", e.Op, e.Err)
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Err
+}
+
+// LinkNotFoundError is returned for an interface that doesn't exist
+type LinkNotFoundError struct {
+	Name string
+}
+
+func (e *LinkNotFoundError) Error() string {
+	return fmt.Sprintf("network interface %s not found", e.Name)
+}
+
+// IsNotFound reports whether err means an interface doesn't exist
+func IsNotFound(err error) bool {
+	var notFound *LinkNotFoundError
+	return errors.As(err, &notFound) || errors.Is(err, syscall.ENODEV)
+}
+
+// IsExist reports whether err means what was being created already exists
+func IsExist(err error) bool {
+	return errors.Is(err, syscall.EEXIST)
+}
@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// HelperReady is what a helper prints once it serves
+const HelperReady = "ready"
+
+// StartHelper runs a long-lived congo command, e.g. `congo proxy ...`, in
+// its own session and waits until it's ready. Helpers report readiness or
+// their error on stdout, then close it.
+func StartHelper(args ...string) (int, error) {
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start %s: %v", args[0], err)
+	}
+
+	line, _ := bufio.NewReader(out).ReadString('\n')
+	if line = strings.TrimSpace(line); line != HelperReady {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if line == "" {
+			line = args[0] + " exited"
+		}
+		return 0, fmt.Errorf("%s", line)
+	}
+	pid := cmd.Process.Pid
+	// The helper outlives this process, nobody waits for it here
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// HelperRunning reports whether pid is still the helper started with args,
+// or with arguments starting with them
+func HelperRunning(pid int, args ...string) bool {
+	if pid <= 0 {
+		return false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	running := bytes.Split(cmdline, []byte{0})
+	if len(running) < len(args)+1 {
+		return false
+	}
+	for i, arg := range args {
+		if string(running[i+1]) != arg {
+			return false
+		}
+	}
+	return true
+}
+
+// StopHelper terminates a helper, unless its pid was reused by something
+// else
+func StopHelper(pid int, args ...string) {
+	if HelperRunning(pid, args...) {
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+}
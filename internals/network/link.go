@@ -0,0 +1,277 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/netlink"
+)
+
+// Link is a network interface as rtnetlink reports it
+type Link struct {
+	Index        int
+	Name         string
+	Kind         string // "bridge", "veth", ... empty for physical devices
+	MasterIndex  int
+	MTU          int
+	Up           bool
+	HardwareAddr net.HardwareAddr
+}
+
+// LinkByName looks up an interface in the current network namespace,
+// returning a *LinkNotFoundError when there is none
+func LinkByName(name string) (*Link, error) {
+	replies, err := nlRequest("get link "+name, unix.RTM_GETLINK, 0,
+		ifInfomsg(unix.AF_UNSPEC, 0, 0, 0),
+		netlink.StringAttr(unix.IFLA_IFNAME, name))
+	if IsNotFound(err) {
+		return nil, &LinkNotFoundError{Name: name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) == 0 {
+		return nil, &LinkNotFoundError{Name: name}
+	}
+	return parseLink(replies[0]), nil
+}
+
+// Links lists every interface in the current network namespace
+func Links() ([]*Link, error) {
+	replies, err := nlRequest("list links", unix.RTM_GETLINK, unix.NLM_F_DUMP,
+		ifInfomsg(unix.AF_UNSPEC, 0, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+	links := make([]*Link, 0, len(replies))
+	for _, reply := range replies {
+		if len(reply) >= unix.SizeofIfInfomsg {
+			links = append(links, parseLink(reply))
+		}
+	}
+	return links, nil
+}
+
+func parseLink(b []byte) *Link {
+	link := &Link{
+		Index: int(int32(binary.NativeEndian.Uint32(b[4:8]))),
+		Up:    binary.NativeEndian.Uint32(b[8:12])&unix.IFF_UP != 0,
+	}
+	attrs := netlink.ParseAttrs(b[unix.SizeofIfInfomsg:])
+	link.Name = netlink.AttrString(attrs[unix.IFLA_IFNAME])
+	if v := attrs[unix.IFLA_MASTER]; len(v) == 4 {
+		link.MasterIndex = int(binary.NativeEndian.Uint32(v))
+	}
+	if v := attrs[unix.IFLA_MTU]; len(v) == 4 {
+		link.MTU = int(binary.NativeEndian.Uint32(v))
+	}
+	if v := attrs[unix.IFLA_ADDRESS]; len(v) > 0 {
+		link.HardwareAddr = net.HardwareAddr(append([]byte(nil), v...))
+	}
+	if info, ok := attrs[unix.IFLA_LINKINFO]; ok {
+		link.Kind = netlink.AttrString(netlink.ParseAttrs(info)[unix.IFLA_INFO_KIND])
+	}
+	return link
+}
+
+// AddBridge creates a bridge, an existing bridge of that name is kept
+func AddBridge(name string) error {
+	_, err := nlRequest("add bridge "+name, unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL,
+		ifInfomsg(unix.AF_UNSPEC, 0, 0, 0),
+		netlink.StringAttr(unix.IFLA_IFNAME, name),
+		netlink.Attr{Type: unix.IFLA_LINKINFO, Children: []netlink.Attr{
+			netlink.StringAttr(unix.IFLA_INFO_KIND, "bridge"),
+		}})
+	if IsExist(err) {
+		link, lerr := LinkByName(name)
+		if lerr == nil && link.Kind == "bridge" {
+			return nil
+		}
+	}
+	return err
+}
+
+// AddVethPair creates a veth pair. Leftovers of a pair with the same name,
+// e.g. from a container that died with a pid now reused, are replaced.
+func AddVethPair(name, peer string) error {
+	for _, leftover := range []string{name, peer} {
+		if err := DeleteLink(leftover); err != nil {
+			return err
+		}
+	}
+
+	peerInfo := netlink.Attr{Type: vethInfoPeer, Data: ifInfomsg(unix.AF_UNSPEC, 0, 0, 0), Children: []netlink.Attr{
+		netlink.StringAttr(unix.IFLA_IFNAME, peer),
+	}}
+	_, err := nlRequest("add veth "+name, unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL,
+		ifInfomsg(unix.AF_UNSPEC, 0, 0, 0),
+		netlink.StringAttr(unix.IFLA_IFNAME, name),
+		netlink.Attr{Type: unix.IFLA_LINKINFO, Children: []netlink.Attr{
+			netlink.StringAttr(unix.IFLA_INFO_KIND, "veth"),
+			{Type: unix.IFLA_INFO_DATA, Children: []netlink.Attr{peerInfo}},
+		}})
+	return err
+}
+
+// DeleteLink removes an interface, one that doesn't exist is not an error
+func DeleteLink(name string) error {
+	link, err := LinkByName(name)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = nlRequest("delete link "+name, unix.RTM_DELLINK, 0,
+		ifInfomsg(unix.AF_UNSPEC, int32(link.Index), 0, 0))
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// SetLinkUp brings an interface up
+func SetLinkUp(name string) error {
+	return setLink(name, "set up "+name, unix.IFF_UP, unix.IFF_UP)
+}
+
+// SetLinkMaster enslaves an interface to a bridge
+func SetLinkMaster(name, master string) error {
+	m, err := LinkByName(master)
+	if err != nil {
+		return err
+	}
+	return setLink(name, "set master of "+name, 0, 0, netlink.Uint32Attr(unix.IFLA_MASTER, uint32(m.Index)))
+}
+
+// SetLinkNsPid moves an interface into the network namespace of a process
+func SetLinkNsPid(name string, pid int) error {
+	return setLink(name, "move "+name+" to netns", 0, 0, netlink.Uint32Attr(unix.IFLA_NET_NS_PID, uint32(pid)))
+}
+
+// RenameLink renames an interface, it has to be down
+func RenameLink(name, newName string) error {
+	return setLink(name, "rename "+name, 0, 0, netlink.StringAttr(unix.IFLA_IFNAME, newName))
+}
+
+func setLink(name, op string, flags, change uint32, attrs ...netlink.Attr) error {
+	link, err := LinkByName(name)
+	if err != nil {
+		return err
+	}
+	_, err = nlRequest(op, unix.RTM_NEWLINK, 0,
+		ifInfomsg(unix.AF_UNSPEC, int32(link.Index), flags, change), attrs...)
+	return err
+}
+
+// AddAddress assigns an IPv4 or IPv6 address to an interface, assigning an
+// address the interface already has is not an error. IPv6 addresses skip
+// duplicate address detection, so they can be used right away.
+func AddAddress(name string, addr *net.IPNet) error {
+	link, err := LinkByName(name)
+	if err != nil {
+		return err
+	}
+	op := "add address " + addr.String() + " to " + name
+	ones, _ := addr.Mask.Size()
+	if ip := addr.IP.To4(); ip != nil {
+		_, err = nlRequest(op, unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL,
+			ifAddrmsg(unix.AF_INET, uint8(ones), unix.RT_SCOPE_UNIVERSE, link.Index),
+			netlink.Attr{Type: unix.IFA_LOCAL, Data: ip},
+			netlink.Attr{Type: unix.IFA_ADDRESS, Data: ip},
+			netlink.Attr{Type: unix.IFA_BROADCAST, Data: broadcast(addr)})
+	} else if ip := addr.IP.To16(); ip != nil {
+		msg := ifAddrmsg(unix.AF_INET6, uint8(ones), unix.RT_SCOPE_UNIVERSE, link.Index)
+		msg[2] = unix.IFA_F_NODAD
+		_, err = nlRequest(op, unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg,
+			netlink.Attr{Type: unix.IFA_ADDRESS, Data: ip})
+	} else {
+		return &NetlinkError{Op: op, Err: unix.EAFNOSUPPORT}
+	}
+	if IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Addresses lists the IPv4 addresses of an interface
+func Addresses(name string) ([]*net.IPNet, error) {
+	link, err := LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := nlRequest("list addresses of "+name, unix.RTM_GETADDR, unix.NLM_F_DUMP,
+		ifAddrmsg(unix.AF_INET, 0, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []*net.IPNet
+	for _, reply := range replies {
+		if len(reply) < unix.SizeofIfAddrmsg || int(binary.NativeEndian.Uint32(reply[4:8])) != link.Index {
+			continue
+		}
+		attrs := netlink.ParseAttrs(reply[unix.SizeofIfAddrmsg:])
+		ip := attrs[unix.IFA_LOCAL]
+		if ip == nil {
+			ip = attrs[unix.IFA_ADDRESS]
+		}
+		if len(ip) != net.IPv4len {
+			continue
+		}
+		addrs = append(addrs, &net.IPNet{
+			IP:   net.IP(append([]byte(nil), ip...)),
+			Mask: net.CIDRMask(int(reply[1]), 32),
+		})
+	}
+	return addrs, nil
+}
+
+// AddDefaultRoute routes everything not on a local subnet through gateway,
+// in the gateway's family. An existing default route is left alone.
+func AddDefaultRoute(gateway net.IP, name string) error {
+	link, err := LinkByName(name)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, unix.SizeofRtMsg)
+	msg[0] = unix.AF_INET
+	gw := gateway.To4()
+	if gw == nil {
+		msg[0], gw = unix.AF_INET6, gateway.To16()
+	}
+	msg[4] = unix.RT_TABLE_MAIN
+	msg[5] = unix.RTPROT_BOOT
+	msg[6] = unix.RT_SCOPE_UNIVERSE
+	msg[7] = unix.RTN_UNICAST
+	_, err = nlRequest("add default route via "+gateway.String(), unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg,
+		netlink.Attr{Type: unix.RTA_GATEWAY, Data: gw},
+		netlink.Uint32Attr(unix.RTA_OIF, uint32(link.Index)))
+	if IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+func ifAddrmsg(family, prefixLen, scope uint8, index int) []byte {
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = prefixLen
+	b[3] = scope
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	return b
+}
+
+func broadcast(addr *net.IPNet) net.IP {
+	ip := addr.IP.To4()
+	brd := make(net.IP, net.IPv4len)
+	for i := range brd {
+		brd[i] = ip[i] | ^addr.Mask[len(addr.Mask)-net.IPv4len+i]
+	}
+	return brd
+}
@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/netlink"
+)
+
+// vethInfoPeer is VETH_INFO_PEER from linux/veth.h, missing from x/sys/unix
+const vethInfoPeer = 1
+
+var nlSeq uint32
+
+func ifInfomsg(family uint8, index int32, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = family
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+// nlRequest sends one rtnetlink request and collects the payloads of the
+// replies. Requests are acknowledged, a refusal comes back as a
+// *NetlinkError wrapping the errno.
+func nlRequest(op string, msgType uint16, flags uint16, body []byte, attrs ...netlink.Attr) ([][]byte, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, &NetlinkError{Op: op, Err: netlink.Errno(err)}
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, &NetlinkError{Op: op, Err: netlink.Errno(err)}
+	}
+
+	for _, attr := range attrs {
+		body = append(body, attr.Serialize()...)
+	}
+	dump := flags&unix.NLM_F_DUMP == unix.NLM_F_DUMP
+	if !dump {
+		flags |= unix.NLM_F_ACK
+	}
+	seq := atomic.AddUint32(&nlSeq, 1)
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	msg = append(msg, body...)
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, &NetlinkError{Op: op, Err: netlink.Errno(err)}
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, &NetlinkError{Op: op, Err: netlink.Errno(err)}
+		}
+		b := buf[:n]
+		for len(b) >= unix.SizeofNlMsghdr {
+			length := int(binary.NativeEndian.Uint32(b[0:4]))
+			typ := binary.NativeEndian.Uint16(b[4:6])
+			if length < unix.SizeofNlMsghdr || length > len(b) {
+				return nil, &NetlinkError{Op: op, Err: unix.EBADMSG}
+			}
+			data := b[unix.SizeofNlMsghdr:length]
+			if netlink.Align(length) >= len(b) {
+				b = nil
+			} else {
+				b = b[netlink.Align(length):]
+			}
+
+			switch typ {
+			case unix.NLMSG_DONE:
+				return replies, nil
+			case unix.NLMSG_ERROR:
+				if len(data) < 4 {
+					return nil, &NetlinkError{Op: op, Err: unix.EBADMSG}
+				}
+				if errno := -int32(binary.NativeEndian.Uint32(data[0:4])); errno != 0 {
+					return nil, &NetlinkError{Op: op, Err: syscall.Errno(errno)}
+				}
+				if !dump {
+					return replies, nil
+				}
+			default:
+				replies = append(replies, append([]byte(nil), data...))
+			}
+		}
+	}
+}
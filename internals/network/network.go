@@ -1,127 +1,304 @@
 //go:build linux
 // +build linux
 
-package network 
+package network
 
 import (
+    "encoding/json"
+    "errors"
     "fmt"
+    "io"
+    "log"
     "net"
     "os"
-    "os/exec"
-    "strconv"
     "strings"
-    
+
+    "congo/internals/firewall"
     "congo/internals/types"
 )
 
+// Network modes accepted by --network
+const (
+    ModeBridge = "bridge"
+    ModeNone   = "none"
+    ModeHost   = "host"
+    // ModeContainer prefixes container:<id>, the network namespace of
+    // another container
+    ModeContainer = "container:"
+)
 
-func setupNetworking(config *types.Config) error {
-    // Create bridge if it doesn't exist
-    if err := createBridge(config.Network.Bridge); err != nil {
-        return fmt.Errorf("failed to create bridge: %v", err)
-    }
+// ContainerInterface is the name the container sees its veth under
+const ContainerInterface = "eth0"
 
-    // Create veth pair
-    containerVeth := fmt.Sprintf("veth%d", os.Getpid())
-    hostVeth := fmt.Sprintf("hveth%d", os.Getpid())
+// SyncFd is the descriptor the child reads its network attachment from,
+// the first of exec.Cmd.ExtraFiles
+const SyncFd = 3
 
-    if err := createVethPair(containerVeth, hostVeth); err != nil {
-        return fmt.Errorf("failed to create veth pair: %v", err)
-    }
+// Attachment tells the child how to configure the interface the parent
+// moved into its network namespace
+type Attachment struct {
+    Interface string
+    // Addresses in CIDR notation, e.g. 172.20.0.5/16 and, on dual-stack
+    // networks, fd3c:9a1e:22b0::5/64. IPv6-only networks have no IPv4
+    // address and Gateway.
+    Addresses   []string
+    Gateway     string `json:",omitempty"`
+    IPv6Gateway string `json:",omitempty"`
+}
 
-    // Connect host veth to bridge
-    if err := connectToBridge(hostVeth, config.Network.Bridge); err != nil {
-        return fmt.Errorf("failed to connect to bridge: %v", err)
+// VethNames returns the host and container ends of a container's n-th veth
+// pair, n counts from 0 for the pair of its first network
+func VethNames(pid, n int) (string, string) {
+    if n == 0 {
+        return fmt.Sprintf("hveth%d", pid), fmt.Sprintf("veth%d", pid)
     }
+    return fmt.Sprintf("hveth%dn%d", pid, n), fmt.Sprintf("veth%dn%d", pid, n)
+}
 
-    // Setup container network namespace
-    if err := setupContainerNetNS(containerVeth, config.Network.ContainerIP); err != nil {
-        return fmt.Errorf("failed to setup container network namespace: %v", err)
-    }
+// SetupNetworking wires the container with the given pid into its network
+// from the host side and hands the attachment to the child through sync,
+// which is closed afterwards. On failure nothing is written, the child sees
+// EOF and gives up. Every mode but none, host and container:<id> names a
+// bridge network, netConfig carries its bridge, subnets and gateways and
+// the addresses leased to the container.
+func SetupNetworking(pid int, netConfig *types.NetworkConfig, sync io.WriteCloser) error {
+    defer sync.Close()
 
-    // Setup port forwarding
-    if err := setupPortForwarding(config.Network.PortMaps, config.Network.ContainerIP); err != nil {
-        return fmt.Errorf("failed to setup port forwarding: %v", err)
+    var attachment Attachment
+    if netConfig.Mode != ModeNone && !sharedNetwork(netConfig.Mode) {
+        var err error
+        if attachment, err = setupBridgeNetwork(pid, netConfig); err != nil {
+            return err
+        }
     }
 
+    if err := json.NewEncoder(sync).Encode(attachment); err != nil {
+        return fmt.Errorf("failed to send network attachment to container: %v", err)
+    }
     return nil
 }
 
-func createBridge(name string) error {
-    // Check if bridge exists
-    if _, err := net.InterfaceByName(name); err == nil {
-        return nil // Bridge already exists
+func setupBridgeNetwork(pid int, netConfig *types.NetworkConfig) (Attachment, error) {
+    n := &Network{
+        Name:        netConfig.Mode,
+        Bridge:      netConfig.Bridge,
+        Subnet:      netConfig.Subnet,
+        Gateway:     netConfig.Gateway,
+        IPv6Subnet:  netConfig.IPv6Subnet,
+        IPv6Gateway: netConfig.IPv6Gateway,
+        IPv6Mode:    netConfig.IPv6Mode,
+    }
+    if n.Subnet == "" && n.IPv6Subnet == "" {
+        n.Subnet, n.Gateway = types.DefaultSubnet, types.DefaultGateway
     }
 
-    // Create bridge using ip command
-    if err := exec.Command("ip", "link", "add", name, "type", "bridge").Run(); err != nil {
-        return err
+    // The addresses come from IPAM, they only have to fit the bridge
+    var ip4, ip6 string
+    for _, ip := range netConfig.ContainerIPs {
+        if strings.Contains(ip, ":") {
+            ip6 = ip
+        } else {
+            ip4 = ip
+        }
+    }
+    addrs, err := interfaceAddresses(n, ip4, ip6)
+    if err != nil {
+        return Attachment{}, err
     }
 
-    // Set bridge up
-    if err := exec.Command("ip", "link", "set", name, "up").Run(); err != nil {
-        return err
+    if err := prepareBridge(n); err != nil {
+        return Attachment{}, err
     }
 
-    return nil
+    // The container end is renamed by the child
+    hostVeth, containerVeth := VethNames(pid, 0)
+    if err := plugVeth(pid, n.Bridge, hostVeth, containerVeth); err != nil {
+        return Attachment{}, err
+    }
+
+    attachment := Attachment{
+        Interface:   containerVeth,
+        Gateway:     n.Gateway,
+        IPv6Gateway: n.IPv6Gateway,
+    }
+    for _, addr := range addrs {
+        attachment.Addresses = append(attachment.Addresses, addr.String())
+    }
+    return attachment, nil
 }
 
-func createVethPair(container, host string) error {
-    // Create veth pair
-    if err := exec.Command("ip", "link", "add", container, "type", "veth", "peer", "name", host).Run(); err != nil {
-        return err
+// prepareBridge makes sure a network's bridge exists with its gateway
+// addresses and firewall rules
+func prepareBridge(n *Network) error {
+    if err := createBridge(n); err != nil {
+        return fmt.Errorf("failed to create bridge: %v", err)
     }
+    // Without NAT containers still reach each other and the host
+    if err := setupFirewall(n.firewallBridge()); err != nil {
+        log.Printf("Warning: failed to set up NAT and network isolation: %v", err)
+    }
+    return nil
+}
 
-    // Set host interface up
-    if err := exec.Command("ip", "link", "set", host, "up").Run(); err != nil {
-        return err
+// plugVeth creates a veth pair, enslaves the host end to the bridge and
+// moves the other end into the network namespace of pid
+func plugVeth(pid int, bridge, hostVeth, containerVeth string) error {
+    if err := AddVethPair(containerVeth, hostVeth); err != nil {
+        return fmt.Errorf("failed to create veth pair: %v", err)
     }
 
+    for _, step := range []func() error{
+        func() error { return SetLinkMaster(hostVeth, bridge) },
+        func() error { return SetLinkUp(hostVeth) },
+        func() error { return SetLinkNsPid(containerVeth, pid) },
+    } {
+        if err := step(); err != nil {
+            DeleteLink(hostVeth)
+            return fmt.Errorf("failed to connect container to bridge: %v", err)
+        }
+    }
     return nil
 }
 
-func connectToBridge(veth, bridge string) error {
-    return exec.Command("ip", "link", "set", veth, "master", bridge).Run()
+// sharedNetwork reports whether a mode joins a network namespace that's
+// already set up
+func sharedNetwork(mode string) bool {
+    return mode == ModeHost || strings.HasPrefix(mode, ModeContainer)
 }
 
-func setupContainerNetNS(veth, ip string) error {
-    // Move veth to container namespace
-    if err := exec.Command("ip", "link", "set", veth, "netns", strconv.Itoa(os.Getpid())).Run(); err != nil {
-        return err
+// ConfigureContainer runs in the child before the rootfs is set up: it
+// waits for the parent's attachment on SyncFd and brings up the interfaces
+// in the container's network namespace
+func ConfigureContainer(config *types.Config) error {
+    sync := os.NewFile(SyncFd, "sync")
+    if sync == nil {
+        return fmt.Errorf("missing network sync pipe")
+    }
+    defer sync.Close()
+
+    var attachment Attachment
+    if err := json.NewDecoder(sync).Decode(&attachment); err != nil {
+        return fmt.Errorf("failed to receive network attachment: %v", err)
+    }
+
+    // The host's or another container's network is used as it is
+    if sharedNetwork(config.Network.Mode) {
+        return nil
     }
 
     // Setup loopback interface
-    if err := exec.Command("ip", "link", "set", "lo", "up").Run(); err != nil {
-        return err
+    if err := SetLinkUp("lo"); err != nil {
+        return fmt.Errorf("failed to bring up loopback: %v", err)
+    }
+    if attachment.Interface == "" {
+        return nil
     }
 
-    // Setup container veth
-    if err := exec.Command("ip", "link", "set", veth, "up").Run(); err != nil {
+    if err := RenameLink(attachment.Interface, ContainerInterface); err != nil {
+        return err
+    }
+    if attachment.IPv6Gateway != "" {
+        // The kernel adds the link-local address when the link comes up
+        if err := enableIPv6(ContainerInterface); err != nil {
+            return err
+        }
+    }
+    for _, address := range attachment.Addresses {
+        ip, subnet, err := net.ParseCIDR(address)
+        if err != nil {
+            return fmt.Errorf("invalid container address %s: %v", address, err)
+        }
+        if err := AddAddress(ContainerInterface, &net.IPNet{IP: ip, Mask: subnet.Mask}); err != nil {
+            return err
+        }
+    }
+    if err := SetLinkUp(ContainerInterface); err != nil {
         return err
     }
+    for _, gateway := range []string{attachment.Gateway, attachment.IPv6Gateway} {
+        if gateway == "" {
+            continue
+        }
+        if err := AddDefaultRoute(net.ParseIP(gateway), ContainerInterface); err != nil {
+            return err
+        }
+    }
+    return nil
+}
 
-    // Assign IP to container veth
-    if err := exec.Command("ip", "addr", "add", ip, "dev", veth).Run(); err != nil {
+func createBridge(n *Network) error {
+    // Create bridge if it doesn't exist
+    if err := AddBridge(n.Bridge); err != nil {
         return err
     }
 
+    // The bridge is the containers' gateway
+    var gateways []struct{ subnet, gateway string }
+    if n.Subnet != "" {
+        gateways = append(gateways, struct{ subnet, gateway string }{n.Subnet, n.Gateway})
+    }
+    if n.IPv6Subnet != "" {
+        if err := enableIPv6(n.Bridge); err != nil {
+            return err
+        }
+        gateways = append(gateways, struct{ subnet, gateway string }{n.IPv6Subnet, n.IPv6Gateway})
+    }
+    for _, gw := range gateways {
+        _, subnet, err := net.ParseCIDR(gw.subnet)
+        if err != nil {
+            return err
+        }
+        if err := AddAddress(n.Bridge, &net.IPNet{IP: net.ParseIP(gw.gateway), Mask: subnet.Mask}); err != nil {
+            return err
+        }
+    }
+
+    // Set bridge up
+    return SetLinkUp(n.Bridge)
+}
+
+// enableIPv6 turns IPv6 on for an interface, hosts may disable it for new
+// ones
+func enableIPv6(name string) error {
+    path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", name)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("IPv6 is not available on %s: %v", name, err)
+    }
+    if strings.TrimSpace(string(data)) == "0" {
+        return nil
+    }
+    if err := os.WriteFile(path, []byte("0"), 0644); err != nil {
+        return fmt.Errorf("failed to enable IPv6 on %s: %v", name, err)
+    }
     return nil
 }
 
-func setupPortForwarding(portMaps []types.PortMapping, containerIP string) error {
-    for _, port := range portMaps {
-        // Add iptables DNAT rule for port forwarding
-        rule := fmt.Sprintf(
-            "-t nat -A PREROUTING -p %s --dport %d -j DNAT --to-destination %s:%d",
-            port.Protocol,
-            port.HostPort,
-            containerIP,
-            port.ContainerPort,
-        )
-        
-        if err := exec.Command("iptables", strings.Split(rule, " ")...).Run(); err != nil {
-            return fmt.Errorf("failed to add port forwarding rule: %v", err)
+// setupFirewall lets containers on the bridge reach the outside through the
+// host but not containers on other congo networks
+func setupFirewall(b firewall.Bridge) error {
+    if b.Subnet != "" {
+        if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+            return fmt.Errorf("failed to enable IP forwarding: %v", err)
+        }
+        // Published ports DNAT connections to localhost, those are only
+        // routed onto the bridge with route_localnet
+        routeLocalnet := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", b.Name)
+        if err := os.WriteFile(routeLocalnet, []byte("1"), 0644); err != nil {
+            return fmt.Errorf("failed to enable route_localnet: %v", err)
         }
     }
-    return nil
+    if b.IPv6Subnet != "" {
+        if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644); err != nil {
+            return fmt.Errorf("failed to enable IPv6 forwarding: %v", err)
+        }
+    }
+
+    fw, err := firewall.New()
+    if errors.Is(err, firewall.ErrDisabled) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    return fw.SetupBridge(b)
 }
@@ -0,0 +1,264 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/firewall"
+	"congo/internals/types"
+)
+
+// Network drivers, every user-defined network is a bridge
+const (
+	DriverBridge = "bridge"
+	DriverHost   = "host"
+	DriverNull   = "null"
+)
+
+// BridgePrefix starts the interface name of a user-defined network's bridge,
+// congo+ in iptables matches these and the default bridge
+const BridgePrefix = "congo-"
+
+// IPv6 modes of a dual-stack network: containers reach outside networks
+// through NAT66 like over IPv4, or with their own addresses when the subnet
+// is routed to the host
+const (
+	IPv6NAT    = "nat"
+	IPv6Routed = "routed"
+)
+
+// EnvBridgeIPv6 gives the built-in bridge network an IPv6 subnet, e.g.
+// fd00:172:20::/64, its containers reach outside networks through NAT66
+const EnvBridgeIPv6 = "CONGO_BRIDGE_IPV6"
+
+// Network is what containers get attached to: one of the built-in bridge,
+// host and none networks or one made with `congo network create`. Bridge
+// networks made with --ipv6 are dual-stack, those made with --ipv4=false
+// have no IPv4 subnet.
+type Network struct {
+	ID          string
+	Name        string
+	Driver      string
+	Bridge      string `json:",omitempty"`
+	Subnet      string `json:",omitempty"`
+	Gateway     string `json:",omitempty"`
+	IPv6Subnet  string `json:",omitempty"`
+	IPv6Gateway string `json:",omitempty"`
+	IPv6Mode    string `json:",omitempty"`
+	Labels      map[string]string
+	Created     time.Time
+}
+
+// firewallBridge describes the bridge of n to the firewall
+func (n *Network) firewallBridge() firewall.Bridge {
+	return firewall.Bridge{
+		Name:       n.Bridge,
+		Subnet:     n.Subnet,
+		IPv6Subnet: n.IPv6Subnet,
+		IPv6Routed: n.IPv6Mode == IPv6Routed,
+	}
+}
+
+// BuiltinNetworks returns the networks that always exist, one per mode.
+// The bridge network is dual-stack when $CONGO_BRIDGE_IPV6 is set.
+func BuiltinNetworks() []*Network {
+	bridge := &Network{
+		ID:      builtinID(ModeBridge),
+		Name:    ModeBridge,
+		Driver:  DriverBridge,
+		Bridge:  types.DefaultBridgeName,
+		Subnet:  types.DefaultSubnet,
+		Gateway: types.DefaultGateway,
+	}
+	if subnet := os.Getenv(EnvBridgeIPv6); subnet != "" {
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			log.Printf("Warning: ignoring $%s, %s is not an IPv6 subnet", EnvBridgeIPv6, subnet)
+		} else {
+			prefix = prefix.Masked()
+			bridge.IPv6Subnet = prefix.String()
+			bridge.IPv6Gateway = prefix.Addr().Next().String()
+			bridge.IPv6Mode = IPv6NAT
+		}
+	}
+	return []*Network{
+		bridge,
+		{ID: builtinID(ModeHost), Name: ModeHost, Driver: DriverHost},
+		{ID: builtinID(ModeNone), Name: ModeNone, Driver: DriverNull},
+	}
+}
+
+// IsBuiltin reports whether name is one of the built-in networks
+func IsBuiltin(name string) bool {
+	return name == ModeBridge || name == ModeHost || name == ModeNone
+}
+
+// SetRequestedIP puts the address of --ip, which has to be IPv4, or --ip6
+// into a container's requested addresses, replacing one of its family
+func SetRequestedIP(ips []string, flag, value string) ([]string, error) {
+	ip := net.ParseIP(value)
+	ipv6 := flag == "--ip6"
+	if ip == nil || (ip.To4() == nil) != ipv6 {
+		if ipv6 {
+			return ips, fmt.Errorf("invalid IPv6 address: %s", value)
+		}
+		return ips, fmt.Errorf("invalid IPv4 address: %s", value)
+	}
+	var result []string
+	for _, other := range ips {
+		if (net.ParseIP(other).To4() == nil) != ipv6 {
+			result = append(result, other)
+		}
+	}
+	// IPv4 first, as the addresses are leased
+	if ipv6 {
+		return append(result, ip.String()), nil
+	}
+	return append([]string{ip.String()}, result...), nil
+}
+
+// builtinID gives built-in networks an ID that's the same on every host
+func builtinID(name string) string {
+	sum := sha256.Sum256([]byte("congo network " + name))
+	return hex.EncodeToString(sum[:])
+}
+
+// AttachInterface hot-plugs a network into the running container with the
+// given pid: a new veth pair goes from n's bridge into the container, where
+// it shows up as ep.Interface with the addresses ep.IP and ep.IPv6 of the
+// network's families. The default routes are left alone, they stay with the
+// container's first network.
+func AttachInterface(pid int, n *Network, ep *types.Endpoint) error {
+	addrs, err := interfaceAddresses(n, ep.IP, ep.IPv6)
+	if err != nil {
+		return err
+	}
+	if err := prepareBridge(n); err != nil {
+		return err
+	}
+
+	// The container end is renamed once inside, ep.Interface may well
+	// exist on the host
+	containerVeth := strings.TrimPrefix(ep.HostVeth, "h")
+	if err := plugVeth(pid, n.Bridge, ep.HostVeth, containerVeth); err != nil {
+		return err
+	}
+
+	err = InNamespace(pid, func() error {
+		if err := RenameLink(containerVeth, ep.Interface); err != nil {
+			return err
+		}
+		if ep.IPv6 != "" {
+			if err := enableIPv6(ep.Interface); err != nil {
+				return err
+			}
+		}
+		for _, addr := range addrs {
+			if err := AddAddress(ep.Interface, addr); err != nil {
+				return err
+			}
+		}
+		return SetLinkUp(ep.Interface)
+	})
+	if err != nil {
+		DeleteLink(ep.HostVeth)
+		return fmt.Errorf("failed to configure %s in container: %v", ep.Interface, err)
+	}
+	return nil
+}
+
+// interfaceAddresses checks that a container's addresses fit the subnets
+// of n and returns them with their prefix lengths. Each subnet n has needs
+// an address, IPv4 first.
+func interfaceAddresses(n *Network, ip4, ip6 string) ([]*net.IPNet, error) {
+	var subnets []struct{ subnet, ip string }
+	if n.Subnet != "" || ip4 != "" {
+		subnets = append(subnets, struct{ subnet, ip string }{n.Subnet, ip4})
+	}
+	if n.IPv6Subnet != "" || ip6 != "" {
+		subnets = append(subnets, struct{ subnet, ip string }{n.IPv6Subnet, ip6})
+	}
+	var addrs []*net.IPNet
+	for _, s := range subnets {
+		_, subnet, err := net.ParseCIDR(s.subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q of network %s", s.subnet, n.Name)
+		}
+		ip := net.ParseIP(s.ip)
+		if ip == nil || !subnet.Contains(ip) || (ip.To4() == nil) != (subnet.IP.To4() == nil) {
+			return nil, fmt.Errorf("container address %q is not in the subnet %s of network %s", s.ip, subnet, n.Name)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: subnet.Mask})
+	}
+	return addrs, nil
+}
+
+// DetachInterface unplugs an endpoint, removing the host end of a veth pair
+// takes the container end with it
+func DetachInterface(ep *types.Endpoint) error {
+	return DeleteLink(ep.HostVeth)
+}
+
+// RemoveBridge tears down the bridge of a network and its firewall rules
+func RemoveBridge(n *Network) error {
+	if n.Bridge == "" {
+		return nil
+	}
+	// Rules are looked up by bridge, a bridge without any is fine
+	if fw, err := firewall.New(); err == nil {
+		if err := fw.RemoveBridge(n.firewallBridge()); err != nil {
+			log.Printf("Warning: failed to remove firewall rules of %s: %v", n.Bridge, err)
+		}
+	}
+	return DeleteLink(n.Bridge)
+}
+
+// InNamespace runs fn in the network namespace of the process pid. The
+// calling goroutine's thread is switched over and back, netlink sockets
+// opened by fn talk to the container's namespace.
+func InNamespace(pid int, fn func() error) error {
+	runtime.LockOSThread()
+
+	self, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer self.Close()
+	target, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open network namespace of %d: %v", pid, err)
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace of %d: %v", pid, err)
+	}
+	fnErr := fn()
+
+	// A thread stuck in the wrong namespace stays locked, Go throws it
+	// away when the goroutine ends
+	if err := unix.Setns(int(self.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("failed to return to host network namespace: %v", err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
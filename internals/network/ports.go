@@ -0,0 +1,215 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"congo/internals/firewall"
+	"congo/internals/types"
+)
+
+// ParsePortMapping parses a -p value, [hostip:][hostport:]containerport[/tcp|udp].
+// IPv6 host addresses are bracketed, e.g. [::]:8080:80. A missing host port
+// is 0, one is picked when the container starts.
+func ParsePortMapping(spec string) (types.PortMapping, error) {
+	var port types.PortMapping
+	rest, protocol, found := strings.Cut(spec, "/")
+	port.Protocol = "tcp"
+	if found {
+		if protocol != "tcp" && protocol != "udp" {
+			return port, fmt.Errorf("invalid protocol %q in port mapping %s, expected tcp or udp", protocol, spec)
+		}
+		port.Protocol = protocol
+	}
+
+	var parts []string
+	if strings.HasPrefix(rest, "[") {
+		hostIP, ports, ok := strings.Cut(rest[1:], "]:")
+		if ip := net.ParseIP(hostIP); !ok || ip == nil || ip.To4() != nil {
+			return port, fmt.Errorf("invalid host IPv6 address in port mapping %s", spec)
+		}
+		parts = append([]string{hostIP}, strings.Split(ports, ":")...)
+	} else {
+		parts = strings.Split(rest, ":")
+	}
+	var hostPort, containerPort string
+	switch len(parts) {
+	case 1:
+		containerPort = parts[0]
+	case 2:
+		hostPort, containerPort = parts[0], parts[1]
+	case 3:
+		port.HostIP, hostPort, containerPort = parts[0], parts[1], parts[2]
+		if net.ParseIP(port.HostIP) == nil {
+			return port, fmt.Errorf("invalid host address in port mapping %s", spec)
+		}
+	default:
+		return port, fmt.Errorf("invalid port mapping %s", spec)
+	}
+
+	var err error
+	if port.ContainerPort, err = parsePort(containerPort); err != nil || port.ContainerPort == 0 {
+		return port, fmt.Errorf("invalid container port in port mapping %s", spec)
+	}
+	if hostPort != "" {
+		if port.HostPort, err = parsePort(hostPort); err != nil {
+			return port, fmt.Errorf("invalid host port in port mapping %s", spec)
+		}
+	}
+	return port, nil
+}
+
+// FormatPortMapping turns a mapping back into its -p value
+func FormatPortMapping(port types.PortMapping) string {
+	spec := strconv.Itoa(port.ContainerPort) + "/" + port.Protocol
+	hostPort := ""
+	if port.HostPort != 0 {
+		hostPort = strconv.Itoa(port.HostPort)
+	}
+	if strings.Contains(port.HostIP, ":") {
+		return "[" + port.HostIP + "]:" + hostPort + ":" + spec
+	}
+	if port.HostIP != "" {
+		return port.HostIP + ":" + hostPort + ":" + spec
+	}
+	if hostPort != "" {
+		return hostPort + ":" + spec
+	}
+	return spec
+}
+
+func parsePort(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 65535 {
+		return 0, fmt.Errorf("invalid port %s", s)
+	}
+	return n, nil
+}
+
+// FreePort asks the kernel for a port nothing on the host listens on, over
+// IPv4 and IPv6 unless hostIP picks one
+func FreePort(protocol, hostIP string) (int, error) {
+	addr := net.JoinHostPort(hostIP, "0")
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// PublishPorts makes container ports reachable on the host, through DNAT
+// rules of the firewall for connections from outside as well as from the
+// host itself. Where no firewall can be used userspace proxies forward the
+// ports instead, the returned mappings carry their pids. The backend that
+// added rules is returned for UnpublishPorts. Host ports must already be
+// picked.
+func PublishPorts(containerID string, ports []types.PortMapping, containerIPs []string) ([]types.PortMapping, string, error) {
+	if fw, err := firewall.New(); err == nil {
+		err := fw.PublishPorts(containerID, containerIPs, ports)
+		if err == nil {
+			return proxyIPv4(containerID, fw.Name(), ports, containerIPs)
+		}
+		log.Printf("Warning: %s can't publish ports, falling back to userspace proxies: %v", fw.Name(), err)
+	}
+
+	var published []types.PortMapping
+	for _, port := range ports {
+		pid, err := startProxy(port, containerIPs)
+		if err != nil {
+			UnpublishPorts(containerID, firewall.BackendNone, published)
+			return nil, "", fmt.Errorf("failed to publish port %s: %v", FormatPortMapping(port), err)
+		}
+		port.ProxyPid = pid
+		published = append(published, port)
+	}
+	return published, firewall.BackendNone, nil
+}
+
+// proxyIPv4 starts userspace proxies for the IPv4 side of the ports the
+// firewall published for a container without an IPv4 address, its rules
+// can't forward connections to another family. Ports bound to a host
+// address are left alone.
+func proxyIPv4(containerID, backend string, ports []types.PortMapping, containerIPs []string) ([]types.PortMapping, string, error) {
+	for _, ip := range containerIPs {
+		if !strings.Contains(ip, ":") {
+			return ports, backend, nil
+		}
+	}
+
+	published := make([]types.PortMapping, 0, len(ports))
+	for _, port := range ports {
+		if port.HostIP == "" {
+			ipv4 := port
+			ipv4.HostIP = "0.0.0.0"
+			pid, err := startProxy(ipv4, containerIPs)
+			if err != nil {
+				UnpublishPorts(containerID, backend, published)
+				return nil, "", fmt.Errorf("failed to publish port %s: %v", FormatPortMapping(port), err)
+			}
+			port.ProxyPid = pid
+		}
+		published = append(published, port)
+	}
+	return published, backend, nil
+}
+
+// UnpublishPorts removes what PublishPorts set up with backend, ports that
+// are already gone are skipped
+func UnpublishPorts(containerID, backend string, ports []types.PortMapping) {
+	for _, port := range ports {
+		if port.ProxyPid > 0 {
+			stopProxy(port.ProxyPid)
+		}
+	}
+	if backend == "" || backend == firewall.BackendNone {
+		return
+	}
+	fw, err := firewall.Get(backend)
+	if err == nil {
+		err = fw.UnpublishPorts(containerID)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to unpublish ports: %v", err)
+	}
+}
+
+// startProxy runs `congo proxy` for a published port. Without a host
+// address it listens on IPv4 and IPv6. Connections go to the container's
+// address of the host address' family if it has one, so a proxy also
+// forwards IPv6 to IPv4-only containers.
+func startProxy(port types.PortMapping, containerIPs []string) (int, error) {
+	if len(containerIPs) == 0 {
+		return 0, fmt.Errorf("container has no address")
+	}
+	target := containerIPs[0]
+	ipv6 := strings.Contains(port.HostIP, ":")
+	for _, ip := range containerIPs {
+		if strings.Contains(ip, ":") == ipv6 {
+			target = ip
+			break
+		}
+	}
+	return StartHelper("proxy", port.Protocol,
+		net.JoinHostPort(port.HostIP, strconv.Itoa(port.HostPort)),
+		net.JoinHostPort(target, strconv.Itoa(port.ContainerPort)))
+}
+
+// stopProxy terminates a proxy, unless its pid was reused by something else
+func stopProxy(pid int) {
+	StopHelper(pid, "proxy")
+}
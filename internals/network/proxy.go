@@ -0,0 +1,142 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// udpIdleTimeout drops the upstream socket of a UDP client gone quiet
+const udpIdleTimeout = 90 * time.Second
+
+// RunProxy forwards a host port to a container, for hosts where no
+// firewall can. It prints HelperReady or the listen error on stdout, closes
+// stdout and serves until SIGTERM.
+func RunProxy(protocol, listenAddr, targetAddr string) error {
+	var serve func() error
+	var closer io.Closer
+	switch protocol {
+	case "tcp":
+		l, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		closer = l
+		serve = func() error { return proxyTCP(l, targetAddr) }
+	case "udp":
+		conn, err := net.ListenPacket("udp", listenAddr)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		closer = conn
+		serve = func() error { return proxyUDP(conn, targetAddr) }
+	default:
+		err := fmt.Errorf("unknown protocol %s", protocol)
+		fmt.Println(err)
+		return err
+	}
+
+	fmt.Println(HelperReady)
+	os.Stdout.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		closer.Close()
+	}()
+	if err := serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func proxyTCP(l net.Listener, targetAddr string) error {
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer client.Close()
+			upstream, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				io.Copy(upstream, client)
+				upstream.(*net.TCPConn).CloseWrite()
+			}()
+			go func() {
+				defer wg.Done()
+				io.Copy(client, upstream)
+				client.(*net.TCPConn).CloseWrite()
+			}()
+			wg.Wait()
+		}()
+	}
+}
+
+// proxyUDP keeps one upstream socket per client address, replies from the
+// container go back to that client
+func proxyUDP(conn net.PacketConn, targetAddr string) error {
+	target, err := net.ResolveUDPAddr("udp", targetAddr)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	upstreams := make(map[string]*net.UDPConn)
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		upstream, ok := upstreams[client.String()]
+		if !ok {
+			if upstream, err = net.DialUDP("udp", nil, target); err != nil {
+				mu.Unlock()
+				continue
+			}
+			upstreams[client.String()] = upstream
+			go func(client net.Addr, upstream *net.UDPConn) {
+				reply := make([]byte, 65535)
+				for {
+					upstream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+					n, err := upstream.Read(reply)
+					if err != nil {
+						break
+					}
+					conn.WriteTo(reply[:n], client)
+				}
+				mu.Lock()
+				delete(upstreams, client.String())
+				mu.Unlock()
+				upstream.Close()
+			}(client, upstream)
+		}
+		mu.Unlock()
+
+		upstream.Write(buf[:n])
+	}
+}
+
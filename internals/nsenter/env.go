@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+// Package nsenter joins the namespaces of another container from a
+// container's child process. A user namespace can only be joined by a
+// process with a single thread, so the namespaces listed in $_CONGO_NSENTER
+// are entered by a C constructor that runs before the Go runtime starts.
+// The namespaces the container doesn't share are created there too, after
+// the user namespace was joined, so they belong to it.
+package nsenter
+
+const (
+	// EnvNamespaces lists the namespace files, e.g. /proc/<pid>/ns/user, a
+	// child process joins before it runs, separated by colons
+	EnvNamespaces = "_CONGO_NSENTER"
+	// EnvUnshare holds the CLONE_NEW* flags of the namespaces the child
+	// creates once it joined them, in decimal. With CLONE_NEWPID the
+	// process forks, the child runs the container and the parent stays
+	// behind to relay signals and its exit status.
+	EnvUnshare = "_CONGO_NSENTER_UNSHARE"
+	// EnvReady is the descriptor the child writes a byte to once its
+	// namespaces are set up, before that its network namespace may not be
+	// the one the container gets yet
+	EnvReady = "_CONGO_NSENTER_READY"
+	// EnvWait is the descriptor the child waits to become readable, or
+	// closed, before it forks into a new PID namespace, so the parent can
+	// move it into its cgroups first
+	EnvWait = "_CONGO_NSENTER_WAIT"
+)
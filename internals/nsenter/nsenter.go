@@ -0,0 +1,166 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+package nsenter
+
+/*
+#define _GNU_SOURCE
+#include <errno.h>
+#include <fcntl.h>
+#include <poll.h>
+#include <sched.h>
+#include <signal.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/mount.h>
+#include <sys/prctl.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+static pid_t congo_child;
+
+static void congo_fail(const char *what) {
+	fprintf(stderr, "congo: %s: %m\n", what);
+	_exit(1);
+}
+
+static int congo_env_int(const char *name, int def) {
+	const char *value = getenv(name);
+	if (value == NULL || *value == '\0') {
+		return def;
+	}
+	return atoi(value);
+}
+
+static void congo_forward(int sig) {
+	kill(congo_child, sig);
+}
+
+// congo_relay runs in place of the container's process in the PID
+// namespace congo sees it in: signals sent to it go to the container, and
+// it exits the way the container did. The container is killed if it dies.
+static void congo_relay(sigset_t *mask) {
+	struct sigaction sa;
+	memset(&sa, 0, sizeof(sa));
+	sa.sa_handler = congo_forward;
+	sa.sa_flags = SA_RESTART;
+	for (int sig = 1; sig < NSIG; sig++) {
+		if (sig != SIGKILL && sig != SIGSTOP && sig != SIGCHLD) {
+			sigaction(sig, &sa, NULL);
+		}
+	}
+	sigprocmask(SIG_SETMASK, mask, NULL);
+
+	int status;
+	while (waitpid(congo_child, &status, 0) < 0) {
+		if (errno != EINTR) {
+			congo_fail("failed to wait for the container");
+		}
+	}
+	if (WIFSIGNALED(status)) {
+		int sig = WTERMSIG(status);
+		sigset_t set;
+		sigemptyset(&set);
+		sigaddset(&set, sig);
+		signal(sig, SIG_DFL);
+		sigprocmask(SIG_UNBLOCK, &set, NULL);
+		kill(getpid(), sig);
+		_exit(128 + sig);
+	}
+	_exit(WEXITSTATUS(status));
+}
+
+// congo_nsenter joins the namespace files of $_CONGO_NSENTER in order and
+// creates the ones of $_CONGO_NSENTER_UNSHARE afterwards. A joined user
+// namespace has to come first: the other namespaces belong to it, and the
+// ones created here have to, or the child's root couldn't manage them.
+__attribute__((constructor)) static void congo_nsenter(void) {
+	const char *list = getenv("_CONGO_NSENTER");
+	if (list == NULL || *list == '\0') {
+		return;
+	}
+	char *paths = strdup(list);
+	if (paths == NULL) {
+		fprintf(stderr, "congo: failed to join namespaces: out of memory\n");
+		_exit(1);
+	}
+
+	int user = 0;
+	char *save = NULL;
+	for (char *path = strtok_r(paths, ":", &save); path != NULL; path = strtok_r(NULL, ":", &save)) {
+		int fd = open(path, O_RDONLY | O_CLOEXEC);
+		if (fd < 0 || setns(fd, 0) < 0) {
+			fprintf(stderr, "congo: failed to join namespace %s: %m\n", path);
+			_exit(1);
+		}
+		close(fd);
+		size_t len = strlen(path);
+		if (len >= 5 && strcmp(path + len - 5, "/user") == 0) {
+			user = 1;
+		}
+	}
+	free(paths);
+
+	// Root of the joined namespace, as mapped by the container owning it
+	if (user && (setresgid(0, 0, 0) < 0 || setresuid(0, 0, 0) < 0)) {
+		congo_fail("failed to become root in the user namespace");
+	}
+	int flags = congo_env_int("_CONGO_NSENTER_UNSHARE", 0);
+	if (flags != 0 && unshare(flags) < 0) {
+		congo_fail("failed to create namespaces");
+	}
+	if ((flags & CLONE_NEWNS) && mount("none", "/", NULL, MS_REC | MS_PRIVATE, NULL) < 0) {
+		congo_fail("failed to make / private");
+	}
+
+	int ready = congo_env_int("_CONGO_NSENTER_READY", -1);
+	if (ready >= 0) {
+		if (write(ready, "1", 1) != 1) {
+			congo_fail("failed to report namespaces");
+		}
+		close(ready);
+	}
+	if (!(flags & CLONE_NEWPID)) {
+		return;
+	}
+
+	// Only the children of a process end up in the PID namespace it made
+	int wait = congo_env_int("_CONGO_NSENTER_WAIT", -1);
+	if (wait >= 0) {
+		struct pollfd pfd = {.fd = wait, .events = POLLIN};
+		while (poll(&pfd, 1, -1) < 0) {
+			if (errno != EINTR) {
+				congo_fail("failed to wait for the parent");
+			}
+		}
+	}
+	sigset_t all, mask;
+	sigfillset(&all);
+	sigprocmask(SIG_SETMASK, &all, &mask);
+	congo_child = fork();
+	if (congo_child < 0) {
+		congo_fail("failed to fork into the PID namespace");
+	}
+	if (congo_child > 0) {
+		congo_relay(&mask);
+	}
+	if (prctl(PR_SET_PDEATHSIG, SIGKILL) < 0) {
+		congo_fail("failed to set parent death signal");
+	}
+	sigprocmask(SIG_SETMASK, &mask, NULL);
+}
+*/
+import "C"
+
+import "os"
+
+// Available reports whether this build can join namespaces with EnvNamespaces
+const Available = true
+
+func init() {
+	// The container's process doesn't need to see them
+	for _, env := range []string{EnvNamespaces, EnvUnshare, EnvReady, EnvWait} {
+		os.Unsetenv(env)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build linux && !cgo
+// +build linux,!cgo
+
+package nsenter
+
+// Available reports whether this build can join namespaces with
+// EnvNamespaces, joining a user namespace needs the C constructor
+const Available = false
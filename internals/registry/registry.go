@@ -0,0 +1,813 @@
+//go:build linux
+// +build linux
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"congo/internals/image"
+	"congo/internals/types"
+)
+
+const (
+	DefaultRegistry = "docker.io"
+	// Docker Hub serves its API from a different host than its name
+	dockerHubAPIHost = "registry-1.docker.io"
+	defaultParallel  = 3
+	maxManifestSize  = 4 * 1024 * 1024
+)
+
+var manifestAccept = strings.Join([]string{
+	image.MediaTypeOCIIndex,
+	image.MediaTypeOCIManifest,
+	image.MediaTypeDockerList,
+	image.MediaTypeDockerManifest,
+}, ", ")
+
+// Reference is a parsed image reference: registry/repository[:tag|@digest]
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference, filling in docker's defaults
+// (docker.io, library/ and the latest tag) for the parts left out
+func ParseReference(ref string) (Reference, error) {
+	var r Reference
+	if ref == "" {
+		return r, fmt.Errorf("empty image reference")
+	}
+
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		r.Digest = name[i+1:]
+		name = name[:i]
+		if _, err := image.SplitDigest(r.Digest); err != nil {
+			return r, err
+		}
+	}
+
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		r.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	// The first component is a registry host when it looks like one
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			r.Registry = first
+			name = name[i+1:]
+		}
+	}
+	if r.Registry == "" {
+		r.Registry = DefaultRegistry
+	}
+	if r.Registry == DefaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" || name != strings.ToLower(name) {
+		return r, fmt.Errorf("invalid repository name in %s", ref)
+	}
+	r.Repository = name
+
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+
+	return r, nil
+}
+
+// reference returns the tag or digest used in manifest URLs
+func (r Reference) reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+type Client struct {
+	HTTP     *http.Client
+	Username string
+	Password string
+	// Insecure talks plain HTTP, which is always the case for localhost
+	Insecure bool
+	// Parallel is the number of layers downloaded at once
+	Parallel int
+	// Out receives progress messages
+	Out io.Writer
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// NewClient returns a client using credentials from CONGO_REGISTRY_USER and
+// CONGO_REGISTRY_PASSWORD when they are set
+func NewClient() *Client {
+	return &Client{
+		HTTP:     http.DefaultClient,
+		Username: os.Getenv("CONGO_REGISTRY_USER"),
+		Password: os.Getenv("CONGO_REGISTRY_PASSWORD"),
+		Parallel: defaultParallel,
+		Out:      io.Discard,
+		tokens:   make(map[string]string),
+	}
+}
+
+func (c *Client) baseURL(r Reference) string {
+	host := r.Registry
+	if host == DefaultRegistry {
+		host = dockerHubAPIHost
+	}
+
+	scheme := "https"
+	hostname := host
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		hostname = h
+	}
+	if c.Insecure || hostname == "localhost" || hostname == "127.0.0.1" || strings.HasPrefix(host, "[::1]") {
+		scheme = "http"
+	}
+
+	return scheme + "://" + host
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.Out != nil {
+		fmt.Fprintf(c.Out, format, args...)
+	}
+}
+
+// do sends a request, answering the registry's auth challenge when it
+// returns 401. newReq must build a fresh request each time since the body
+// may have to be sent twice.
+func (c *Client) do(scope string, newReq func() (*http.Request, error)) (*http.Response, error) {
+	req, err := newReq()
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req, scope)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, &Error{Op: req.Method, URL: req.URL.String(), Err: err}
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := c.authenticate(challenge, scope); err != nil {
+		return nil, err
+	}
+
+	if req, err = newReq(); err != nil {
+		return nil, err
+	}
+	c.authorize(req, scope)
+
+	resp, err = c.HTTP.Do(req)
+	if err != nil {
+		return nil, &Error{Op: req.Method, URL: req.URL.String(), Err: err}
+	}
+	return resp, nil
+}
+
+func (c *Client) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	token := c.tokens[scope]
+	c.mu.Unlock()
+
+	switch {
+	case token == "basic":
+		req.SetBasicAuth(c.Username, c.Password)
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// authenticate handles a WWW-Authenticate challenge, fetching a bearer token
+// from the realm the registry points at (the docker token auth spec)
+func (c *Client) authenticate(challenge, scope string) error {
+	kind, params := parseChallenge(challenge)
+
+	switch strings.ToLower(kind) {
+	case "basic":
+		if c.Username == "" {
+			return fmt.Errorf("registry requires credentials, set CONGO_REGISTRY_USER and CONGO_REGISTRY_PASSWORD")
+		}
+		c.setToken(scope, "basic")
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid auth realm in challenge %q", challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return &Error{Op: "GET", URL: realm.String(), Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("failed to decode auth token: %v", err)
+	}
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("auth server at %s returned no token", realm.Host)
+	}
+
+	c.setToken(scope, token)
+	return nil
+}
+
+func (c *Client) setToken(scope, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = make(map[string]string)
+	}
+	c.tokens[scope] = token
+}
+
+// parseChallenge splits `Bearer realm="...",service="..."` into its scheme and parameters
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	kind, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+
+	return kind, params
+}
+
+// Error is a failed registry request
+type Error struct {
+	Op         string
+	URL        string
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s %s: %v", e.Op, e.URL, e.Err)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("%s %s: %s: %s", e.Op, e.URL, http.StatusText(e.StatusCode), e.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Op, e.URL, http.StatusText(e.StatusCode))
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newStatusError reads the registry's error body (the distribution spec's
+// {"errors": [...]} document) into an Error
+func newStatusError(resp *http.Response) error {
+	e := &Error{Op: resp.Request.Method, URL: resp.Request.URL.String(), StatusCode: resp.StatusCode}
+
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		var msgs []string
+		for _, regErr := range body.Errors {
+			msgs = append(msgs, regErr.Code+": "+regErr.Message)
+		}
+		e.Message = strings.Join(msgs, "; ")
+	}
+
+	return e
+}
+
+func pullScope(r Reference) string {
+	return "repository:" + r.Repository + ":pull"
+}
+
+func pushScope(r Reference) string {
+	return "repository:" + r.Repository + ":pull,push"
+}
+
+// fetchManifest gets a manifest or index by tag or digest, returning its
+// body and media type
+func (c *Client) fetchManifest(r Reference, reference string) ([]byte, string, error) {
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL(r), r.Repository, reference)
+	resp, err := c.do(pullScope(r), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err == nil {
+			req.Header.Set("Accept", manifestAccept)
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", newStatusError(resp)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	// Content fetched by digest must match it
+	if strings.HasPrefix(reference, "sha256:") {
+		if _, err := io.Copy(io.Discard, image.NewVerifier(bytes.NewReader(data), reference)); err != nil {
+			return nil, "", fmt.Errorf("manifest %s: %v", reference, err)
+		}
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &probe) == nil && probe.MediaType != "" {
+		mediaType = probe.MediaType
+	}
+
+	return data, mediaType, nil
+}
+
+func (c *Client) fetchBlob(r Reference, digest string) ([]byte, error) {
+	resp, err := c.getBlob(r, digest, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	return io.ReadAll(image.NewVerifier(io.LimitReader(resp.Body, maxManifestSize), digest))
+}
+
+func (c *Client) getBlob(r Reference, digest string, offset int64) (*http.Response, error) {
+	u := fmt.Sprintf("%s/v2/%s/blobs/%s", c.baseURL(r), r.Repository, digest)
+	return c.do(pullScope(r), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err == nil && offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return req, err
+	})
+}
+
+func downloadDir() string {
+	dir := filepath.Join(types.DefaultImageRoot, "downloads")
+	os.MkdirAll(dir, 0755)
+	return dir
+}
+
+// openPartial opens and flocks the partial download file of a blob, so
+// concurrent pulls of the same blob take turns. A file renamed or removed
+// by the previous holder is opened again.
+func openPartial(partial string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create download file: %v", err)
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock download file: %v", err)
+		}
+		var locked, current unix.Stat_t
+		if unix.Fstat(int(f.Fd()), &locked) == nil && unix.Stat(partial, &current) == nil && locked.Ino == current.Ino {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+// downloadBlob fetches a blob into the download cache, resuming a partial
+// download left behind by an earlier pull, and verifies its digest
+func (c *Client) downloadBlob(r Reference, desc image.Descriptor) (string, error) {
+	hexPart, err := image.SplitDigest(desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(downloadDir(), hexPart)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	partial := path + ".partial"
+	f, err := openPartial(partial)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Another pull may have finished it while we waited for the lock
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.getBlob(r, desc.Digest, offset)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		c.logf("Resuming %s at %d bytes\n", desc.Digest, offset)
+	case http.StatusOK:
+		// No range support (or nothing downloaded yet), start over
+		if err := f.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Everything is already there, verification below decides
+	default:
+		return "", newStatusError(resp)
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if _, err := io.Copy(f, resp.Body); err != nil {
+			return "", fmt.Errorf("failed to download %s: %v", desc.Digest, err)
+		}
+	}
+
+	// Verify the complete file, a bad partial download is thrown away
+	check, err := os.Open(partial)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(io.Discard, image.NewVerifier(check, desc.Digest))
+	check.Close()
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+
+	if err := os.Rename(partial, path); err != nil {
+		return "", fmt.Errorf("failed to store download: %v", err)
+	}
+	return path, nil
+}
+
+// Pull downloads an image from a registry into the image store and tags it
+// with the reference it was pulled by
+func (c *Client) Pull(ref string) (*image.Image, error) {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	data, mediaType, err := c.fetchManifest(r, r.reference())
+	if err != nil {
+		return nil, err
+	}
+
+	// Manifest lists carry one manifest per platform
+	if image.IsIndex(mediaType) {
+		var index image.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("failed to parse image index: %v", err)
+		}
+		desc, err := image.MatchPlatform(index.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		if data, _, err = c.fetchManifest(r, desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	var manifest image.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse image manifest: %v", err)
+	}
+
+	configData, err := c.fetchBlob(r, manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image config: %v", err)
+	}
+	var cfg image.OCIConfig
+	if err := json.Unmarshal(configData, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %v", err)
+	}
+
+	// Layers found in the store are kept until the image refers to them
+	unlock, err := image.LockLayers()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	diffIDs, err := c.pullLayers(r, manifest.Layers, cfg.RootFS.DiffIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := image.ImageFromConfig(cfg, diffIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := image.Tag(ref, img.ID); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// pullLayers downloads the layers that aren't in the store yet, Parallel at
+// a time, and imports them in order. A layer listed more than once is
+// downloaded and imported once.
+func (c *Client) pullLayers(r Reference, layers []image.Descriptor, knownDiffIDs []string) ([]string, error) {
+	parallel := c.Parallel
+	if parallel <= 0 {
+		parallel = defaultParallel
+	}
+
+	paths := make([]string, len(layers))
+	errs := make([]error, len(layers))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	downloading := make(map[string]bool)
+	for i, desc := range layers {
+		if i < len(knownDiffIDs) && image.HasLayer(knownDiffIDs[i]) {
+			c.logf("Layer %s already exists\n", desc.Digest)
+			continue
+		}
+		if downloading[desc.Digest] {
+			continue
+		}
+		downloading[desc.Digest] = true
+
+		wg.Add(1)
+		go func(i int, desc image.Descriptor) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			c.logf("Downloading %s (%d bytes)\n", desc.Digest, desc.Size)
+			paths[i], errs[i] = c.downloadBlob(r, desc)
+		}(i, desc)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to download layer %s: %v", layers[i].Digest, err)
+		}
+	}
+
+	diffIDs := make([]string, len(layers))
+	imported := make(map[string]string)
+	for i, desc := range layers {
+		if diffID, ok := imported[desc.Digest]; ok {
+			diffIDs[i] = diffID
+			continue
+		}
+		if paths[i] == "" {
+			diffIDs[i] = knownDiffIDs[i]
+			continue
+		}
+
+		f, err := os.Open(paths[i])
+		if os.IsNotExist(err) && i < len(knownDiffIDs) && image.HasLayer(knownDiffIDs[i]) {
+			// A concurrent pull imported the download and removed it
+			diffIDs[i] = knownDiffIDs[i]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		diffID, err := image.ImportLayer(f, desc)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(paths[i])
+		diffIDs[i] = diffID
+		imported[desc.Digest] = diffID
+		c.logf("Extracted %s\n", desc.Digest)
+	}
+
+	return diffIDs, nil
+}
+
+// Push uploads a local image to a registry under ref
+func (c *Client) Push(localRef, ref string) error {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	if r.Tag == "" {
+		return fmt.Errorf("pushing requires a tag, not a digest: %s", ref)
+	}
+
+	img, err := image.Lookup(localRef)
+	if err != nil {
+		return err
+	}
+
+	configBlob, manifestBlob, err := image.ManifestFor(img)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range img.Layers {
+		err := c.uploadBlob(r, layer, func() (io.ReadCloser, int64, error) {
+			f, err := os.Open(image.LayerTarPath(layer))
+			if err != nil {
+				return nil, 0, err
+			}
+			fi, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, 0, err
+			}
+			return f, fi.Size(), nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to push layer %s: %v", layer, err)
+		}
+	}
+
+	configDigest := image.DigestOf(configBlob)
+	err = c.uploadBlob(r, configDigest, func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(configBlob)), int64(len(configBlob)), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push image config: %v", err)
+	}
+
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL(r), r.Repository, r.Tag)
+	resp, err := c.do(pushScope(r), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(manifestBlob))
+		if err == nil {
+			req.Header.Set("Content-Type", image.MediaTypeOCIManifest)
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+
+	c.logf("Pushed %s (%s)\n", r, image.DigestOf(manifestBlob))
+	return nil
+}
+
+// uploadBlob pushes a blob unless the registry already has it, using a
+// monolithic upload (POST for a session, then PUT with the digest)
+func (c *Client) uploadBlob(r Reference, digest string, open func() (io.ReadCloser, int64, error)) error {
+	base := c.baseURL(r)
+
+	headURL := fmt.Sprintf("%s/v2/%s/blobs/%s", base, r.Repository, digest)
+	resp, err := c.do(pushScope(r), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, headURL, nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		c.logf("Blob %s already exists\n", digest)
+		return nil
+	}
+
+	postURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/", base, r.Repository)
+	resp, err = c.do(pushScope(r), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, postURL, nil)
+	})
+	if err != nil {
+		return err
+	}
+	// The error is read from the body, close it afterwards
+	if resp.StatusCode != http.StatusAccepted {
+		err := newStatusError(resp)
+		resp.Body.Close()
+		return err
+	}
+	resp.Body.Close()
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return fmt.Errorf("registry returned no upload location")
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	c.logf("Uploading %s\n", digest)
+	resp, err = c.do(pushScope(r), func() (*http.Request, error) {
+		body, size, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPut, location.String(), body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newStatusError(resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,368 @@
+//go:build linux
+// +build linux
+
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"congo/internals/image"
+)
+
+const (
+	testRepo  = "test/app"
+	testToken = "secret-token"
+)
+
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+// fakeRegistry serves the distribution API for testRepo behind bearer
+// token auth and records what clients asked for
+type fakeRegistry struct {
+	url string
+
+	mu          sync.Mutex
+	blobs       map[string][]byte
+	manifests   map[string]fakeManifest
+	tokenScopes []string
+	ranges      []string
+	uploads     []string
+	denyUploads bool
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, *Client, string) {
+	f := &fakeRegistry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string]fakeManifest),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+
+	c := NewClient()
+	c.HTTP = srv.Client()
+	c.Username, c.Password = "", ""
+	return f, c, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		f.tokenScopes = append(f.tokenScopes, r.URL.Query().Get("scope"))
+		json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, f.url))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, "/v2/"+testRepo+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case strings.HasPrefix(path, "manifests/"):
+		ref := strings.TrimPrefix(path, "manifests/")
+		if r.Method == http.MethodPut {
+			data, _ := io.ReadAll(r.Body)
+			f.manifests[ref] = fakeManifest{mediaType: r.Header.Get("Content-Type"), data: data}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		m, ok := f.manifests[ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Write(m.data)
+	case path == "blobs/uploads/":
+		if f.denyUploads {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"}]}`)
+			return
+		}
+		w.Header().Set("Location", "/v2/"+testRepo+"/blobs/uploads/session?state=1")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(path, "blobs/uploads/"):
+		digest := r.URL.Query().Get("digest")
+		data, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || image.DigestOf(data) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[digest] = data
+		f.uploads = append(f.uploads, digest)
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "blobs/"):
+		data, ok := f.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			f.ranges = append(f.ranges, r.Header.Get("Range"))
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// requireStore skips tests that write to the image store under /var/lib/congo
+func requireStore(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root for the image store")
+	}
+}
+
+// testLayer returns a layer tarball with one file, unique to each run so it
+// isn't in the store yet
+func testLayer(t *testing.T) []byte {
+	content := fmt.Sprintf("written by %s at %d\n", t.Name(), time.Now().UnixNano())
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(tw, content)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPullPicksPlatformWithBearerToken(t *testing.T) {
+	requireStore(t)
+	f, c, host := newFakeRegistry(t)
+
+	layer := testLayer(t)
+	blob := gzipped(t, layer)
+	diffID := image.DigestOf(layer)
+	f.blobs[image.DigestOf(blob)] = blob
+
+	configBlob := mustJSON(t, image.OCIConfig{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS:       image.RootFS{Type: "layers", DiffIDs: []string{diffID}},
+	})
+	f.blobs[image.DigestOf(configBlob)] = configBlob
+
+	manifest := mustJSON(t, image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIManifest,
+		Config:        image.Descriptor{MediaType: image.MediaTypeOCIConfig, Digest: image.DigestOf(configBlob), Size: int64(len(configBlob))},
+		Layers:        []image.Descriptor{{MediaType: image.MediaTypeOCILayerGzip, Digest: image.DigestOf(blob), Size: int64(len(blob))}},
+	})
+	f.manifests[image.DigestOf(manifest)] = fakeManifest{image.MediaTypeOCIManifest, manifest}
+
+	// The other platform's manifest isn't served, picking it fails the pull
+	index := mustJSON(t, image.Index{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIIndex,
+		Manifests: []image.Descriptor{
+			{MediaType: image.MediaTypeOCIManifest, Digest: image.DigestOf([]byte("other")), Size: 5, Platform: &image.Platform{OS: "windows", Architecture: runtime.GOARCH}},
+			{MediaType: image.MediaTypeOCIManifest, Digest: image.DigestOf(manifest), Size: int64(len(manifest)), Platform: &image.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}},
+		},
+	})
+	f.manifests["v1"] = fakeManifest{image.MediaTypeOCIIndex, index}
+
+	ref := host + "/" + testRepo + ":v1"
+	img, err := c.Pull(ref)
+	if err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	defer image.RemoveImage(ref, nil)
+
+	if len(img.Layers) != 1 || img.Layers[0] != diffID {
+		t.Errorf("image layers = %v, want [%s]", img.Layers, diffID)
+	}
+	if !image.HasLayer(diffID) {
+		t.Errorf("layer %s is not in the store", diffID)
+	}
+	if !contains(f.tokenScopes, "repository:"+testRepo+":pull") {
+		t.Errorf("token scopes = %v, want the pull scope", f.tokenScopes)
+	}
+}
+
+func TestDownloadBlobResumesPartialDownload(t *testing.T) {
+	requireStore(t)
+	f, c, host := newFakeRegistry(t)
+
+	blob := testLayer(t)
+	desc := image.Descriptor{MediaType: image.MediaTypeOCILayer, Digest: image.DigestOf(blob), Size: int64(len(blob))}
+	f.blobs[desc.Digest] = blob
+
+	path := filepath.Join(downloadDir(), strings.TrimPrefix(desc.Digest, "sha256:"))
+	defer os.Remove(path)
+	half := len(blob) / 2
+	if err := os.WriteFile(path+".partial", blob[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path + ".partial")
+
+	r, err := ParseReference(host + "/" + testRepo + ":v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.downloadBlob(r, desc)
+	if err != nil {
+		t.Fatalf("downloadBlob: %v", err)
+	}
+	if data, err := os.ReadFile(got); err != nil || !bytes.Equal(data, blob) {
+		t.Errorf("downloaded blob differs from the served one (err %v)", err)
+	}
+	if want := fmt.Sprintf("bytes=%d-", half); !contains(f.ranges, want) {
+		t.Errorf("Range headers = %q, want %q", f.ranges, want)
+	}
+}
+
+func TestDownloadBlobRejectsDigestMismatch(t *testing.T) {
+	requireStore(t)
+	f, c, host := newFakeRegistry(t)
+
+	blob := testLayer(t)
+	desc := image.Descriptor{MediaType: image.MediaTypeOCILayer, Digest: image.DigestOf(blob), Size: int64(len(blob))}
+	f.blobs[desc.Digest] = append([]byte("tampered"), blob...)
+
+	path := filepath.Join(downloadDir(), strings.TrimPrefix(desc.Digest, "sha256:"))
+	defer os.Remove(path)
+	defer os.Remove(path + ".partial")
+
+	r, err := ParseReference(host + "/" + testRepo + ":v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.downloadBlob(r, desc); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("downloadBlob error = %v, want a digest mismatch", err)
+	}
+	for _, p := range []string{path, path + ".partial"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was kept after a digest mismatch", p)
+		}
+	}
+}
+
+func TestPushUploadsBlobsAndManifest(t *testing.T) {
+	requireStore(t)
+	f, c, host := newFakeRegistry(t)
+
+	localRef := fmt.Sprintf("congo-registry-test:%d", time.Now().UnixNano())
+	img, err := image.Import(bytes.NewReader(testLayer(t)), localRef, "registry test")
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	defer image.RemoveImage(localRef, nil)
+	layer := img.Layers[0]
+	configBlob, _, err := image.ManifestFor(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := host + "/" + testRepo + ":v2"
+	if err := c.Push(localRef, ref); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	if !contains(f.uploads, layer) || !contains(f.uploads, image.DigestOf(configBlob)) {
+		t.Errorf("uploaded blobs = %v, want layer %s and the config", f.uploads, layer)
+	}
+	stored, err := os.ReadFile(image.LayerTarPath(layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.blobs[layer], stored) {
+		t.Errorf("uploaded layer differs from the stored tarball")
+	}
+
+	pushed, ok := f.manifests["v2"]
+	if !ok {
+		t.Fatalf("no manifest was put under the tag")
+	}
+	if pushed.mediaType != image.MediaTypeOCIManifest {
+		t.Errorf("manifest content type = %q, want %q", pushed.mediaType, image.MediaTypeOCIManifest)
+	}
+	var manifest image.Manifest
+	if err := json.Unmarshal(pushed.data, &manifest); err != nil {
+		t.Fatalf("pushed manifest: %v", err)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != layer || manifest.Config.Digest != image.DigestOf(configBlob) {
+		t.Errorf("pushed manifest = %s", pushed.data)
+	}
+
+	// Blobs the registry has are skipped
+	uploads := len(f.uploads)
+	if err := c.Push(localRef, ref); err != nil {
+		t.Fatalf("second Push: %v", err)
+	}
+	if len(f.uploads) != uploads {
+		t.Errorf("second push uploaded %v again", f.uploads[uploads:])
+	}
+}
+
+func TestUploadBlobReportsRegistryError(t *testing.T) {
+	f, c, host := newFakeRegistry(t)
+	f.denyUploads = true
+
+	r, err := ParseReference(host + "/" + testRepo + ":v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := []byte("blob")
+	err = c.uploadBlob(r, image.DigestOf(blob), func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(blob)), int64(len(blob)), nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "DENIED: requested access to the resource is denied") {
+		t.Fatalf("uploadBlob error = %v, want the registry's message", err)
+	}
+}
@@ -16,6 +16,7 @@ import (
     "congo/internals/capabilities"
     "congo/internals/utils"
     "congo/internals/filesystem"
+    "congo/internals/dns"
     //"congo/internals/logging"
     "congo/internals/monitoring"
     "congo/internals/cgroups"
@@ -173,24 +174,6 @@ func SetupLogging(config *types.Config) error {
     return nil
 }
 
-func SetupMounts(mounts []types.Mount) error {
-    for _, mount := range mounts {
-        if err := os.MkdirAll(mount.Destination, 0755); err != nil {
-            return fmt.Errorf("failed to create mount point: %v", err)
-        }
-
-        flags := unix.MS_BIND
-        if mount.ReadOnly {
-            flags |= unix.MS_RDONLY
-        }
-
-        if err := unix.Mount(mount.Source, mount.Destination, "", uintptr(flags), ""); err != nil {
-            return fmt.Errorf("failed to mount: %v", err)
-        }
-    }
-    return nil
-}
-
 func SetupEnv(envVars map[string]string) error {
     for key, value := range envVars {
         if err := os.Setenv(key, value); err != nil {
@@ -200,16 +183,20 @@ func SetupEnv(envVars map[string]string) error {
     return nil
 }
 
-func SetupContainer(config *types.Config) error {
-    defer utils.Cleanup(config)
+func SetupContainer(config *types.Config) (err error) {
+    // Mounts have to survive into the container process, only undo them on failure
+    defer func() {
+        if err != nil {
+            utils.Cleanup(config)
+        }
+    }()
 
-    // Set hostname
-    hostname := config.Hostname
-    if hostname == ""{
-        hostname = "container"
-    }
-    if err := unix.Sethostname([]byte(hostname)); err != nil {
-        return fmt.Errorf("error setting hostname: %v", err)
+    // Set hostname, unless the UTS namespace is the host's
+    if config.Namespaces.UTS == "" {
+        hostname := dns.Hostname(config.ContainerID, config.Hostname)
+        if err := unix.Sethostname([]byte(hostname)); err != nil {
+            return fmt.Errorf("error setting hostname: %v", err)
+        }
     }
 
     // Setup root filesystem
@@ -218,7 +205,7 @@ func SetupContainer(config *types.Config) error {
             return fmt.Errorf("error setting up layered rootfs: %v", err)
         }
     } else {
-        if err := filesystem.SetupRootfs(config.Rootfs); err != nil {
+        if err := filesystem.SetupRootfs(config); err != nil {
             return fmt.Errorf("error setting up rootfs: %v", err)
         }
     }
@@ -228,9 +215,21 @@ func SetupContainer(config *types.Config) error {
         return fmt.Errorf("error setting up capabilities: %v", err)
     }
 
-    // Setup bind mounts
-    if err := SetupMounts(config.Mounts); err != nil {
-        return fmt.Errorf("error performing bind mounts: %v", err)
+    // Writable scratch space has to be mounted before the root goes read-only
+    if err := filesystem.SetupTmpfs(config.Tmpfs); err != nil {
+        return fmt.Errorf("error setting up tmpfs mounts: %v", err)
+    }
+
+    // The working directory may live on a volume or a tmpfs, and has to be
+    // created before the root goes read-only
+    if err := filesystem.SetupWorkingDir(config.WorkingDir); err != nil {
+        return fmt.Errorf("error setting up working directory: %v", err)
+    }
+
+    if config.ReadOnly {
+        if err := filesystem.RemountReadOnly("/"); err != nil {
+            return fmt.Errorf("error making rootfs read-only: %v", err)
+        }
     }
 
     // Setup cgroups
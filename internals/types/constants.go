@@ -60,7 +60,25 @@ const (
 	DefaultLogDir = "/var/log/congo"
 	DefaultMaxLogSize = 10 * 1024 * 1024
 	DefaultMonitorInterval = 30
-	DefaultImageDir = "var/lib/congo/images"
+	DefaultImageRoot = "/var/lib/congo"
+	DefaultImageDir = "/var/lib/congo/images"
+	DefaultLayerDir = "/var/lib/congo/layers"
+	DefaultBuildCacheDir = "/var/lib/congo/build-cache"
+)
+
+// Per-container overlay directories, relative to the container's directory in the state root
+const (
+	OverlayUpperDir = "upper"
+	OverlayWorkDir = "work"
+	OverlayMergedDir = "merged"
+)
+
+// Files generated for each container and bind mounted over the image's
+// /etc ones, relative to the container's directory in the state root
+const (
+	HostsFile = "hosts"
+	HostnameFile = "hostname"
+	ResolvConfFile = "resolv.conf"
 )
 
 // Network defaults 
@@ -39,10 +39,45 @@ type Mount struct {
 	ReadOnly bool
 }
 
+// TmpfsMount is a writable tmpfs mounted inside the container, Options is
+// the raw mount data string (e.g. "size=64m,mode=1777")
+type TmpfsMount struct {
+	Destination string
+	Options     string
+}
+
 type NetworkConfig struct {
+	Mode        string
 	Bridge      string
-	ContainerIP string
+	Subnet      string
+	Gateway     string
+	// IPv6Subnet and IPv6Gateway are empty on IPv4-only networks,
+	// IPv6Mode is how the subnet reaches outside networks
+	IPv6Subnet  string
+	IPv6Gateway string
+	IPv6Mode    string
+	// ContainerIPs are the container's addresses, at most one IPv4 and one
+	// IPv6 address
+	ContainerIPs []string
 	PortMaps    []PortMapping
+	// DNS, DNSSearch and ExtraHosts (name:ip) go into the container's
+	// resolv.conf and hosts files
+	DNS         []string
+	DNSSearch   []string
+	ExtraHosts  []string
+}
+
+// Endpoint is a container's interface on one of its networks
+type Endpoint struct {
+	Network   string
+	Interface string // name inside the container, e.g. eth1
+	HostVeth  string
+	// IP and Gateway are empty on IPv6-only networks, IPv6 and IPv6Gateway
+	// are set on networks with IPv6
+	IP        string
+	Gateway   string
+	IPv6        string `json:",omitempty"`
+	IPv6Gateway string `json:",omitempty"`
 }
 
 type Config struct {
@@ -52,8 +87,16 @@ type Config struct {
     CpuShare     string
     EnvVars      map[string]string
     Command      []string
+    Entrypoint   []string
+    WorkingDir   string
+    StopSignal   string
+    ExposedPorts []string
+    Volumes      []string
+    Labels       map[string]string
     Mounts       []Mount
     UseLayers    bool     
+    Image        string
+    ImageID      string
     ImageLayers  []string 
     User         string   
     Capabilities []string 
@@ -61,29 +104,77 @@ type Config struct {
 	LogConfig LoggingConfig
     MonitorConfig MonitoringConfig
 	ContainerID  string         
+    Name         string
     State        ContainerState 
     Interactive  bool           
     Detached     bool           
     StateDir     string  
     Hostname     string       
+    Namespaces   NamespaceModes
+    // Pod is the ID of the pod the container runs in
+    Pod          string
+    // CgroupParent is the cgroup the container's cgroup is created in,
+    // its pod's or the root of each hierarchy
+    CgroupParent string
+    ReadOnly     bool
+    Tmpfs        []TmpfsMount
+}
+
+// NamespaceModes are the --pid, --ipc, --uts and --userns modes of a
+// container, "host", "container:<id>" or, for IPC, "shareable" or
+// "private". Empty modes get a namespace of the container's own, or for
+// the user namespace the one of the container whose namespaces it shares.
+type NamespaceModes struct {
+    PID  string `json:",omitempty"`
+    IPC  string `json:",omitempty"`
+    UTS  string `json:",omitempty"`
+    User string `json:",omitempty"`
 }
 
 type PortMapping struct {
+	HostIP        string `json:",omitempty"`
 	HostPort      int
 	ContainerPort int
 	Protocol      string
+	// Pid of the userspace proxy forwarding the port, or its IPv4 side to an
+	// IPv6-only container, where the firewall couldn't
+	ProxyPid      int `json:",omitempty"`
 }
 
 // could have gone with flattened struct, but this allows for more consistent handling	
 type ContainerState struct {
     ID           string            
+    Name         string
     Pid          int               
     Status       string            
     CreatedAt    time.Time         
+    StartedAt    time.Time
     Command      []string          
+    Entrypoint   []string
+    WorkingDir   string
+    User         string
+    StopSignal   string
+    Hostname     string `json:",omitempty"`
+    Namespaces   NamespaceModes
+    // Pod is the ID of the container's pod, Infra marks the container
+    // holding the pod's namespaces
+    Pod          string `json:",omitempty"`
+    Infra        bool `json:",omitempty"`
+    // UserNamespace records whether the container last started in a user
+    // namespace, its own or a joined one, its overlay keeps metadata in
+    // user.* xattrs then
+    UserNamespace bool
+    HostUID      int
+    HostGID      int
+    Labels       map[string]string
     RootDir      string            
+    Image        string
+    ImageID      string
+    UseLayers    bool
     EnvVars      map[string]string 
     Mounts       []Mount           
+    ReadOnly     bool
+    Tmpfs        []TmpfsMount
     Interactive  bool              
     Detached     bool              
     LogDir       string            
@@ -93,9 +184,27 @@ type ContainerState struct {
         ProcessLimit int
 	}
     Network struct {               
-        ContainerIP string
+        Mode        string
+        // RequestedIPs are the --ip and --ip6 addresses, ContainerIPs those
+        // of the running container on its first network
+        RequestedIPs []string `json:",omitempty"`
+        ContainerIPs []string `json:",omitempty"`
         Bridge      string
         PortMaps    []PortMapping
+        // Ports published while the container runs, with the host ports
+        // picked for PortMaps that left them open
+        Ports       []PortMapping
+        // Firewall is the backend that published Ports, "none" when only
+        // userspace proxies did
+        Firewall    string `json:",omitempty"`
+        DNS         []string `json:",omitempty"`
+        DNSSearch   []string `json:",omitempty"`
+        ExtraHosts  []string `json:",omitempty"`
+        // Networks the container is connected to besides Mode, attached
+        // again each time it starts
+        Networks    []string
+        // Endpoints of the running container, its first network first
+        Endpoints   []Endpoint
     }
 }
 
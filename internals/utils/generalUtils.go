@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"golang.org/x/sys/unix"
 	"strings"
+	"time"
 )
 
 // getHomeDirectory determines the appropriate home directory
@@ -75,4 +76,45 @@ func FormatEnvVars(envMap map[string]string) string {
         envStrs = append(envStrs, fmt.Sprintf("%s=%s", k, v))
     }
     return strings.Join(envStrs, ",")
-}
\ No newline at end of file
+}
+// HumanDuration renders a duration the way docker does in ps, e.g. "5 minutes"
+func HumanDuration(d time.Duration) string {
+    switch seconds := int(d.Seconds()); {
+    case seconds < 1:
+        return "Less than a second"
+    case seconds == 1:
+        return "1 second"
+    case seconds < 60:
+        return fmt.Sprintf("%d seconds", seconds)
+    case d.Minutes() < 2:
+        return "About a minute"
+    case d.Minutes() < 60:
+        return fmt.Sprintf("%d minutes", int(d.Minutes()))
+    case d.Hours() < 2:
+        return "About an hour"
+    case d.Hours() < 48:
+        return fmt.Sprintf("%d hours", int(d.Hours()))
+    case d.Hours() < 24*14:
+        return fmt.Sprintf("%d days", int(d.Hours()/24))
+    case d.Hours() < 24*60:
+        return fmt.Sprintf("%d weeks", int(d.Hours()/24/7))
+    case d.Hours() < 24*365*2:
+        return fmt.Sprintf("%d months", int(d.Hours()/24/30))
+    }
+    return fmt.Sprintf("%d years", int(d.Hours()/24/365))
+}
+
+// FormatSize renders a byte count with a decimal unit, e.g. 5.61MB
+func FormatSize(size int64) string {
+    units := []string{"B", "kB", "MB", "GB", "TB"}
+    value := float64(size)
+    i := 0
+    for value >= 1000 && i < len(units)-1 {
+        value /= 1000
+        i++
+    }
+    if i == 0 {
+        return fmt.Sprintf("%dB", size)
+    }
+    return fmt.Sprintf("%.3g%s", value, units[i])
+}
@@ -5,27 +5,35 @@ package main
 
 import (
 	//"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
-    "syscall"
 
 	//"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 
 	//"unsafe"
 	"golang.org/x/sys/unix"
-	//"net"
+	"net"
 	"time"
-	//"encoding/json"
+	"text/template"
+	"congo/internals/build"
 	"congo/internals/config"
 	"congo/internals/container"
+	"congo/internals/format"
+	"congo/internals/image"
 	"congo/internals/logging"
+	"congo/internals/network"
+	"congo/internals/registry"
 	"congo/internals/setups"
 	"congo/internals/types"
+	"congo/internals/utils"
 )
 
 func main() {
@@ -41,48 +49,730 @@ func main() {
         if err != nil {
             log.Fatalf("Error parsing config: %v", err)
         }
+        if err := config.ValidateConfig(cfg); err != nil {
+            log.Fatalf("Invalid config: %v", err)
+        }
+        if err := container.ResolveNamespaces(cfg); err != nil {
+            log.Fatalf("Invalid config: %v", err)
+        }
         
         // Generate a unique container ID if not provided
         if cfg.ContainerID == "" {
-            cfg.ContainerID = fmt.Sprintf("congo-%d", time.Now().UnixNano())
+            if cfg.ContainerID, err = container.GenerateID(); err != nil {
+                log.Fatalf("Error creating container: %v", err)
+            }
         }
         
         // Initialize container state
         cfg.State = types.ContainerState{
-            ID:        cfg.ContainerID,
-            Status:    "created",
-            CreatedAt: time.Now(),
-            Command:   cfg.Command,
-            RootDir:   cfg.Rootfs,
+            ID:         cfg.ContainerID,
+            Name:       cfg.Name,
+            Status:     "created",
+            CreatedAt:  time.Now(),
+            Command:    cfg.Command,
+            Entrypoint: cfg.Entrypoint,
+            WorkingDir: cfg.WorkingDir,
+            User:       cfg.User,
+            StopSignal: cfg.StopSignal,
+            Hostname:   cfg.Hostname,
+            Namespaces: cfg.Namespaces,
+            Pod:        cfg.Pod,
+            EnvVars:    cfg.EnvVars,
+            HostUID:    os.Getuid(),
+            HostGID:    os.Getgid(),
+            Labels:     cfg.Labels,
+            RootDir:    cfg.Rootfs,
+            Image:      cfg.Image,
+            ImageID:    cfg.ImageID,
+            UseLayers:  cfg.UseLayers,
+            ReadOnly:   cfg.ReadOnly,
+            Tmpfs:      cfg.Tmpfs,
         }
         
-        // Save the container state
-        if err := container.SaveContainerState(cfg.ContainerID, cfg.State); err != nil {
-            log.Fatalf("Error saving container state: %v", err)
+        cfg.State.Network.Mode = cfg.Network.Mode
+        cfg.State.Network.RequestedIPs = cfg.Network.ContainerIPs
+        cfg.State.Network.Bridge = cfg.Network.Bridge
+        cfg.State.Network.PortMaps = cfg.Network.PortMaps
+        cfg.State.Network.DNS = cfg.Network.DNS
+        cfg.State.Network.DNSSearch = cfg.Network.DNSSearch
+        cfg.State.Network.ExtraHosts = cfg.Network.ExtraHosts
+
+        // Save the container state, this also settles its name
+        if err := container.RegisterContainer(&cfg.State); err != nil {
+            log.Fatalf("Error creating container: %v", err)
         }
 
         fmt.Printf("Container created: %s\n", cfg.ContainerID)
 
 	case "commit":
 		// Create an image from a container
-		if len(os.Args) < 4 {
-			log.Fatalf("Usage: %s commit <container-id> <image-name>", os.Args[0])
+		var changes []string
+		var commitArgs []string
+		for i := 2; i < len(os.Args); i++ {
+			if os.Args[i] == "--change" || os.Args[i] == "-c" {
+				if i+1 >= len(os.Args) {
+					log.Fatalf("Missing value for %s", os.Args[i])
+				}
+				changes = append(changes, os.Args[i+1])
+				i++
+				continue
+			}
+			commitArgs = append(commitArgs, os.Args[i])
+		}
+		if len(commitArgs) != 2 {
+			log.Fatalf("Usage: %s commit [--change 'INSTRUCTION ...']... <container-id> <image-name>", os.Args[0])
 		}
-		containerID := os.Args[2]
-		imageName := os.Args[3]
+		containerID := resolveContainer(commitArgs[0])
+		imageName := commitArgs[1]
 		
-		if err := container.CommitContainer(containerID, imageName); err != nil {
+		if err := container.CommitContainer(containerID, imageName, changes); err != nil {
 			log.Fatalf("Error committing container: %v", err)
 		}
 		
 		fmt.Printf("Container %s committed to image: %s\n", containerID, imageName)
 	
+	case "build":
+		// Build an image from a Congofile
+		opts := build.Options{}
+		for i := 2; i < len(os.Args); i++ {
+			switch os.Args[i] {
+			case "-f", "--file", "-t", "--tag":
+				if i+1 >= len(os.Args) {
+					log.Fatalf("Missing value for %s", os.Args[i])
+				}
+				if os.Args[i] == "-f" || os.Args[i] == "--file" {
+					opts.File = os.Args[i+1]
+				} else {
+					opts.Tags = append(opts.Tags, os.Args[i+1])
+				}
+				i++
+			case "--no-cache":
+				opts.NoCache = true
+			default:
+				if opts.ContextDir != "" {
+					log.Fatalf("Unexpected argument: %s", os.Args[i])
+				}
+				opts.ContextDir = os.Args[i]
+			}
+		}
+		if opts.ContextDir == "" {
+			log.Fatalf("Usage: %s build [-f Congofile] [-t name[:tag]]... [--no-cache] <context-dir>", os.Args[0])
+		}
+
+		id, err := build.NewBuilder(opts).Build()
+		if err != nil {
+			log.Fatalf("Error building image: %v", err)
+		}
+		fmt.Printf("Successfully built %s\n", image.ShortID(id))
+		for _, tag := range opts.Tags {
+			fmt.Printf("Successfully tagged %s\n", image.NormalizeRef(tag))
+		}
+
+	case "export":
+		// Stream a container's filesystem as a tar archive
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s export <container-id> [-o file] > fs.tar", os.Args[0])
+		}
+		output := os.Stdout
+		if len(os.Args) > 4 && (os.Args[3] == "-o" || os.Args[3] == "--output") {
+			f, err := os.Create(os.Args[4])
+			if err != nil {
+				log.Fatalf("Error creating output file: %v", err)
+			}
+			defer f.Close()
+			output = f
+		}
+
+		if err := container.ExportContainer(resolveContainer(os.Args[2]), output); err != nil {
+			log.Fatalf("Error exporting container: %v", err)
+		}
+
+	case "cp":
+		// Copy files between the host and a container
+		if len(os.Args) != 4 {
+			log.Fatalf("Usage: %s cp <container-id>:<path> <host-path|-> | cp <host-path|-> <container-id>:<path>", os.Args[0])
+		}
+		srcID, srcPath := container.ParseCopyPath(os.Args[2])
+		destID, destPath := container.ParseCopyPath(os.Args[3])
+
+		var err error
+		switch {
+		case srcID != "" && destID == "":
+			err = container.CopyFromContainer(resolveContainer(srcID), srcPath, destPath, os.Stdout)
+		case srcID == "" && destID != "":
+			err = container.CopyToContainer(resolveContainer(destID), srcPath, destPath, os.Stdin)
+		default:
+			log.Fatalf("Exactly one of source and destination must be a container path (<container-id>:<path>)")
+		}
+		if err != nil {
+			log.Fatalf("Error copying: %v", err)
+		}
+
+	case "diff":
+		// Show what a container changed in its writable layer
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s diff <container-id>", os.Args[0])
+		}
+		changes, err := container.DiffContainer(resolveContainer(os.Args[2]))
+		if err != nil {
+			log.Fatalf("Error diffing container: %v", err)
+		}
+		for _, change := range changes {
+			fmt.Printf("%s %s\n", change.Kind, change.Path)
+		}
+
+	case "import":
+		// Create a single-layer image from a root filesystem tarball
+		if len(os.Args) < 4 {
+			log.Fatalf("Usage: %s import <fs.tar[.gz]|-> <image-name[:tag]>", os.Args[0])
+		}
+		input := os.Stdin
+		if os.Args[2] != "-" {
+			f, err := os.Open(os.Args[2])
+			if err != nil {
+				log.Fatalf("Error opening archive: %v", err)
+			}
+			defer f.Close()
+			input = f
+		}
+
+		img, err := image.Import(input, os.Args[3], os.Args[2])
+		if err != nil {
+			log.Fatalf("Error importing image: %v", err)
+		}
+		fmt.Printf("Imported image: %s (%s)\n", image.NormalizeRef(os.Args[3]), img.ID)
+
+	case "inspect":
+		// Print container (or image) details as JSON
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s inspect [--format template] [--type container|image] <container-id|image>...", os.Args[0])
+		}
+		inspectObjects(os.Args[2:], "")
+
+	case "image":
+		// Manage the local image store
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s image <load|save|inspect|history|prune> [args...]", os.Args[0])
+		}
+
+		switch os.Args[2] {
+		case "load":
+			// Import an OCI image layout (or docker save) tarball
+			if len(os.Args) < 4 {
+				log.Fatalf("Usage: %s image load <archive.tar|-> [image-name]", os.Args[0])
+			}
+			input := os.Stdin
+			if os.Args[3] != "-" {
+				f, err := os.Open(os.Args[3])
+				if err != nil {
+					log.Fatalf("Error opening image archive: %v", err)
+				}
+				defer f.Close()
+				input = f
+			}
+			name := ""
+			if len(os.Args) > 4 {
+				name = os.Args[4]
+			}
+
+			loaded, err := image.LoadArchive(input, name)
+			if err != nil {
+				log.Fatalf("Error loading image: %v", err)
+			}
+			for _, ref := range loaded {
+				fmt.Printf("Loaded image: %s\n", ref)
+			}
+
+		case "save":
+			// Export an image as an OCI image layout tarball
+			if len(os.Args) < 4 {
+				log.Fatalf("Usage: %s image save <image-name> [-o <archive.tar>]", os.Args[0])
+			}
+			output := os.Stdout
+			if len(os.Args) > 5 && os.Args[4] == "-o" {
+				f, err := os.Create(os.Args[5])
+				if err != nil {
+					log.Fatalf("Error creating image archive: %v", err)
+				}
+				defer f.Close()
+				output = f
+			}
+
+			if err := image.SaveArchive(os.Args[3], output); err != nil {
+				log.Fatalf("Error saving image: %v", err)
+			}
+
+		case "inspect":
+			// Print image details as JSON
+			if len(os.Args) < 4 {
+				log.Fatalf("Usage: %s image inspect [--format template] <image-name>...", os.Args[0])
+			}
+			inspectObjects(os.Args[3:], "image")
+
+		case "history":
+			// Show how each layer of an image was created
+			if len(os.Args) < 4 {
+				log.Fatalf("Usage: %s image history <image-name>", os.Args[0])
+			}
+			entries, err := image.ImageHistory(os.Args[3])
+			if err != nil {
+				log.Fatalf("Error reading image history: %v", err)
+			}
+			fmt.Printf("%-14s %-22s %-45s %-10s %s\n", "IMAGE", "CREATED", "CREATED BY", "SIZE", "COMMENT")
+			for _, entry := range entries {
+				id := entry.ID
+				if id != "<missing>" {
+					id = image.ShortID(id)
+				}
+				createdBy := entry.CreatedBy
+				if len(createdBy) > 45 {
+					createdBy = createdBy[:42] + "..."
+				}
+				fmt.Printf("%-14s %-22s %-45s %-10s %s\n",
+					id,
+					entry.Created.Format(time.RFC3339),
+					createdBy,
+					utils.FormatSize(entry.Size),
+					entry.Comment)
+			}
+
+		case "prune":
+			// Remove unused images and the layers only they referenced
+			all := false
+			filters := format.Filters{}
+			for i := 3; i < len(os.Args); i++ {
+				switch os.Args[i] {
+				case "-a", "--all":
+					all = true
+				case "--filter", "-f":
+					if i+1 >= len(os.Args) {
+						log.Fatalf("Missing value for %s", os.Args[i])
+					}
+					if err := filters.Add(os.Args[i+1], "label", "label!"); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					i++
+				default:
+					log.Fatalf("Unknown option: %s", os.Args[i])
+				}
+			}
+			inUse, err := container.ImagesInUse()
+			if err != nil {
+				log.Fatalf("Error listing containers: %v", err)
+			}
+			removed, reclaimed, err := image.Prune(all, inUse, func(img *image.Image) bool {
+				return filters.MatchLabels(img.Config.Labels)
+			})
+			if err != nil {
+				log.Fatalf("Error pruning images: %v", err)
+			}
+			for _, id := range removed {
+				fmt.Printf("Deleted: %s\n", id)
+			}
+			fmt.Printf("Total reclaimed space: %s\n", utils.FormatSize(reclaimed))
+
+		default:
+			log.Fatalf("Unknown image command: %s", os.Args[2])
+		}
+
+	case "network":
+		// Manage user-defined networks and what containers are on them
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s network <create|ls|rm|inspect|connect|disconnect> [args...]", os.Args[0])
+		}
+
+		switch os.Args[2] {
+		case "create":
+			var name string
+			opts := container.NetworkOptions{Labels: make(map[string]string)}
+			for i := 3; i < len(os.Args); i++ {
+				switch os.Args[i] {
+				case "--ipv6":
+					opts.IPv6 = true
+				case "--ipv4=false":
+					opts.NoIPv4 = true
+				case "--subnet", "--gateway", "--ipv6-mode", "--label":
+					if i+1 >= len(os.Args) {
+						log.Fatalf("Missing value for %s", os.Args[i])
+					}
+					switch os.Args[i] {
+					case "--subnet":
+						opts.Subnets = append(opts.Subnets, os.Args[i+1])
+					case "--gateway":
+						opts.Gateways = append(opts.Gateways, os.Args[i+1])
+					case "--ipv6-mode":
+						opts.IPv6Mode = os.Args[i+1]
+					case "--label":
+						parts := strings.SplitN(os.Args[i+1], "=", 2)
+						if len(parts) == 1 {
+							parts = append(parts, "")
+						}
+						opts.Labels[parts[0]] = parts[1]
+					}
+					i++
+				default:
+					if strings.HasPrefix(os.Args[i], "-") || name != "" {
+						log.Fatalf("Unknown option: %s", os.Args[i])
+					}
+					name = os.Args[i]
+				}
+			}
+			if name == "" {
+				log.Fatalf("Usage: %s network create [--subnet CIDR]... [--gateway IP]... [--ipv6] [--ipv4=false] [--ipv6-mode nat|routed] [--label key=value] <name>", os.Args[0])
+			}
+			n, err := container.CreateNetwork(name, opts)
+			if err != nil {
+				log.Fatalf("Error creating network: %v", err)
+			}
+			fmt.Println(n.ID)
+
+		case "ls":
+			quiet := false
+			for _, arg := range os.Args[3:] {
+				switch arg {
+				case "-q", "--quiet":
+					quiet = true
+				default:
+					log.Fatalf("Unknown option: %s", arg)
+				}
+			}
+			networks, err := container.ListNetworks()
+			if err != nil {
+				log.Fatalf("Error listing networks: %v", err)
+			}
+			if quiet {
+				for _, n := range networks {
+					fmt.Println(n.ID[:12])
+				}
+				break
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "NETWORK ID\tNAME\tDRIVER\tBRIDGE\tSUBNET\tGATEWAY")
+			for _, n := range networks {
+				var subnets, gateways []string
+				for _, s := range []string{n.Subnet, n.IPv6Subnet} {
+					if s != "" {
+						subnets = append(subnets, s)
+					}
+				}
+				for _, g := range []string{n.Gateway, n.IPv6Gateway} {
+					if g != "" {
+						gateways = append(gateways, g)
+					}
+				}
+				subnet, gateway := strings.Join(subnets, ","), strings.Join(gateways, ",")
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", n.ID[:12], n.Name, n.Driver, n.Bridge, subnet, gateway)
+			}
+			w.Flush()
+
+		case "rm":
+			if len(os.Args) < 4 {
+				log.Fatalf("Usage: %s network rm <network>...", os.Args[0])
+			}
+			failed := false
+			for _, ref := range os.Args[3:] {
+				n, err := container.RemoveNetwork(ref)
+				if err != nil {
+					log.Printf("Error removing network %s: %v", ref, err)
+					failed = true
+					continue
+				}
+				fmt.Println(n.Name)
+			}
+			if failed {
+				os.Exit(1)
+			}
+
+		case "inspect":
+			if len(os.Args) < 4 {
+				log.Fatalf("Usage: %s network inspect [--format template] <network>...", os.Args[0])
+			}
+			inspectObjects(os.Args[3:], "network")
+
+		case "connect":
+			var ips, refs []string
+			for i := 3; i < len(os.Args); i++ {
+				if os.Args[i] == "--ip" || os.Args[i] == "--ip6" {
+					if i+1 >= len(os.Args) {
+						log.Fatalf("Missing value for %s", os.Args[i])
+					}
+					var err error
+					if ips, err = network.SetRequestedIP(ips, os.Args[i], os.Args[i+1]); err != nil {
+						log.Fatalf("Error: %v", err)
+					}
+					i++
+					continue
+				}
+				refs = append(refs, os.Args[i])
+			}
+			if len(refs) != 2 {
+				log.Fatalf("Usage: %s network connect [--ip IP] [--ip6 IP] <network> <container>", os.Args[0])
+			}
+			if err := container.ConnectContainer(refs[0], resolveContainer(refs[1]), ips); err != nil {
+				log.Fatalf("Error connecting container: %v", err)
+			}
+
+		case "disconnect":
+			if len(os.Args) != 5 {
+				log.Fatalf("Usage: %s network disconnect <network> <container>", os.Args[0])
+			}
+			if err := container.DisconnectContainer(os.Args[3], resolveContainer(os.Args[4])); err != nil {
+				log.Fatalf("Error disconnecting container: %v", err)
+			}
+
+		default:
+			log.Fatalf("Unknown network command: %s", os.Args[2])
+		}
+
+	case "pod":
+		// Manage pods, groups of containers sharing namespaces
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s pod <create|ps|stop|rm> [args...]", os.Args[0])
+		}
+
+		switch os.Args[2] {
+		case "create":
+			var name, hostname, networkMode string
+			var ports []types.PortMapping
+			labels := make(map[string]string)
+			for i := 3; i < len(os.Args); i++ {
+				switch os.Args[i] {
+				case "--name", "--hostname", "--network", "--net", "--publish", "-p", "--label", "-l":
+					if i+1 >= len(os.Args) {
+						log.Fatalf("Missing value for %s", os.Args[i])
+					}
+					value := os.Args[i+1]
+					switch os.Args[i] {
+					case "--name":
+						name = value
+					case "--hostname":
+						hostname = value
+					case "--network", "--net":
+						networkMode = value
+					case "--publish", "-p":
+						port, err := network.ParsePortMapping(value)
+						if err != nil {
+							log.Fatalf("Error: %v", err)
+						}
+						ports = append(ports, port)
+					default:
+						parts := strings.SplitN(value, "=", 2)
+						if len(parts) == 1 {
+							parts = append(parts, "")
+						}
+						labels[parts[0]] = parts[1]
+					}
+					i++
+				default:
+					log.Fatalf("Usage: %s pod create [--name NAME] [--hostname NAME] [--network NETWORK] [-p PORT]... [--label key=value]...", os.Args[0])
+				}
+			}
+			pod, err := container.CreatePod(name, hostname, networkMode, ports, labels)
+			if err != nil {
+				log.Fatalf("Error creating pod: %v", err)
+			}
+			fmt.Println(pod.ID)
+
+		case "ps", "ls":
+			quiet := false
+			for _, arg := range os.Args[3:] {
+				switch arg {
+				case "-q", "--quiet":
+					quiet = true
+				default:
+					log.Fatalf("Unknown option: %s", arg)
+				}
+			}
+			pods, err := container.ListPods()
+			if err != nil {
+				log.Fatalf("Error listing pods: %v", err)
+			}
+			if quiet {
+				for _, pod := range pods {
+					fmt.Println(container.ShortID(pod.ID))
+				}
+				break
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "POD ID\tNAME\tSTATUS\tCREATED\tINFRA ID\t# OF CONTAINERS")
+			for _, pod := range pods {
+				status, containers, err := container.PodStatus(pod)
+				if err != nil {
+					log.Fatalf("Error listing pods: %v", err)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\t%s\t%d\n", container.ShortID(pod.ID), pod.Name, status,
+					utils.HumanDuration(time.Since(pod.Created)), container.ShortID(pod.InfraID), containers)
+			}
+			w.Flush()
+
+		case "stop", "rm":
+			force := false
+			var refs []string
+			for _, arg := range os.Args[3:] {
+				if arg == "--force" || arg == "-f" {
+					force = true
+					continue
+				}
+				refs = append(refs, arg)
+			}
+			if len(refs) == 0 {
+				log.Fatalf("Usage: %s pod %s [--force] <pod>...", os.Args[0], os.Args[2])
+			}
+			failed := false
+			for _, ref := range refs {
+				var pod *container.Pod
+				var err error
+				if os.Args[2] == "stop" {
+					pod, err = container.StopPod(ref, force)
+				} else {
+					pod, err = container.RemovePod(ref, force)
+				}
+				if err != nil {
+					log.Printf("Error: %v", err)
+					failed = true
+					continue
+				}
+				fmt.Println(pod.Name)
+			}
+			if failed {
+				os.Exit(1)
+			}
+
+		default:
+			log.Fatalf("Unknown pod command: %s", os.Args[2])
+		}
+
+	case "pull", "push":
+		// Transfer images to and from an OCI distribution registry
+		args := os.Args[2:]
+		insecure := len(args) > 0 && args[0] == "--insecure"
+		if insecure {
+			args = args[1:]
+		}
+		if len(args) < 1 {
+			log.Fatalf("Usage: %s pull [--insecure] <image-ref> | push [--insecure] <image-name> [remote-ref]", os.Args[0])
+		}
+
+		client := registry.NewClient()
+		client.Insecure = insecure
+		client.Out = os.Stdout
+
+		if os.Args[1] == "pull" {
+			img, err := client.Pull(args[0])
+			if err != nil {
+				log.Fatalf("Error pulling image: %v", err)
+			}
+			fmt.Printf("Pulled image: %s (%s)\n", args[0], img.ID)
+		} else {
+			remote := args[0]
+			if len(args) > 1 {
+				remote = args[1]
+			}
+			if err := client.Push(args[0], remote); err != nil {
+				log.Fatalf("Error pushing image: %v", err)
+			}
+		}
+
+	case "images":
+		// List images in the local store
+		filters := format.Filters{}
+		for i := 2; i < len(os.Args); i++ {
+			if os.Args[i] != "--filter" && os.Args[i] != "-f" {
+				log.Fatalf("Unknown option: %s", os.Args[i])
+			}
+			if i+1 >= len(os.Args) {
+				log.Fatalf("Missing value for %s", os.Args[i])
+			}
+			if err := filters.Add(os.Args[i+1], "label", "label!", "dangling", "reference"); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			i++
+		}
+		images, err := image.ListImages()
+		if err != nil {
+			log.Fatalf("Error listing images: %v", err)
+		}
+		repos, err := image.LoadRepositories()
+		if err != nil {
+			log.Fatalf("Error listing images: %v", err)
+		}
+
+		fmt.Printf("%-40s %-15s %-14s %-22s %-10s\n", "REPOSITORY", "TAG", "IMAGE ID", "CREATED", "SIZE")
+		for _, img := range images {
+			tags := image.RepoTags(repos, img.ID)
+			dangling := strconv.FormatBool(len(tags) == 0)
+			if !filters.MatchLabels(img.Config.Labels) || !filters.Match("dangling", dangling) {
+				continue
+			}
+			if len(tags) == 0 {
+				tags = []string{"<none>:<none>"}
+			}
+			for _, ref := range tags {
+				repo, tag := image.SplitRef(ref)
+				if !filters.MatchFunc("reference", func(want string) bool {
+					matched, _ := filepath.Match(want, ref)
+					return matched || want == repo
+				}) {
+					continue
+				}
+				fmt.Printf("%-40s %-15s %-14s %-22s %-10s\n",
+					repo,
+					tag,
+					image.ShortID(img.ID),
+					img.Created.Format(time.RFC3339),
+					utils.FormatSize(image.Size(img)))
+			}
+		}
+
+	case "rmi":
+		// Remove images, layers still used elsewhere are kept
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s rmi <image-name>...", os.Args[0])
+		}
+		inUse, err := container.ImagesInUse()
+		if err != nil {
+			log.Fatalf("Error listing containers: %v", err)
+		}
+		for _, ref := range os.Args[2:] {
+			removed, err := image.RemoveImage(ref, inUse)
+			if err != nil {
+				log.Fatalf("Error removing image: %v", err)
+			}
+			for _, line := range removed {
+				fmt.Println(line)
+			}
+		}
+
+	case "tag":
+		// Add a name to an image
+		if len(os.Args) < 4 {
+			log.Fatalf("Usage: %s tag <source-image> <target-name[:tag]>", os.Args[0])
+		}
+		img, err := image.Lookup(os.Args[2])
+		if err != nil {
+			log.Fatalf("Error tagging image: %v", err)
+		}
+		if err := image.Tag(os.Args[3], img.ID); err != nil {
+			log.Fatalf("Error tagging image: %v", err)
+		}
+
+	case "rename":
+		// Give a container a new name
+		if len(os.Args) != 4 {
+			log.Fatalf("Usage: %s rename <container> <new-name>", os.Args[0])
+		}
+		containerID := resolveContainer(os.Args[2])
+
+		if err := container.RenameContainer(containerID, os.Args[3]); err != nil {
+			log.Fatalf("Error renaming container: %v", err)
+		}
+
 	case "logs":
 		// View container logs
 		if len(os.Args) < 3 {
 			log.Fatalf("Usage: %s logs <container-id>", os.Args[0])
 		}
-		containerID := os.Args[2]
+		containerID := resolveContainer(os.Args[2])
 		
 		if err := logging.ViewContainerLogs(containerID); err != nil {
 			log.Fatalf("Error viewing container logs: %v", err)
@@ -94,7 +784,7 @@ func main() {
         if len(os.Args) < 3 {
             log.Fatalf("Usage: %s start <container-id>", os.Args[0])
         }
-        containerID := os.Args[2]
+        containerID := resolveContainer(os.Args[2])
 
         if err := container.StartContainer(containerID, os.Args[3:]); err != nil {
             log.Fatalf("Error starting container: %v", err)
@@ -107,7 +797,7 @@ func main() {
 		if len(os.Args) < 3 {
 			log.Fatalf("Usage: %s rm <container-id>", os.Args[0])
 		}
-		containerID := os.Args[2]
+		containerID := resolveContainer(os.Args[2])
 		
 		if err := container.RemoveContainer(containerID); err != nil {
 			log.Fatalf("Error removing container: %v", err)
@@ -120,7 +810,7 @@ func main() {
         if len(os.Args) < 3 {
             log.Fatalf("Usage: %s stop <container-id> [--force]", os.Args[0])
         }
-        containerID := os.Args[2]
+        containerID := resolveContainer(os.Args[2])
         force := len(os.Args) > 3 && os.Args[3] == "--force"
         
         if err := container.StopContainer(containerID, force); err != nil {
@@ -134,7 +824,7 @@ func main() {
         if len(os.Args) < 3 {
             log.Fatalf("Usage: %s restart <container-id>", os.Args[0])
         }
-        containerID := os.Args[2]
+        containerID := resolveContainer(os.Args[2])
 
         if err := container.RestartContainer(containerID); err != nil {
             log.Fatalf("Error restarting container: %v", err)
@@ -147,7 +837,7 @@ func main() {
         if len(os.Args) < 4 {
             log.Fatalf("Usage: %s exec <container-id> <command> [args...]", os.Args[0])
         }
-        containerID := os.Args[2]
+        containerID := resolveContainer(os.Args[2])
         command := os.Args[3:]
         
         if err := container.ExecInContainer(containerID, command); err != nil {
@@ -159,7 +849,7 @@ func main() {
         if len(os.Args) < 3 {
             log.Fatalf("Usage: %s shell <container-id>", os.Args[0])
         }
-        containerID := os.Args[2]
+        containerID := resolveContainer(os.Args[2])
         
         // Default to bash, but fall back to sh if not available
         shell := []string{"/bin/bash"}
@@ -171,26 +861,107 @@ func main() {
         }
         
     case "ps":
-        // List containers
+        // List containers, running ones only unless -a is given
+        var all, quiet, noTrunc bool
+        var tmpl *template.Template
+        var jsonOutput bool
+        filters := format.Filters{}
+        args := os.Args[2:]
+        for i := 0; i < len(args); i++ {
+            switch args[i] {
+            case "-a", "--all":
+                all = true
+            case "-q", "--quiet":
+                quiet = true
+            case "--no-trunc":
+                noTrunc = true
+            case "--filter", "-f", "--format":
+                if i+1 >= len(args) {
+                    log.Fatalf("Missing value for %s", args[i])
+                }
+                if args[i] == "--format" {
+                    if args[i+1] == "json" {
+                        jsonOutput = true
+                    } else {
+                        var err error
+                        if tmpl, err = format.Parse(args[i+1]); err != nil {
+                            log.Fatalf("Error: %v", err)
+                        }
+                    }
+                } else if err := filters.Add(args[i+1], "status", "label", "label!", "name", "id", "ancestor"); err != nil {
+                    log.Fatalf("Error: %v", err)
+                }
+                i++
+            default:
+                log.Fatalf("Unknown option: %s", args[i])
+            }
+        }
+        // Asking for a status other than running only makes sense with stopped containers listed
+        if filters.Has("status") {
+            all = true
+        }
+
         containers, err := container.ListContainers()
         if err != nil {
             log.Fatalf("Error listing containers: %v", err)
         }
-        
-        // Print container information
-        fmt.Printf("%-20s %-10s %-20s %-30s\n", "CONTAINER ID", "STATUS", "CREATED", "COMMAND")
-        for _, container := range containers {
-            cmdStr := strings.Join(container.Command, " ")
-            if len(cmdStr) > 30 {
-                cmdStr = cmdStr[:27] + "..."
+        sort.Slice(containers, func(i, j int) bool {
+            return containers[i].CreatedAt.After(containers[j].CreatedAt)
+        })
+
+        var rows []container.ContainerSummary
+        for _, state := range containers {
+            summary := container.Summarize(state, noTrunc)
+            if !all && summary.State != "running" && summary.State != "paused" {
+                continue
             }
-            fmt.Printf("%-20s %-10s %-20s %-30s\n", 
-                container.ID, 
-                container.Status, 
-                container.CreatedAt.Format(time.RFC3339), 
-                cmdStr)
+            if !filters.Match("status", summary.State) ||
+                !filters.MatchLabels(state.Labels) ||
+                !filters.MatchFunc("id", func(want string) bool { return strings.HasPrefix(state.ID, want) }) ||
+                !filters.MatchFunc("name", func(want string) bool { return strings.Contains(state.Name, want) }) ||
+                !filters.MatchFunc("ancestor", func(want string) bool { return container.HasAncestor(state, want) }) {
+                continue
+            }
+            rows = append(rows, summary)
         }
-        
+
+        switch {
+        case quiet:
+            for _, row := range rows {
+                fmt.Println(row.ID)
+            }
+        case jsonOutput:
+            // One object per line so the output can be streamed into jq
+            enc := json.NewEncoder(os.Stdout)
+            enc.SetEscapeHTML(false)
+            for _, row := range rows {
+                if err := enc.Encode(row); err != nil {
+                    log.Fatalf("Error: %v", err)
+                }
+            }
+        case tmpl != nil:
+            for _, row := range rows {
+                if err := format.Execute(os.Stdout, tmpl, row); err != nil {
+                    log.Fatalf("Error: %v", err)
+                }
+            }
+        default:
+            w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+            fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tPORTS\tIP\tNAMES")
+            for _, row := range rows {
+                fmt.Fprintf(w, "%s\t%s\t%q\t%s\t%s\t%s\t%s\t%s\n",
+                    row.ID,
+                    row.Image,
+                    row.Command,
+                    row.RunningFor,
+                    row.Status,
+                    row.Ports,
+                    row.IP,
+                    row.Name)
+            }
+            w.Flush()
+        }
+
     case "child":
         // Handle child process (container process)
         isChild := true
@@ -203,6 +974,11 @@ func main() {
             log.Fatalf("Invalid config: %v", err)
         }
 
+        // Blocks until the parent has set up the host side of the network
+        if err := network.ConfigureContainer(cfg); err != nil {
+            log.Fatalf("Error configuring container network: %v", err)
+        }
+
         if err := setups.SetupContainer(cfg); err != nil {
             log.Fatalf("Error setting up container: %v", err)
         }
@@ -217,18 +993,78 @@ func main() {
                 }
             }
         } else {
-            // In non-interactive mode, execute the specified command
-            if err := unix.Exec(cfg.Command[0], cfg.Command, os.Environ()); err != nil {
+            // In non-interactive mode, execute the specified command, image
+            // commands may rely on the container's PATH
+            path, err := exec.LookPath(cfg.Command[0])
+            if err != nil {
+                log.Fatalf("Error finding command: %v", err)
+            }
+            if err := unix.Exec(path, cfg.Command, os.Environ()); err != nil {
                 log.Fatalf("Error executing command: %v", err)
             }
         }
 
+	case "port":
+		// List a container's published ports
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			log.Fatalf("Usage: %s port <container-id> [port[/protocol]]", os.Args[0])
+		}
+		containerPort := ""
+		if len(os.Args) == 4 {
+			containerPort = os.Args[3]
+		}
+		ports, err := container.PublishedPorts(resolveContainer(os.Args[2]), containerPort)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		for _, port := range ports {
+			hostIP := port.HostIP
+			if hostIP == "" {
+				hostIP = "0.0.0.0"
+			}
+			hostAddr := net.JoinHostPort(hostIP, strconv.Itoa(port.HostPort))
+			if containerPort != "" {
+				fmt.Println(hostAddr)
+				continue
+			}
+			fmt.Printf("%d/%s -> %s\n", port.ContainerPort, port.Protocol, hostAddr)
+		}
+
+	case "proxy":
+		// Forward a published port when no firewall can, started by the
+		// container's parent
+		if len(os.Args) != 5 {
+			log.Fatalf("Usage: %s proxy <tcp|udp> <listen-address> <container-address>", os.Args[0])
+		}
+		if err := network.RunProxy(os.Args[2], os.Args[3], os.Args[4]); err != nil {
+			os.Exit(1)
+		}
+
+	case "dns":
+		// Resolve container names on a user-defined network, started by
+		// the parent of its first container
+		if len(os.Args) != 3 {
+			log.Fatalf("Usage: %s dns <network>", os.Args[0])
+		}
+		if err := container.RunDNS(os.Args[2]); err != nil {
+			os.Exit(1)
+		}
+
+	case "infra":
+		// Hold the namespaces of a pod, started by `congo pod create`
+		if len(os.Args) != 3 {
+			log.Fatalf("Usage: %s infra <container-id>", os.Args[0])
+		}
+		if err := container.RunInfra(os.Args[2]); err != nil {
+			os.Exit(1)
+		}
+
 	case "pause":
 		// Pause a running container
 		if len(os.Args) < 3 {
 			log.Fatalf("Usage: %s pause <container-id>", os.Args[0])
 		}
-		containerID := os.Args[2]
+		containerID := resolveContainer(os.Args[2])
 		
 		if err := container.PauseContainer(containerID); err != nil {
 			log.Fatalf("Error pausing container: %v", err)
@@ -241,7 +1077,7 @@ func main() {
 		if len(os.Args) < 3 {
 			log.Fatalf("Usage: %s unpause <container-id>", os.Args[0])
 		}
-		containerID := os.Args[2]
+		containerID := resolveContainer(os.Args[2])
 		
 		if err := container.UnpauseContainer(containerID); err != nil {
 			log.Fatalf("Error unpausing container: %v", err)
@@ -253,7 +1089,7 @@ func main() {
 		if len(os.Args) < 3 {
 			log.Fatalf("Usage: %s update <container-id> [--memory=<limit>] [--cpu=<shares>] [--pids=<limit>]", os.Args[0])
 		}
-		containerID := os.Args[2]
+		containerID := resolveContainer(os.Args[2])
 		
 		var memory, cpu string
 		var pids int
@@ -285,7 +1121,7 @@ func main() {
 		if len(os.Args) < 5 {
 			log.Fatalf("Usage: %s volume-add <container-id> <host-path> <container-path> [ro]", os.Args[0])
 		}
-		containerID := os.Args[2]
+		containerID := resolveContainer(os.Args[2])
 		hostPath := os.Args[3]
 		containerPath := os.Args[4]
 		readOnly := len(os.Args) > 5 && os.Args[5] == "ro"
@@ -301,7 +1137,7 @@ func main() {
 		if len(os.Args) < 4 {
 			log.Fatalf("Usage: %s volume-remove <container-id> <container-path>", os.Args[0])
 		}
-		containerID := os.Args[2]
+		containerID := resolveContainer(os.Args[2])
 		containerPath := os.Args[3]
 
 		if err := container.RemoveVolumeFromContainer(containerID, containerPath); err != nil {
@@ -320,66 +1156,84 @@ func main() {
         if err := config.ValidateConfig(cfg); err != nil {
             log.Fatalf("Invalid config: %v", err)
         }
+        if err := container.ResolveNamespaces(cfg); err != nil {
+            log.Fatalf("Invalid config: %v", err)
+        }
         
         // Generate a unique container ID
         if cfg.ContainerID == "" {
-            cfg.ContainerID = fmt.Sprintf("congo-%d", time.Now().UnixNano())
+            if cfg.ContainerID, err = container.GenerateID(); err != nil {
+                log.Fatalf("Error creating container: %v", err)
+            }
         }
         
         // Initialize container state
         cfg.State = types.ContainerState{
-            ID:        cfg.ContainerID,
-            Status:    "created", // Will be updated to "running" when started
-            CreatedAt: time.Now(),
-            Command:   cfg.Command,
-            RootDir:   cfg.Rootfs,
+            ID:         cfg.ContainerID,
+            Name:       cfg.Name,
+            Status:     "created", // Will be updated to "running" when started
+            CreatedAt:  time.Now(),
+            Command:    cfg.Command,
+            Entrypoint: cfg.Entrypoint,
+            WorkingDir: cfg.WorkingDir,
+            User:       cfg.User,
+            StopSignal: cfg.StopSignal,
+            Hostname:   cfg.Hostname,
+            Namespaces: cfg.Namespaces,
+            Pod:        cfg.Pod,
+            EnvVars:    cfg.EnvVars,
+            HostUID:    os.Getuid(),
+            HostGID:    os.Getgid(),
+            Labels:     cfg.Labels,
+            RootDir:    cfg.Rootfs,
+            Image:      cfg.Image,
+            ImageID:    cfg.ImageID,
+            UseLayers:  cfg.UseLayers,
+            ReadOnly:   cfg.ReadOnly,
+            Tmpfs:      cfg.Tmpfs,
         }
 
-        cfg.State.Network.ContainerIP = cfg.Network.ContainerIP
+        cfg.State.Network.Mode = cfg.Network.Mode
+        cfg.State.Network.RequestedIPs = cfg.Network.ContainerIPs
 		cfg.State.Network.Bridge = cfg.Network.Bridge
 		cfg.State.Network.PortMaps = cfg.Network.PortMaps
+		cfg.State.Network.DNS = cfg.Network.DNS
+		cfg.State.Network.DNSSearch = cfg.Network.DNSSearch
+		cfg.State.Network.ExtraHosts = cfg.Network.ExtraHosts
         
-        // Save the container state
-        if err := container.SaveContainerState(cfg.ContainerID, cfg.State); err != nil {
-            log.Fatalf("Error saving container state: %v", err)
+        // Save the container state, this also settles its name
+        if err := container.RegisterContainer(&cfg.State); err != nil {
+            log.Fatalf("Error creating container: %v", err)
         }
         
-        // Start the container
-        cmd := exec.Command("/proc/self/exe", append([]string{"child"}, os.Args[2:]...)...)
+        // Start the container, the child needs the ID to find its overlay directories
+        childArgs := container.InjectOptions(os.Args[2:], "--id", cfg.ContainerID)
+        cmd := exec.Command("/proc/self/exe", append([]string{"child"}, childArgs...)...)
         cmd.Stdin = os.Stdin
         cmd.Stdout = os.Stdout
         cmd.Stderr = os.Stderr
-        cmd.SysProcAttr = &syscall.SysProcAttr{
-            Cloneflags: syscall.CLONE_NEWUTS |
-                syscall.CLONE_NEWPID |
-                syscall.CLONE_NEWNS |
-                syscall.CLONE_NEWNET |
-                syscall.CLONE_NEWIPC |
-                syscall.CLONE_NEWUSER,
-            UidMappings: []syscall.SysProcIDMap{
-                {
-                    ContainerID: 0,
-                    HostID:     os.Getuid(),
-                    Size:       1,
-                },
-            },
-            GidMappings: []syscall.SysProcIDMap{
-                {
-                    ContainerID: 0,
-                    HostID:     os.Getgid(),
-                    Size:       1,
-                },
-            },
-            Unshareflags: unix.CLONE_NEWNS,
+        // The child waits on this pipe until its network is wired up
+        syncR, syncW, err := os.Pipe()
+        if err != nil {
+            log.Fatalf("Error creating sync pipe: %v", err)
         }
+        cmd.ExtraFiles = []*os.File{syncR}
         
-        if err := cmd.Start(); err != nil {
+        if err := container.StartProcess(cmd, &cfg.State); err != nil {
             log.Fatalf("Error starting container: %v", err)
         }
+        syncR.Close()
+
+        if err := container.ConnectNetwork(&cfg.State, cmd.Process.Pid, &cfg.Network, syncW); err != nil {
+            cmd.Process.Kill()
+            cmd.Wait()
+            log.Fatalf("Error setting up container network: %v", err)
+        }
         
         // Update container state
         cfg.State.Status = "running"
         cfg.State.Pid = cmd.Process.Pid
+        cfg.State.StartedAt = time.Now()
         if err := container.SaveContainerState(cfg.ContainerID, cfg.State); err != nil {
             log.Printf("Warning: failed to update container state: %v", err)
         }
@@ -392,6 +1246,13 @@ func main() {
                 log.Printf("Container exited with error: %v", err)
             }
             
+            if err := container.CleanupPortForwarding(cfg.ContainerID); err != nil {
+                log.Printf("Warning: failed to clean up port forwarding rules: %v", err)
+            }
+            if err := container.ReleaseNetwork(&cfg.State); err != nil {
+                log.Printf("Warning: failed to release container address: %v", err)
+            }
+
             // Update container state to stopped
             cfg.State.Status = "stopped"
             cfg.State.Pid = 0
@@ -405,4 +1266,85 @@ func main() {
     }
 }
 
+// inspectObjects prints details of containers and images as a JSON array or,
+// with --format, through a Go template per object. Without a --type, names
+// that aren't containers are looked up as images.
+func inspectObjects(args []string, kind string) {
+	var tmpl *template.Template
+	var names []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--format", "-f", "--type":
+			if i+1 >= len(args) {
+				log.Fatalf("Missing value for %s", args[i])
+			}
+			if args[i] == "--type" {
+				kind = args[i+1]
+			} else {
+				var err error
+				if tmpl, err = format.Parse(args[i+1]); err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+			}
+			i++
+		default:
+			names = append(names, args[i])
+		}
+	}
+	if kind != "" && kind != "container" && kind != "image" && kind != "network" {
+		log.Fatalf("Unknown type %s, expected container, image or network", kind)
+	}
 
+	var objects []interface{}
+	for _, name := range names {
+		if kind == "network" {
+			info, err := container.InspectNetwork(name)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			objects = append(objects, info)
+			continue
+		}
+		if kind != "image" {
+			containerID, err := container.ResolveContainerID(name)
+			if err == nil {
+				info, err := container.InspectContainer(containerID)
+				if err != nil {
+					log.Fatalf("Error inspecting container: %v", err)
+				}
+				objects = append(objects, info)
+				continue
+			}
+			if kind == "container" {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+		info, err := image.Inspect(name)
+		if err != nil {
+			log.Fatalf("Error: no such container or image: %s", name)
+		}
+		objects = append(objects, info)
+	}
+
+	if tmpl == nil {
+		if err := format.JSON(os.Stdout, objects); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	for _, object := range objects {
+		if err := format.Execute(os.Stdout, tmpl, object); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+}
+
+// resolveContainer turns a container name or ID prefix given on the command
+// line into the full container ID
+func resolveContainer(ref string) string {
+	containerID, err := container.ResolveContainerID(ref)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	return containerID
+}